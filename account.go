@@ -0,0 +1,410 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/mdlayher/gosubsonic"
+)
+
+// account is a set of Subsonic credentials, along with the state fetched on its behalf
+type account struct {
+	// Name of the account's top-level directory when several accounts are mounted
+	Name string
+
+	// Connection parameters for API requests, with the password guarded by credLock as it is replaced
+	// when credentials are reloaded
+	Host     string
+	User     string
+	credLock sync.RWMutex
+	Password string
+
+	// version is the Subsonic API version targeted, negotiated at startup and updated from the watchdog's
+	// pings under versionLock, as the server may be upgraded while mounted
+	versionLock sync.RWMutex
+	version     string
+
+	// config is the account's configuration, from which credentials are reloaded, and authRejected is 1
+	// while the server rejects them
+	config       UserConfig
+	authRejected int32
+
+	// sfs is the instance serving this account
+	sfs *Filesystem
+
+	// artistsIndex stores the fetched top-level artists, replaced as a whole under indexLock
+	indexLock    sync.RWMutex
+	artistsIndex map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist
+
+	// indexReady is closed once the index is first populated, blocking subfs from listing it until then
+	indexReady chan struct{}
+	readyOnce  sync.Once
+
+	// refreshIndex wakes the index refresh early, as requested through the control API
+	refreshIndex chan struct{}
+
+	// indexUpdated is the Unix time at which the artist index was last refreshed, and generation counts
+	// its refreshes, with nodes remembering the latest directory listed at each path of the tree
+	indexUpdated int64
+	generation   int64
+	nodes        *nodeRegistry
+
+	// quirks describes how the server departs from Subsonic, detected at startup
+	quirks serverQuirks
+
+	// songs remembers every song seen in a directory listing
+	songs *songStore
+
+	// audiobooks lists the path prefixes below which directories hold audiobooks
+	audiobooks []string
+
+	// playlistsChanged counts the changes subfs made to playlists, expiring them when it changes
+	playlistsChanged int64
+
+	// smartPlaylists are the smart playlists shown in this account's root
+	smartPlaylists []SmartPlaylistConfig
+
+	// offline is 1 while the server is unreachable, along with the number of consecutive failed pings
+	// and the Unix time of the last successful one
+	offline      int32
+	pingFailures int64
+	lastContact  int64
+
+	// info describes the server's version, license and library scan, gathered on each successful ping
+	infoLock sync.Mutex
+	info     serverInfo
+
+	// latencies times each Subsonic method called, for -slow-api and the metrics endpoint
+	latencies *apiLatencies
+
+	// searches holds the latest query written to .subfs/search, and its results
+	searches *searchResults
+
+	// various holds the compilations found for -various-artists, and the artists only appearing on them
+	various compilationSet
+}
+
+// newAccount connects to Subsonic using the given credentials, checking that the server answers a ping
+// within -api-timeout, as every request goes through the shared HTTP clients
+func newAccount(config UserConfig) (*account, error) {
+	password, err := resolvePassword(config)
+	if err != nil {
+		return nil, err
+	}
+
+	a := accountFor(config, password)
+	if err := apiGet(a, "ping", url.Values{}, nil); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// accountFor returns the account for config and its resolved password, with empty state
+func accountFor(config UserConfig, password string) *account {
+	name := config.Name
+	if name == "" {
+		name = config.User
+	}
+
+	return &account{
+		Name:         name,
+		Host:         config.Host,
+		User:         config.User,
+		Password:     password,
+		config:       config,
+		artistsIndex: make(map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist),
+		indexReady:   make(chan struct{}),
+		refreshIndex: make(chan struct{}, 1),
+		songs:        &songStore{songs: map[int64]apiChild{}},
+		latencies:    newAPILatencies(),
+		nodes:        newNodeRegistry(),
+		searches:     &searchResults{},
+	}
+}
+
+// indexRefresh is the interval between refreshes of the artist index
+var indexRefresh = flag.Duration("index-refresh", 10*time.Minute, "Interval between refreshes of the artist index, which only fetch changed folders")
+
+// includeFolders and excludeFolders choose which music folders are mounted and indexed, by name
+var includeFolders = flag.String("folders", "", "Comma-separated names of the only music folders to mount and index, such as Music,Audiobooks")
+var excludeFolders = flag.String("exclude-folders", "", "Comma-separated names of music folders not to mount or index")
+
+// folderSelected reports whether a music folder is chosen by -folders and -exclude-folders
+func folderSelected(name string) bool {
+	listed := func(names string) bool {
+		for _, n := range strings.Split(names, ",") {
+			if strings.EqualFold(strings.TrimSpace(n), name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if *includeFolders != "" && !listed(*includeFolders) {
+		return false
+	}
+	return *excludeFolders == "" || !listed(*excludeFolders)
+}
+
+// fullIndexRefresh is the interval between refreshes which fetch every folder, even if unchanged, as
+// servers can't tell a folder which became empty from one which didn't change
+const fullIndexRefresh = time.Hour
+
+// indexWait is the longest a listing waits for the first index before showing whichever folders have loaded
+const indexWait = 30 * time.Second
+
+// indexRetry is the delay before retrying a failed fetch of the music folders
+const indexRetry = 30 * time.Second
+
+// fetchMusicFolders returns the server's music folders
+func fetchMusicFolders(a *account) ([]gosubsonic.MusicFolder, error) {
+	var res struct {
+		MusicFolders struct {
+			MusicFolder []struct {
+				ID   apiInt `json:"id"`
+				Name string `json:"name"`
+			} `json:"musicFolder"`
+		} `json:"musicFolders"`
+	}
+	if err := apiGet(a, "getMusicFolders", url.Values{}, &res); err != nil {
+		return nil, err
+	}
+
+	folders := make([]gosubsonic.MusicFolder, 0, len(res.MusicFolders.MusicFolder))
+	for _, f := range res.MusicFolders.MusicFolder {
+		folders = append(folders, gosubsonic.MusicFolder{
+			ID:   int64(f.ID),
+			Name: f.Name,
+		})
+	}
+	return folders, nil
+}
+
+// fetchIndexes retrieves the artists of a music folder, or none if it hasn't changed since the given
+// time, along with the server's time of the folder's last change, in milliseconds as used by
+// ifModifiedSince.  A since of -1 fetches the folder whether or not it changed.
+func fetchIndexes(a *account, folderID int64, since int64) ([]gosubsonic.Index, int64, error) {
+	params := url.Values{}
+	params.Set("musicFolderId", strconv.FormatInt(folderID, 10))
+	if since >= 0 {
+		params.Set("ifModifiedSince", strconv.FormatInt(since, 10))
+	}
+
+	var res struct {
+		Indexes struct {
+			LastModified int64 `json:"lastModified"`
+			Index        []struct {
+				Name   string `json:"name"`
+				Artist []struct {
+					ID   apiInt `json:"id"`
+					Name string `json:"name"`
+				} `json:"artist"`
+			} `json:"index"`
+		} `json:"indexes"`
+	}
+	if err := apiGet(a, "getIndexes", params, &res); err != nil {
+		return nil, 0, err
+	}
+
+	indexes := make([]gosubsonic.Index, 0, len(res.Indexes.Index))
+	for _, i := range res.Indexes.Index {
+		index := gosubsonic.Index{Name: i.Name}
+		for _, artist := range i.Artist {
+			index.Artist = append(index.Artist, gosubsonic.IndexArtist{
+				ID:   int64(artist.ID),
+				Name: artist.Name,
+			})
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, res.Indexes.LastModified, nil
+}
+
+// cacheIndexes populates and refills the indexes cache at regular intervals
+func (a *account) cacheIndexes() {
+	// Server time of the last change to each folder, and local time of the last full refresh, in
+	// milliseconds as used by ifModifiedSince.  Only the server's own clock is compared with its changes.
+	lastModified := map[int64]int64{}
+	var full int64
+
+	// Immediately cache the current index
+	for {
+		started := time.Now().UnixNano() / int64(time.Millisecond)
+		if started-full > int64(fullIndexRefresh/time.Millisecond) {
+			lastModified, full = map[int64]int64{}, started
+		}
+
+		// Previous index, without waiting for it to be ready as index() does
+		a.indexLock.RLock()
+		previous := a.artistsIndex
+		a.indexLock.RUnlock()
+
+		// Fetch the main folders
+		// Without them, keep the previous index, or an empty one, so that listings don't block, and try again
+		folders, err := fetchMusicFolders(a)
+		if err != nil {
+			log.Printf("Failed to retrieve music folders for %s: %s", a.Name, err.Error())
+			a.readyOnce.Do(func() {
+				close(a.indexReady)
+			})
+			<-time.After(indexRetry)
+			continue
+		}
+
+		// Fetch indexes
+		index := make(map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist)
+		for _, folder := range folders {
+			if !folderSelected(folder.Name) {
+				continue
+			}
+
+			// get all the letters of this folder, unless unchanged since the server last reported a change
+			since, ok := lastModified[folder.ID]
+			if !ok {
+				since = -1
+			}
+			indexes, modified, err := fetchIndexes(a, folder.ID, since)
+			if err != nil {
+				// Keep showing a folder which failed to refresh, but omit one which never loaded
+				log.Printf("Failed to retrieve indexes of %s: %s", folder.Name, err.Error())
+				if artists, ok := previous[folder]; ok {
+					index[folder] = artists
+				}
+				continue
+			}
+
+			if modified > 0 {
+				lastModified[folder.ID] = modified
+			}
+
+			// Unchanged folders come back empty, so keep their previous artists
+			if artists, ok := previous[folder]; ok && len(indexes) == 0 && since != -1 {
+				index[folder] = artists
+				continue
+			}
+
+			// Cache and return indexes
+			index[folder] = make([]gosubsonic.IndexArtist, 0)
+			for _, i := range indexes {
+				for _, artist := range i.Artist {
+					index[folder] = append(index[folder], artist)
+				}
+			}
+			log.Printf("Caching %d artists", len(index[folder]))
+
+			// Until the first index is complete, publish each folder as it loads, for listings which
+			// give up waiting
+			select {
+			case <-a.indexReady:
+			default:
+				partial := make(map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist, len(index))
+				for f, artists := range index {
+					partial[f] = artists
+				}
+				a.indexLock.Lock()
+				a.artistsIndex = partial
+				a.indexLock.Unlock()
+			}
+		}
+
+		a.indexLock.Lock()
+		a.artistsIndex = index
+		a.indexLock.Unlock()
+
+		log.Printf("Finished caching artists for %s", a.Name)
+		atomic.StoreInt64(&a.indexUpdated, time.Now().Unix())
+		a.readyOnce.Do(func() {
+			close(a.indexReady)
+		})
+
+		// Directories already resolved from an earlier index find their fresh counterparts
+		if atomic.AddInt64(&a.generation, 1) > 1 {
+			a.relistIndex()
+		}
+
+		// Repeat at regular intervals, only asking for folders changed since the server last changed them, or
+		// in full when asked to refresh now
+		select {
+		case <-time.After(*indexRefresh):
+		case <-a.refreshIndex:
+			full = 0
+		}
+	}
+}
+
+// requestRefresh asks for the artist index to be refreshed in full now, rather than at the next interval
+func (a *account) requestRefresh() {
+	select {
+	case a.refreshIndex <- struct{}{}:
+	default:
+	}
+}
+
+// index returns the cached artist index, waiting for it to be populated first, or for the folders loaded
+// so far if that takes too long
+func (a *account) index() map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist {
+	select {
+	case <-a.indexReady:
+	case <-time.After(indexWait):
+		log.Printf("subfs: index of %s is still loading, showing the folders loaded so far", a.Name)
+	}
+
+	a.indexLock.RLock()
+	defer a.indexLock.RUnlock()
+	return a.artistsIndex
+}
+
+// AccountsDir is the root directory when several accounts are mounted, containing one directory per account
+type AccountsDir struct {
+	readOnlyDir
+
+	sfs *Filesystem
+}
+
+// Attr retrives the attributes for this AccountsDir
+func (AccountsDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode:  os.ModeDir | 0555,
+		Nlink: dirNlink,
+	}
+}
+
+// Lookup returns the root directory of the named account
+func (d AccountsDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	for _, a := range d.sfs.accounts {
+		if a.Name == name {
+			return NewSubDir(a, -1, true, false), nil
+		}
+	}
+
+	return nil, fuse.ENOENT
+}
+
+// ReadDir returns a directory entry for each account
+func (d AccountsDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	names := make([]string, 0, len(d.sfs.accounts))
+	for _, a := range d.sfs.accounts {
+		names = append(names, a.Name)
+	}
+	sort.Strings(names)
+
+	directories := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		directories = append(directories, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_Dir,
+		})
+	}
+
+	return directories, nil
+}
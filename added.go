@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+
+	"bazil.org/fuse/fs"
+)
+
+// addedTree adds the Added directory, grouping albums by the month they were added to the server
+var addedTree = flag.Bool("added", false, "Add an Added/<year>/<month> directory tree grouping albums by when they were added to the server")
+
+// addedPageSize is the number of albums fetched per getAlbumList2 request
+const addedPageSize = 500
+
+// newAddedDir returns the Added directory, holding a directory per year, then per month, of albums
+func newAddedDir(a *account) VirtualDir {
+	return newCachedDir(layoutTTL, func() (map[string]fs.Node, error) {
+		albums, err := allAlbums(a)
+		if err != nil {
+			log.Printf("subfs: failed to retrieve album list: %s", err.Error())
+			return nil, err
+		}
+
+		// Group albums by year and month
+		months := map[string]map[string][]id3Album{}
+		for _, album := range albums {
+			if album.Created.IsZero() {
+				continue
+			}
+			year := strconv.Itoa(album.Created.Year())
+			month := fmt.Sprintf("%02d", int(album.Created.Month()))
+			if months[year] == nil {
+				months[year] = map[string][]id3Album{}
+			}
+			months[year][month] = append(months[year][month], album)
+		}
+
+		years := map[string]fs.Node{}
+		for year, byMonth := range months {
+			entries := map[string]fs.Node{}
+			for month, albums := range byMonth {
+				entries[month] = newStaticDir(addedAlbumEntries(a, albums))
+			}
+			years[year] = newStaticDir(entries)
+		}
+		return years, nil
+	})
+}
+
+// addedAlbumEntries returns a directory for each album added in a month, named "Artist - Album"
+func addedAlbumEntries(a *account, albums []id3Album) map[string]fs.Node {
+	// Qualify albums sharing a name with their year or ID
+	name := func(album id3Album) string {
+		return limitName(sanitizeName(fmt.Sprintf("%s - %s", rewrite("artist", album.Artist), rewrite("album", album.Name))), int64(album.ID))
+	}
+	names, years := nameCounter{}, nameCounter{}
+	for _, album := range albums {
+		names[name(album)]++
+		years[fmt.Sprintf("%s (%d)", name(album), album.Year)]++
+	}
+
+	entries := map[string]fs.Node{}
+	for _, album := range albums {
+		albumID := int64(album.ID)
+		entries[names.qualify(name(album), album.Year, albumID, years)] = albumSongsDir(a, albumID)
+	}
+	return entries
+}
+
+// allAlbums pages through every album on the server using getAlbumList2
+func allAlbums(a *account) ([]id3Album, error) {
+	albums := []id3Album{}
+	for offset := 0; ; offset += addedPageSize {
+		params := url.Values{}
+		params.Set("type", "newest")
+		params.Set("size", strconv.Itoa(addedPageSize))
+		params.Set("offset", strconv.Itoa(offset))
+
+		var res struct {
+			AlbumList struct {
+				Album []id3Album `json:"album"`
+			} `json:"albumList2"`
+		}
+		if err := apiGet(a, "getAlbumList2", params, &res); err != nil {
+			return nil, err
+		}
+
+		albums = append(albums, res.AlbumList.Album...)
+		if len(res.AlbumList.Album) < addedPageSize {
+			return albums, nil
+		}
+	}
+}
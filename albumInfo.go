@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// albumInfoFiles adds albuminfo.txt to album directories
+var albumInfoFiles = flag.Bool("album-info", false, "Add albuminfo.txt to album directories, with the album's notes from the server")
+
+// albumInfoTTL is how long an album's notes are kept once fetched
+const albumInfoTTL = time.Hour
+
+// htmlTags matches the markup found in album notes, such as links to Last.fm
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// albumInfo is the description of an album returned by getAlbumInfo2 or getAlbumInfo
+type albumInfo struct {
+	Notes         string `json:"notes"`
+	MusicBrainzID string `json:"musicBrainzId"`
+	LastFmURL     string `json:"lastFmUrl"`
+}
+
+// albumInfoFile returns albuminfo.txt for an album directory, fetched on first read.  The ID3 album
+// is described with getAlbumInfo2 if known, or else the directory itself with getAlbumInfo.
+func (d SubDir) albumInfoFile(albumID int64) VirtualFile {
+	return newVirtualFile(albumInfoTTL, func() ([]byte, error) {
+		var res struct {
+			AlbumInfo albumInfo `json:"albumInfo"`
+		}
+
+		params := url.Values{}
+		method := "getAlbumInfo"
+		params.Set("id", strconv.FormatInt(d.ID, 10))
+		if albumID != 0 {
+			method = "getAlbumInfo2"
+			params.Set("id", strconv.FormatInt(albumID, 10))
+		}
+		if err := apiGet(d.acct, method, params, &res); err != nil {
+			return nil, err
+		}
+
+		return res.AlbumInfo.text(), nil
+	})
+}
+
+// text formats album info as plain text, with the notes stripped of markup
+func (info albumInfo) text() []byte {
+	var buf bytes.Buffer
+	if notes := strings.TrimSpace(html.UnescapeString(htmlTags.ReplaceAllString(info.Notes, ""))); notes != "" {
+		fmt.Fprintf(&buf, "%s\n\n", notes)
+	}
+	if info.LastFmURL != "" {
+		fmt.Fprintf(&buf, "Last.fm: %s\n", info.LastFmURL)
+	}
+	if info.MusicBrainzID != "" {
+		fmt.Fprintf(&buf, "MusicBrainz: https://musicbrainz.org/release/%s\n", info.MusicBrainzID)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// recentlyPlayed adds the Recently Played directory
+var recentlyPlayed = flag.Bool("recent", false, "Add a Recently Played directory of the albums most recently played on any client")
+
+// topRated adds the Top Rated directory
+var topRated = flag.Bool("top-rated", false, "Add a Top Rated directory of the highest rated albums")
+
+// recentTTL is how long the Recently Played directory is kept, short so that plays elsewhere show up quickly
+const recentTTL = time.Minute
+
+// albumListSize is the number of albums shown in directories built from getAlbumList
+const albumListSize = 50
+
+// newAlbumListDir returns a directory of the albums in one of the server's album lists, such as recent,
+// prefixed by their position so that they list in the server's order
+func newAlbumListDir(a *account, listType string, ttl time.Duration) VirtualDir {
+	return newCachedDir(ttl, func() (map[string]fs.Node, error) {
+		params := url.Values{}
+		params.Set("type", listType)
+		params.Set("size", strconv.Itoa(albumListSize))
+
+		var res struct {
+			AlbumList struct {
+				Album []apiChild `json:"album"`
+			} `json:"albumList"`
+		}
+		if err := apiGet(a, "getAlbumList", params, &res); err != nil {
+			log.Printf("subfs: failed to retrieve %s albums: %s", listType, err.Error())
+			return nil, err
+		}
+
+		entries := map[string]fs.Node{}
+		for i, album := range res.AlbumList.Album {
+			name := a.sfs.formatDirname(album, fmt.Sprintf("%s - %s", rewrite("artist", album.Artist), rewrite("album", album.Title)))
+			name = limitName(fmt.Sprintf("%02d - %s", i+1, name), int64(album.ID))
+
+			sub := NewSubDir(a, int64(album.ID), false, false)
+			sub.Name = name
+			sub.Modified = album.modified()
+			sub.CoverArt = int64(album.CoverArt)
+			entries[name] = sub
+		}
+		return entries, nil
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiTimeout bounds each request to the server, so that a server which stops answering fails calls rather
+// than hanging them
+var apiTimeout = flag.Duration("api-timeout", 30*time.Second, "Longest a request to the Subsonic server may wait for a response before failing, or 0 to wait indefinitely")
+
+// pingTimeout bounds the watchdog's pings, which should notice an unreachable server well before the
+// requests it would fail
+const pingTimeout = 5 * time.Second
+
+// httpClients are shared by every account, and built under -api-timeout on first use
+var httpClients struct {
+	once sync.Once
+
+	// api bounds whole requests, stream only the wait for a response, as media bodies are read as they
+	// are needed, and ping bounds the watchdog's pings
+	api    *http.Client
+	stream *http.Client
+	ping   *http.Client
+}
+
+// clients returns the shared HTTP clients, building them on first use
+func clients() (api *http.Client, stream *http.Client, ping *http.Client) {
+	httpClients.once.Do(func() {
+		httpClients.api = &http.Client{Timeout: *apiTimeout}
+		httpClients.stream = &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: *apiTimeout,
+			},
+		}
+		httpClients.ping = &http.Client{Timeout: pingTimeout}
+	})
+	return httpClients.api, httpClients.stream, httpClients.ping
+}
+
+// apiError is an error returned by the Subsonic server in a response envelope
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error returns the server's error message and code
+func (e apiError) Error() string {
+	return fmt.Sprintf("subsonic: %s (code %d)", e.Message, e.Code)
+}
+
+// apiURL builds the URL for a Subsonic REST method with the given parameters, authenticating as the
+// given account.  Direct requests are used for functionality not exposed by gosubsonic.
+func apiURL(a *account, method string, params url.Values) string {
+	host := a.Host
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+
+	// Merge authentication parameters into the query
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("u", a.User)
+	query.Set("p", "enc:"+hex.EncodeToString([]byte(a.password())))
+	query.Set("v", a.apiVersion())
+	query.Set("c", "subfs")
+	query.Set("f", "json")
+
+	return fmt.Sprintf("%s/rest/%s.view?%s", strings.TrimSuffix(host, "/"), method, query.Encode())
+}
+
+// apiGet calls a Subsonic REST method, decoding the contents of its response envelope into v
+func apiGet(a *account, method string, params url.Values, v interface{}) error {
+	api, _, _ := clients()
+	return apiGetWith(api, a, method, params, v)
+}
+
+// apiGetWith calls a Subsonic REST method through client, decoding its response envelope into v
+func apiGetWith(client *http.Client, a *account, method string, params url.Values, v interface{}) error {
+	if !a.supports(method) {
+		return errUnsupportedMethod
+	}
+
+	debugf("api: %s %s", method, params.Encode())
+	start := time.Now()
+	var wait time.Duration
+	defer func() {
+		a.timeAPI(method, params, start, wait)
+	}()
+
+	res, err := client.Get(apiURL(a, method, params))
+	if err != nil {
+		return err
+	}
+	wait = time.Since(start)
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("subsonic: %s returned HTTP %s", method, res.Status)
+	}
+
+	var envelope struct {
+		Response json.RawMessage `json:"subsonic-response"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return err
+	}
+
+	// Check for an error before decoding the response itself
+	var status struct {
+		Status string    `json:"status"`
+		Error  *apiError `json:"error"`
+	}
+	if err := json.Unmarshal(envelope.Response, &status); err != nil {
+		return err
+	}
+	if status.Error != nil {
+		a.noteAuthError(*status.Error)
+		return *status.Error
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Response, v)
+}
+
+// apiStream opens a binary Subsonic method such as stream or download, optionally starting at offset.
+// The returned boolean reports whether the server honored the offset with a partial response.
+func apiStream(a *account, method string, params url.Values, offset int64) (io.ReadCloser, bool, error) {
+	if !a.supports(method) {
+		return nil, false, errUnsupportedMethod
+	}
+
+	debugf("api: %s %s from %d", method, params.Encode(), offset)
+	req, err := http.NewRequest("GET", apiURL(a, method, params), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Request a byte range when resuming
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// Streams are timed until the server responds, as the body is read as it is needed
+	start := time.Now()
+	var wait time.Duration
+	defer func() {
+		a.timeAPI(method, params, start, wait)
+	}()
+
+	_, stream, _ := clients()
+	res, err := stream.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	wait = time.Since(start)
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, false, fmt.Errorf("subsonic: %s returned HTTP %s", method, res.Status)
+	}
+
+	// Errors are returned as a regular response envelope rather than media
+	contentType := res.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "text/xml") {
+		defer res.Body.Close()
+
+		var envelope struct {
+			Response struct {
+				Status string    `json:"status"`
+				Error  *apiError `json:"error"`
+			} `json:"subsonic-response"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+			return nil, false, fmt.Errorf("subsonic: %s returned unexpected %s response", method, contentType)
+		}
+		if envelope.Response.Error != nil {
+			a.noteAuthError(*envelope.Response.Error)
+			return nil, false, *envelope.Response.Error
+		}
+		return nil, false, fmt.Errorf("subsonic: %s returned no media", method)
+	}
+
+	return res.Body, res.StatusCode == http.StatusPartialContent, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slowAPI is the duration beyond which a Subsonic API call is logged, along with its parameters
+var slowAPI = flag.Duration("slow-api", 2*time.Second, "Log Subsonic API calls taking longer than this, with their method and parameters, or 0 to log none")
+
+// apiBuckets are the upper bounds in seconds of the API latency histogram buckets
+var apiBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// apiHistogram counts the latencies of one Subsonic method, both until the server's response arrives and
+// until it has been read in full
+type apiHistogram struct {
+	counts []int64
+	sum    float64
+	wait   float64
+	count  int64
+}
+
+// apiLatencies holds an apiHistogram for each Subsonic method called
+type apiLatencies struct {
+	sync.Mutex
+	methods map[string]*apiHistogram
+}
+
+// newAPILatencies returns an empty apiLatencies
+func newAPILatencies() *apiLatencies {
+	return &apiLatencies{
+		methods: map[string]*apiHistogram{},
+	}
+}
+
+// observe adds a call to a method's histogram, taking wait until the server responded and total until
+// the response was read
+func (l *apiLatencies) observe(method string, wait, total time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	h, ok := l.methods[method]
+	if !ok {
+		h = &apiHistogram{counts: make([]int64, len(apiBuckets))}
+		l.methods[method] = h
+	}
+	seconds := total.Seconds()
+	for i, bound := range apiBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.wait += wait.Seconds()
+	h.count++
+}
+
+// timeAPI records a call to a method which started at start, and whose response arrived after wait, and
+// logs it if slower than -slow-api.  A wait of zero means no response arrived.
+func (a *account) timeAPI(method string, params url.Values, start time.Time, wait time.Duration) {
+	total := time.Since(start)
+	a.latencies.observe(method, wait, total)
+
+	if *slowAPI <= 0 || total < *slowAPI {
+		return
+	}
+	if wait == 0 {
+		log.Printf("subfs: slow API call for %s: %s %s failed after %s", a.Name, method, params.Encode(), total)
+		return
+	}
+	log.Printf("subfs: slow API call for %s: %s %s took %s, %s of it waiting for the server",
+		a.Name, method, params.Encode(), total, wait)
+}
+
+// writeAPIMetrics writes the API latency histograms of each account in the Prometheus text format
+func (sfs *Filesystem) writeAPIMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP subfs_api_duration_seconds Time taken by Subsonic API calls, until the response was read.")
+	fmt.Fprintln(w, "# TYPE subfs_api_duration_seconds histogram")
+	for _, a := range sfs.accounts {
+		a.latencies.Lock()
+		for _, method := range a.latencies.sortedMethods() {
+			h := a.latencies.methods[method]
+			for i, bound := range apiBuckets {
+				fmt.Fprintf(w, "subfs_api_duration_seconds_bucket{account=%q,method=%q,le=\"%g\"} %d\n", a.Name, method, bound, h.counts[i])
+			}
+			fmt.Fprintf(w, "subfs_api_duration_seconds_bucket{account=%q,method=%q,le=\"+Inf\"} %d\n", a.Name, method, h.count)
+			fmt.Fprintf(w, "subfs_api_duration_seconds_sum{account=%q,method=%q} %f\n", a.Name, method, h.sum)
+			fmt.Fprintf(w, "subfs_api_duration_seconds_count{account=%q,method=%q} %d\n", a.Name, method, h.count)
+		}
+		a.latencies.Unlock()
+	}
+
+	fmt.Fprintln(w, "# HELP subfs_api_wait_seconds_total Time spent waiting for the Subsonic server to respond to API calls.")
+	fmt.Fprintln(w, "# TYPE subfs_api_wait_seconds_total counter")
+	for _, a := range sfs.accounts {
+		a.latencies.Lock()
+		for _, method := range a.latencies.sortedMethods() {
+			fmt.Fprintf(w, "subfs_api_wait_seconds_total{account=%q,method=%q} %f\n", a.Name, method, a.latencies.methods[method].wait)
+		}
+		a.latencies.Unlock()
+	}
+}
+
+// sortedMethods returns the methods called, in order.  The caller must hold the lock.
+func (l *apiLatencies) sortedMethods() []string {
+	methods := make([]string, 0, len(l.methods))
+	for method := range l.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
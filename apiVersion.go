@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// targetAPIVersion is the Subsonic REST API version sent with direct API requests, or auto to use the
+// version each server reports
+var targetAPIVersion = flag.String("api-version", "auto", "Subsonic REST API version sent to the server, such as 1.8.0, or auto to use the version the server reports")
+
+// defaultAPIVersion is sent until a server's version is known, and kept if it can't be found
+const defaultAPIVersion = "1.8.0"
+
+// methodVersions lists the API version introducing each method used which postdates 1.8.0
+var methodVersions = map[string]string{
+	"getBookmarks":     "1.9.0",
+	"createBookmark":   "1.9.0",
+	"getSimilarSongs":  "1.11.0",
+	"getSimilarSongs2": "1.11.0",
+	"getAlbumInfo":     "1.14.0",
+	"getAlbumInfo2":    "1.14.0",
+	"getScanStatus":    "1.15.0",
+}
+
+// errUnsupportedMethod is returned for methods newer than the API version targeted
+var errUnsupportedMethod = errors.New("subsonic: method not supported by the targeted API version")
+
+// negotiateAPIVersion returns the API version to target for an account, from -api-version or else the
+// version reported by the server's ping response
+func negotiateAPIVersion(a *account) string {
+	if *targetAPIVersion != "auto" {
+		return *targetAPIVersion
+	}
+
+	var ping struct {
+		Version string `json:"version"`
+	}
+	if err := apiGet(a, "ping", url.Values{}, &ping); err != nil || ping.Version == "" {
+		return defaultAPIVersion
+	}
+	if ping.Version != defaultAPIVersion {
+		log.Printf("subfs: server for %s supports API version %s", a.Name, ping.Version)
+	}
+	return ping.Version
+}
+
+// apiVersion returns the API version targeted for this account
+func (a *account) apiVersion() string {
+	a.versionLock.RLock()
+	defer a.versionLock.RUnlock()
+
+	if a.version == "" {
+		return defaultAPIVersion
+	}
+	return a.version
+}
+
+// updateAPIVersion targets the version from a successful ping, unless -api-version fixes it
+func (a *account) updateAPIVersion(version string) {
+	if *targetAPIVersion != "auto" || version == "" {
+		return
+	}
+
+	a.versionLock.Lock()
+	defer a.versionLock.Unlock()
+
+	if version != a.version {
+		log.Printf("subfs: server for %s now supports API version %s", a.Name, version)
+		a.version = version
+	}
+}
+
+// supports reports whether a method is available at the API version targeted for this account
+func (a *account) supports(method string) bool {
+	required, ok := methodVersions[method]
+	return !ok || compareVersions(a.apiVersion(), required) >= 0
+}
+
+// compareVersions compares dotted version numbers, returning -1, 0 or 1
+func compareVersions(a string, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
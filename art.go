@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+)
+
+// fetchArt retrieves a cover art image, caching it on disk.  One getCoverArt request is shared between
+// concurrent reads of the same art ID and size, such as a thumbnailer walking many directories of one album.
+func (s SubFile) fetchArt() ([]byte, error) {
+	result, err := s.acct.sfs.artFlight.Do(s.accountKey(), func() (interface{}, error) {
+		// A previous request may have cached the art since this read checked
+		if buf, ok := s.acct.sfs.cache.Get(s); ok {
+			return buf, nil
+		}
+
+		stream, err := s.openStream()
+		if err != nil {
+			return nil, err
+		}
+		defer stream.Close()
+
+		buf, err := readStream(stream, s.knownSize())
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Closing art stream: [%d] %s", s.ID, s.FileName)
+		s.SetSize(int64(len(buf)))
+		s.acct.sfs.cache.Put(s, buf)
+		return buf, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]byte), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// ignoreArticles lists leading articles which artists are sorted without, such as "The" in "The Beatles"
+var ignoreArticles = flag.String("ignore-articles", "", "Comma-separated leading articles to ignore when sorting artists, such as \"The,A,An\"")
+
+// moveArticles also moves those articles to the end of artist directory names, as in "Beatles, The"
+var moveArticles = flag.Bool("move-articles", false, "Show artists' -ignore-articles articles at the end of their names, as \"Beatles, The\"")
+
+// splitArticle splits a leading article of -ignore-articles from a name, returning the article and the
+// rest of the name, or an empty article if the name has none.  A name which is only an article keeps it.
+func splitArticle(name string) (string, string) {
+	if *ignoreArticles == "" {
+		return "", name
+	}
+
+	for _, article := range strings.Split(*ignoreArticles, ",") {
+		article = strings.TrimSpace(article)
+		if article == "" || len(name) <= len(article)+1 {
+			continue
+		}
+		if strings.EqualFold(name[:len(article)], article) && name[len(article)] == ' ' {
+			return name[:len(article)], strings.TrimLeft(name[len(article):], " ")
+		}
+	}
+	return "", name
+}
+
+// artistDisplayName returns the name of an artist's directory, with any leading article moved to the end
+// under -move-articles
+func artistDisplayName(name string) string {
+	if !*moveArticles {
+		return name
+	}
+	article, rest := splitArticle(name)
+	if article == "" {
+		return name
+	}
+	return rest + ", " + article
+}
+
+// sortArtists orders artist directory entries under -collate, ignoring leading articles, leaving them in
+// the server's order if neither applies
+func sortArtists(entries []fuse.Dirent) []fuse.Dirent {
+	if nameCollator() == nil && *ignoreArticles == "" {
+		return entries
+	}
+
+	// Compare by the names without their articles, falling back to the full names for ties
+	keys := make(map[string]string, len(entries))
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		_, key := splitArticle(e.Name)
+		keys[e.Name] = key
+		names = append(names, key)
+	}
+	less := nameLess(names)
+
+	sort.Stable(direntSorter{entries, func(a, b fuse.Dirent) bool {
+		ka, kb := keys[a.Name], keys[b.Name]
+		if ka != kb {
+			return less(ka, kb)
+		}
+		return a.Name < b.Name
+	}})
+	return entries
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// artistSeparators lists the separators splitting collaborations into their artists, such as " feat. "
+var artistSeparators = flag.String("artist-separators", "", "Separators between the artists of collaborations, separated by |, such as \" feat. | ft. |; | & \", to also list their songs under each artist")
+
+// collaborationsName is the directory within each artist holding songs credited to them along with others
+const collaborationsName = "Collaborations"
+
+// splitArtists returns the artists credited in an artist field, split on -artist-separators, or only the
+// field itself if it names a single artist
+func splitArtists(artist string) []string {
+	names := []string{artist}
+	if *artistSeparators == "" {
+		return names
+	}
+
+	for _, separator := range strings.Split(*artistSeparators, "|") {
+		if separator == "" {
+			continue
+		}
+		split := []string{}
+		for _, name := range names {
+			split = append(split, strings.Split(name, separator)...)
+		}
+		names = split
+	}
+
+	artists := []string{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			artists = append(artists, name)
+		}
+	}
+	return artists
+}
+
+// collaborations returns the known songs credited to an artist along with other artists
+func (m *songStore) collaborations(artist string) []apiChild {
+	return m.matching(func(c apiChild) bool {
+		artists := splitArtists(c.Artist)
+		if len(artists) < 2 {
+			return false
+		}
+		for _, name := range artists {
+			if strings.EqualFold(name, artist) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// collaborationsDir returns the Collaborations directory of an artist, holding a directory per album of
+// their known collaborations, or nil if there are none or -artist-separators is unset
+func collaborationsDir(a *account, artist string) fs.Node {
+	if *artistSeparators == "" || len(a.songs.collaborations(artist)) == 0 {
+		return nil
+	}
+	return newCachedDir(time.Minute, func() (map[string]fs.Node, error) {
+		return albumDirs(a, a.songs.collaborations(artist)), nil
+	})
+}
+
+// addCollaborations adds the Collaborations directory to this directory, if it belongs to an artist
+// with any known collaborations
+func (d SubDir) addCollaborations(directories []fuse.Dirent) []fuse.Dirent {
+	if d.Artist == "" {
+		return directories
+	}
+	dir := collaborationsDir(d.acct, d.Artist)
+	if dir == nil {
+		return directories
+	}
+
+	d.virtual[collaborationsName] = dir
+	return append(directories, fuse.Dirent{
+		Name: collaborationsName,
+		Type: fuse.DT_Dir,
+	})
+}
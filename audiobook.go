@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// bookmarksPath is the file remembering the last read position within each audiobook file
+var bookmarksPath = flag.String("bookmarks", filepath.Join(os.Getenv("HOME"), ".subfs-bookmarks.json"), "File remembering the last read position within audiobook files")
+
+// bookmark is the last read position within a file
+type bookmark struct {
+	// Offset is the last byte read, and Position the matching time in milliseconds
+	Offset   int64     `json:"offset"`
+	Position int64     `json:"position"`
+	Updated  time.Time `json:"updated"`
+}
+
+// bookmarkStore holds the bookmarks of every audiobook file, keyed by account name and song ID, and
+// saved to bookmarksPath as they change
+type bookmarkStore struct {
+	sync.Mutex
+	path  string
+	marks map[string]bookmark
+}
+
+// loadBookmarks reads the bookmarks saved at path, starting afresh if there are none
+func loadBookmarks(path string) *bookmarkStore {
+	b := &bookmarkStore{
+		path:  path,
+		marks: map[string]bookmark{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("subfs: could not read bookmarks: %s", err.Error())
+		}
+		return b
+	}
+	if err := json.Unmarshal(data, &b.marks); err != nil {
+		log.Printf("subfs: could not parse bookmarks %s: %s", path, err.Error())
+	}
+	return b
+}
+
+// bookmarkKey identifies a song's bookmark
+func bookmarkKey(a *account, id int64) string {
+	return fmt.Sprintf("%s/%d", a.Name, id)
+}
+
+// get returns the bookmark of a song, if any
+func (b *bookmarkStore) get(a *account, id int64) (bookmark, bool) {
+	b.Lock()
+	defer b.Unlock()
+	mark, ok := b.marks[bookmarkKey(a, id)]
+	return mark, ok
+}
+
+// set replaces the bookmark of a song, unless an existing one is newer
+func (b *bookmarkStore) set(a *account, id int64, mark bookmark) bool {
+	b.Lock()
+	defer b.Unlock()
+	key := bookmarkKey(a, id)
+	if old, ok := b.marks[key]; ok && old.Updated.After(mark.Updated) {
+		return false
+	}
+	b.marks[key] = mark
+	return true
+}
+
+// save writes every bookmark to disk, replacing the previous file atomically
+func (b *bookmarkStore) save() error {
+	b.Lock()
+	data, err := json.Marshal(b.marks)
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// isAudiobook reports whether a directory path, relative to the account's root, lies below one of the
+// configured audiobook prefixes
+func (a *account) isAudiobook(path string) bool {
+	for _, prefix := range a.audiobooks {
+		prefix = "/" + strings.Trim(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// child places a subdirectory of this directory at the given name, so that it knows its path and
+// whether it holds audiobooks
+func (d SubDir) child(sub SubDir, name string) SubDir {
+	sub.Path = d.Path + "/" + name
+	sub.Audiobook = d.Audiobook || d.acct.isAudiobook(sub.Path)
+	return sub
+}
+
+// loadServerBookmarks adds the bookmarks stored on the Subsonic server for files which have no local
+// bookmark, or an older one, for audiobooks and chapter files
+func (a *account) loadServerBookmarks() {
+	if (len(a.audiobooks) == 0 && !*chapterFiles) || !a.supports("getBookmarks") {
+		return
+	}
+
+	var res struct {
+		Bookmarks struct {
+			Bookmark []struct {
+				Position int64    `json:"position"`
+				Changed  apiTime  `json:"changed"`
+				Entry    apiChild `json:"entry"`
+			} `json:"bookmark"`
+		} `json:"bookmarks"`
+	}
+	if err := apiGet(a, "getBookmarks", url.Values{}, &res); err != nil {
+		log.Printf("subfs: could not fetch bookmarks for %s: %s", a.Name, err.Error())
+		return
+	}
+
+	changed := false
+	for _, m := range res.Bookmarks.Bookmark {
+		mark := bookmark{
+			Position: m.Position,
+			Updated:  m.Changed.Time,
+		}
+		if m.Entry.Duration > 0 {
+			mark.Offset = m.Entry.Size * m.Position / (m.Entry.Duration * 1000)
+		}
+		if a.sfs.bookmarks.set(a, int64(m.Entry.ID), mark) {
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := a.sfs.bookmarks.save(); err != nil {
+			log.Printf("subfs: could not save bookmarks: %s", err.Error())
+		}
+	}
+}
+
+// saveBookmark records the position reached within an audiobook file, both locally and on the server
+func (s SubFile) saveBookmark(offset int64) {
+	mark := bookmark{
+		Offset:  offset,
+		Updated: time.Now(),
+	}
+	if size := s.GetSize(); size > 0 {
+		mark.Position = offset * s.Duration * 1000 / size
+	}
+
+	sfs := s.acct.sfs
+	sfs.bookmarks.set(s.acct, s.ID, mark)
+	if err := sfs.bookmarks.save(); err != nil {
+		log.Printf("subfs: could not save bookmarks: %s", err.Error())
+	}
+
+	if !s.acct.supports("createBookmark") {
+		return
+	}
+	go func() {
+		params := url.Values{}
+		params.Set("id", strconv.FormatInt(s.ID, 10))
+		params.Set("position", strconv.FormatInt(mark.Position, 10))
+		if err := apiGet(s.acct, "createBookmark", params, nil); err != nil {
+			log.Printf("subfs: could not store bookmark for [%d] %s: %s", s.ID, s.FileName, err.Error())
+		}
+	}()
+}
+
+// bookmarkXattrs adds the bookmark of an audiobook file to its extended attributes, as
+// user.subfs.offset in bytes and user.subfs.position in seconds
+func (s SubFile) bookmarkXattrs(attrs map[string]string) {
+	mark, ok := s.acct.sfs.bookmarks.get(s.acct, s.ID)
+	if !ok {
+		return
+	}
+	attrs["user.subfs.offset"] = strconv.FormatInt(mark.Offset, 10)
+	attrs["user.subfs.position"] = strconv.FormatInt(mark.Position/1000, 10)
+}
+
+// bookHandle is an open audiobook file, remembering the position reached by reading it in order for when
+// it is released
+type bookHandle struct {
+	readOnlyFile
+
+	handle *fileHandle
+
+	// last is where the latest read ended, and offset where the latest read following on from the one
+	// before it ended, so that a lone jump, such as a player probing for tags at the end, isn't saved
+	lock   sync.Mutex
+	last   int64
+	offset int64
+}
+
+// Read returns part of the file, noting how far it has been read in order
+func (h *bookHandle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.Intr) fuse.Error {
+	if err := h.handle.Read(req, resp, intr); err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	end := req.Offset + int64(len(resp.Data))
+	if req.Offset == h.last {
+		h.offset = end
+	}
+	h.last = end
+	return nil
+}
+
+// Release remembers the position reached, then releases the underlying handle
+func (h *bookHandle) Release(req *fuse.ReleaseRequest, intr fs.Intr) fuse.Error {
+	h.lock.Lock()
+	offset := h.offset
+	h.lock.Unlock()
+
+	if offset > 0 {
+		h.handle.file.saveBookmark(offset)
+	}
+	return h.handle.Release(req, intr)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used to copy streams to disk
+const copyBufferSize = 64 * 1024
+
+// copyBuffers holds buffers for copying streams, shared between concurrent downloads
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// copyStream copies a stream to w through a pooled buffer, rather than allocating one per copy
+func copyStream(w io.Writer, r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	// Hide any ReadFrom or WriteTo, which would otherwise be used instead of the buffer
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *buf)
+}
+
+// readStream reads a stream to its end into a buffer sized for the expected length, so that reading a
+// whole file doesn't repeatedly grow and copy its buffer as ioutil.ReadAll does.  The expected length must
+// be exact, or -1 if unknown, as an estimate would allocate its whole size however short the stream.  The returned slice is
+// kept by callers, in the cache or by open handles, so it can't come from a pool.
+func readStream(r io.Reader, expected int64) ([]byte, error) {
+	if expected < 0 {
+		expected = 0
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, expected+bytes.MinRead))
+	_, err := buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// benchmarkFileSize is the size of the file copied and read by the buffer benchmarks, that of a typical
+// transcoded song
+const benchmarkFileSize = 8 * 1024 * 1024
+
+// benchmarkFile returns the content copied and read by the buffer benchmarks
+func benchmarkFile() []byte {
+	return bytes.Repeat([]byte("subfs"), benchmarkFileSize/5)
+}
+
+// BenchmarkCopyStream copies a stream through the pooled buffers, as downloads to disk do
+func BenchmarkCopyStream(b *testing.B) {
+	file := benchmarkFile()
+	b.SetBytes(int64(len(file)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := copyStream(ioutil.Discard, bytes.NewReader(file)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCopyUnpooled copies a stream allocating a buffer for each copy, for comparison
+func BenchmarkCopyUnpooled(b *testing.B) {
+	file := benchmarkFile()
+	b.SetBytes(int64(len(file)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.Copy(struct{ io.Writer }{ioutil.Discard}, struct{ io.Reader }{bytes.NewReader(file)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCopyStreamParallel copies streams concurrently, as several clients streaming at once do
+func BenchmarkCopyStreamParallel(b *testing.B) {
+	file := benchmarkFile()
+	b.SetBytes(int64(len(file)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := copyStream(ioutil.Discard, bytes.NewReader(file)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReadStream reads a whole stream into a buffer sized for it, as fetching a file does
+func BenchmarkReadStream(b *testing.B) {
+	file := benchmarkFile()
+	b.SetBytes(int64(len(file)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := readStream(struct{ io.Reader }{bytes.NewReader(file)}, int64(len(file))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadAll reads a whole stream with ioutil.ReadAll, growing its buffer as it goes, for comparison
+func BenchmarkReadAll(b *testing.B) {
+	file := benchmarkFile()
+	b.SetBytes(int64(len(file)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := ioutil.ReadAll(struct{ io.Reader }{bytes.NewReader(file)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestReadStream checks that reading a stream returns all of it, whether its expected length is right,
+// too small, too large or unknown
+func TestReadStream(t *testing.T) {
+	file := []byte("the quick brown fox jumps over the lazy dog")
+	for _, expected := range []int64{int64(len(file)), 4, 1024, 0, -1} {
+		buf, err := readStream(bytes.NewReader(file), expected)
+		if err != nil {
+			t.Fatalf("expected %d: %v", expected, err)
+		}
+		if !bytes.Equal(buf, file) {
+			t.Fatalf("expected %d: read %q, want %q", expected, buf, file)
+		}
+	}
+}
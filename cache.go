@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// cacheDir is an optional directory for cached files, which may be shared between several subfs instances
+var cacheDir = flag.String("cache-dir", "", "Directory for cached files, which may be shared between subfs instances")
+
+// cacheCompress enables compression of cached lossless files on disk
+var cacheCompress = flag.Bool("cache-compress", false, "Compress cached lossless files on disk, trading CPU for a bigger effective cache")
+
+// cacheBackend chooses where cached files are kept
+var cacheBackend = flag.String("cache-backend", "", "Cache backend: temp (private temporary files), dir (the -cache-dir directory, with a manifest), memory (RAM only, up to -cache) or chunks (private temporary files split into shared chunks), by default dir if -cache-dir is set")
+
+// cacheMaxFile is the size in megabytes above which files are served without being cached
+var cacheMaxFile = flag.Int64("cache-max-file", 50, "Size in megabytes above which files, such as videos, are never cached")
+
+// cacheTTL is the age in days after which cached files are evicted, however much space is free
+var cacheTTL = flag.Int("cache-ttl", 0, "Age in days after which cached files are evicted regardless of space, or 0 to keep them")
+
+// cacheExpiryInterval is the interval between checks for cached files older than -cache-ttl
+const cacheExpiryInterval = time.Hour
+
+// Cache stores the content of files read through subfs, keyed by accountKey.  Files with open handles,
+// as counted by Open and Release, are never removed; evicting them is deferred until their last release,
+// and expiry and shutdown pass over them.
+type Cache interface {
+	// Get returns a file's content, if cached
+	Get(s SubFile) ([]byte, bool)
+
+	// Put stores a file's content, if it fits
+	Put(s SubFile, data []byte)
+
+	// Evict removes a file from the cache
+	Evict(key string)
+
+	// Stats reports the number of files and bytes cached
+	Stats() CacheStats
+
+	// File returns the path of a file's content on disk, if cached neither compressed nor encrypted, so
+	// that it can be read directly at any offset
+	File(s SubFile) (string, bool)
+
+	// Checksum returns the hex MD5 of a file's content, if cached, computing it only once per file
+	Checksum(s SubFile) (string, bool)
+
+	// Open and Release count the open handles on a file
+	Open(key string)
+	Release(key string)
+
+	// Purge removes every cached file, returning the number removed
+	Purge() int
+
+	// Expire removes cached files added longer than maxAge ago, returning the number removed
+	Expire(maxAge time.Duration) int
+
+	// Close releases the cache at shutdown, returning the number of files released.  Files still open are
+	// left to their last release, as another process may be reading them if the mount couldn't be unmounted.
+	Close() int
+}
+
+// CacheStats is a snapshot of a cache's usage
+type CacheStats struct {
+	Files int
+	Bytes int64
+}
+
+// newCache returns the cache backend chosen by flags
+func newCache() (Cache, error) {
+	if proxyReads() {
+		return noCache{}, nil
+	}
+
+	backend := *cacheBackend
+	if backend == "" {
+		backend = "temp"
+		if *cacheDir != "" {
+			backend = "dir"
+		}
+	}
+
+	switch backend {
+	case "temp":
+		return newTempCache(), nil
+	case "memory":
+		return newMemoryCache(), nil
+	case "chunks":
+		return newChunkCache()
+	case "dir":
+		if *cacheDir == "" {
+			return nil, fmt.Errorf("the dir cache backend requires -cache-dir")
+		}
+		return newDirCache(*cacheDir)
+	}
+	return nil, fmt.Errorf("unknown cache backend %q", backend)
+}
+
+// cacheFits reports whether a file of the given stored size may be added to a cache currently holding
+// total bytes, logging why not
+func cacheFits(s SubFile, total int64, stored int64) bool {
+	// Check for maximum cache size
+	if total > *cacheSize*1024*1024 {
+		log.Printf("Cache full (%d MB), skipping local cache", *cacheSize)
+		return false
+	}
+
+	// Skip caching files above the threshold, such as videos, so they don't evict everything else
+	if size := s.GetSize(); size > *cacheMaxFile*1024*1024 {
+		log.Printf("File too large (%0.3f > %0d MB), skipping local cache", float64(size)/1024/1024, *cacheMaxFile)
+		return false
+	}
+
+	// Check if cache will overflow if file is added, counting the bytes it will occupy on disk
+	if total+stored > *cacheSize*1024*1024 {
+		log.Printf("File will overflow cache (%0.3f MB), skipping local cache", float64(stored)/1024/1024)
+		return false
+	}
+
+	return true
+}
+
+// logCacheUse prints some cache metrics after a file is added or removed
+func logCacheUse(total int64, change int64) {
+	cacheUse := float64(total) / 1024 / 1024
+	if change < 0 {
+		log.Printf("Cache use: %0.3f / %d.000 MB (-%0.3f MB)", cacheUse, *cacheSize, float64(-change)/1024/1024)
+		return
+	}
+	log.Printf("Cache use: %0.3f / %d.000 MB (+%0.3f MB)", cacheUse, *cacheSize, float64(change)/1024/1024)
+}
+
+// cacheFiles tracks cached files on disk, along with their open handles, for the disk-based backends
+type cacheFiles struct {
+	sync.RWMutex
+
+	// files maps a cache key to its file, stored to the bytes it occupies on disk, refs to its number of
+	// open handles, and doomed holds files evicted while open
+	files  map[string]os.File
+	stored map[string]int64
+	refs   map[string]int
+	doomed map[string]doomedFile
+
+	// sums maps a cache key to the MD5 of its content, once known, and added to when it was cached
+	sums  map[string]string
+	added map[string]time.Time
+
+	// total is the number of bytes occupied on disk
+	total int64
+
+	// remove is whether evicted files are removed from disk, rather than only closed and kept between runs
+	remove bool
+}
+
+// doomedFile is a file evicted while open, to be closed, and removed if set, on its last release
+type doomedFile struct {
+	file   os.File
+	remove bool
+}
+
+// newCacheFiles returns empty bookkeeping, removing evicted files from disk if remove is set
+func newCacheFiles(remove bool) cacheFiles {
+	return cacheFiles{
+		files:  map[string]os.File{},
+		stored: map[string]int64{},
+		refs:   map[string]int{},
+		doomed: map[string]doomedFile{},
+		sums:   map[string]string{},
+		added:  map[string]time.Time{},
+		remove: remove,
+	}
+}
+
+// lookup returns the file cached for a key
+func (c *cacheFiles) lookup(key string) (os.File, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	f, ok := c.files[key]
+	return f, ok
+}
+
+// add records a newly cached file, along with the MD5 of its content
+func (c *cacheFiles) add(key string, f os.File, stored int64, sum string) {
+	c.Lock()
+	c.files[key] = f
+	c.stored[key] = stored
+	c.sums[key] = sum
+	c.added[key] = time.Now()
+	c.Unlock()
+
+	logCacheUse(atomic.AddInt64(&c.total, stored), stored)
+}
+
+// Evict removes a cached file, deferring its removal if it is open
+func (c *cacheFiles) Evict(key string) {
+	c.Lock()
+	f, ok := c.files[key]
+	stored := c.stored[key]
+	release := ok && c.drop(key, f, c.remove)
+	c.Unlock()
+
+	if release {
+		releaseCacheFile(f, c.remove)
+	}
+	if ok {
+		logCacheUse(atomic.AddInt64(&c.total, -stored), -stored)
+	}
+}
+
+// drop forgets a cached file, reporting whether it should be closed, and removed if set, now.  Files
+// still open are instead closed on their last release.  The caller must hold the lock.
+func (c *cacheFiles) drop(key string, f os.File, remove bool) bool {
+	delete(c.files, key)
+	delete(c.stored, key)
+	delete(c.sums, key)
+	delete(c.added, key)
+
+	if c.refs[key] > 0 {
+		c.doomed[key] = doomedFile{f, remove}
+		return false
+	}
+	return true
+}
+
+// sum returns the MD5 of a cached file's content, if known
+func (c *cacheFiles) sum(key string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	sum, ok := c.sums[key]
+	return sum, ok
+}
+
+// setSum records the MD5 of a cached file's content, if it is still cached
+func (c *cacheFiles) setSum(key string, sum string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.files[key]; ok {
+		c.sums[key] = sum
+	}
+}
+
+// storedPlain reports whether a file's content is cached as is, neither compressed nor encrypted
+func storedPlain(s SubFile) bool {
+	return !s.compressCache() && cacheCipher == nil
+}
+
+// checksum returns the hex MD5 of a file's content
+func checksum(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// Stats reports the number of files and bytes cached
+func (c *cacheFiles) Stats() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+
+	return CacheStats{
+		Files: len(c.files),
+		Bytes: atomic.LoadInt64(&c.total),
+	}
+}
+
+// Open counts an open handle on a file
+func (c *cacheFiles) Open(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]++
+}
+
+// Release drops an open handle on a file, removing it if it was evicted while open
+func (c *cacheFiles) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]--
+	if c.refs[key] > 0 {
+		return
+	}
+	delete(c.refs, key)
+
+	if d, ok := c.doomed[key]; ok {
+		releaseCacheFile(d.file, d.remove)
+		delete(c.doomed, key)
+	}
+}
+
+// inUse reports whether a file has open handles
+func (c *cacheFiles) inUse(key string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.refs[key] > 0
+}
+
+// expired returns the keys of files cached before cutoff, leaving out those with open handles, which
+// expire once closed
+func (c *cacheFiles) expired(cutoff time.Time) []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	keys := []string{}
+	for key, added := range c.added {
+		if added.Before(cutoff) && c.refs[key] == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// expireCache periodically evicts files older than -cache-ttl, if set
+func expireCache(cache Cache) {
+	if *cacheTTL <= 0 {
+		return
+	}
+
+	maxAge := time.Duration(*cacheTTL) * 24 * time.Hour
+	for {
+		if count := cache.Expire(maxAge); count > 0 {
+			log.Printf("Expired %d cached files older than %d days", count, *cacheTTL)
+		}
+		<-time.After(cacheExpiryInterval)
+	}
+}
+
+// Purge removes every cached file, returning the number removed
+func (c *cacheFiles) Purge() int {
+	return c.purge(true)
+}
+
+// purge drops every cached file, removing them if set, and returns the number dropped.  Files are
+// closed and removed in parallel once dropped, as there may be many of them at shutdown.
+func (c *cacheFiles) purge(remove bool) int {
+	c.Lock()
+	count := len(c.files)
+	release := make([]os.File, 0, count)
+	for key, f := range c.files {
+		if c.drop(key, f, remove) {
+			release = append(release, f)
+		}
+	}
+	atomic.StoreInt64(&c.total, 0)
+	c.Unlock()
+
+	releaseCacheFiles(release, remove)
+	return count
+}
+
+// releaseWorkers is the number of cached files closed and removed at once by releaseCacheFiles
+const releaseWorkers = 8
+
+// releaseCacheFiles closes files dropped from the cache, and removes them if set, several at a time
+func releaseCacheFiles(files []os.File, remove bool) {
+	work := make(chan os.File)
+	var wg sync.WaitGroup
+	for i := 0; i < releaseWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				releaseCacheFile(f, remove)
+			}
+		}()
+	}
+
+	for _, f := range files {
+		work <- f
+	}
+	close(work)
+	wg.Wait()
+}
+
+// Close releases every cached file, removing them unless they are kept between runs, and returns the
+// number released.  Files still open are removed now all the same, which readers holding them open don't
+// notice, and only closed on their last release, so that nothing is left behind if that never comes.
+func (c *cacheFiles) Close() int {
+	count := c.purge(c.remove)
+
+	c.Lock()
+	defer c.Unlock()
+	kept := 0
+	for key, d := range c.doomed {
+		if c.refs[key] == 0 {
+			continue
+		}
+		kept++
+		if d.remove {
+			if err := os.Remove(d.file.Name()); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			c.doomed[key] = doomedFile{d.file, false}
+		}
+	}
+	if kept > 0 {
+		log.Printf("subfs: removed %d cached file(s) still open, to be closed once released", kept)
+	}
+	return count - kept
+}
+
+// releaseCacheFile closes a file dropped from the cache, and removes it if set
+func releaseCacheFile(f os.File, remove bool) {
+	if err := f.Close(); err != nil {
+		log.Println(err)
+	}
+	if !remove {
+		return
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		log.Println(err)
+	}
+}
+
+// compressibleSuffixes lists lossless formats which are worth compressing in the cache
+var compressibleSuffixes = map[string]bool{
+	"aif":  true,
+	"aiff": true,
+	"flac": true,
+	"wav":  true,
+}
+
+// compressCache reports whether a file's content is compressed in the cache
+func (s SubFile) compressCache() bool {
+	return *cacheCompress && s.Lossless && !s.IsVideo && !s.IsArt && compressibleSuffixes[strings.ToLower(s.Suffix)]
+}
+
+// cacheKey returns the name under which a file's content is cached.  Keys depend only on the content,
+// not on the filename template, so that differently configured mounts can share cached files.
+func (s SubFile) cacheKey() string {
+	// Art is keyed by ID and size alone, so every directory referencing the same art shares one cached copy
+	if s.IsArt {
+		return fmt.Sprintf("art-%d-%d.jpg", s.ID, s.ArtSize)
+	}
+
+	if s.CueLength > 0 && s.shouldFixTags() {
+		return fmt.Sprintf("%d.cue-%d.tagged.%s", s.ID, int64(s.CueStart*1000), s.Suffix)
+	}
+	if s.CueLength > 0 {
+		return fmt.Sprintf("%d.cue-%d.%s", s.ID, int64(s.CueStart*1000), s.Suffix)
+	}
+
+	if s.IsVideo {
+		return fmt.Sprintf("%d.video.%s", s.ID, s.Suffix)
+	}
+
+	if s.Lossless {
+		return fmt.Sprintf("%d.%s", s.ID, s.Suffix)
+	}
+
+	// Rewritten tags change the content of a transcode
+	if s.shouldFixTags() {
+		return fmt.Sprintf("%d.transcode.tagged.%s", s.ID, s.Suffix)
+	}
+	return fmt.Sprintf("%d.transcode.%s", s.ID, s.Suffix)
+}
+
+// accountKey returns the key under which this instance tracks a file's cached content, which includes the
+// account, as the same IDs on different accounts or servers name different files
+func (s SubFile) accountKey() string {
+	return s.acct.Name + "/" + s.cacheKey()
+}
+
+// cachePath returns the location of a file within the shared cache directory, namespaced by server
+// so that mounts of different servers never collide
+func (s SubFile) cachePath() string {
+	namespace := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s.acct.Host)
+
+	// Encrypted files are kept apart from plain ones, so mounts with differing settings don't misread them
+	name := s.cacheKey()
+	if s.compressCache() {
+		name += ".gz"
+	}
+	if cacheCipher != nil {
+		name += ".enc"
+	}
+
+	return filepath.Join(*cacheDir, namespace, name)
+}
+
+// lockCacheFile acquires an advisory lock on a file in the shared cache directory, shared for readers and
+// exclusive for writers, so that instances never read a file while another is still writing it
+func lockCacheFile(name string, exclusive bool) (*os.File, error) {
+	lock, err := os.OpenFile(name+".lock", os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// unlockCacheFile releases a lock acquired by lockCacheFile
+func unlockCacheFile(lock *os.File) {
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_UN); err != nil {
+		log.Println(err)
+	}
+	if err := lock.Close(); err != nil {
+		log.Println(err)
+	}
+}
+
+// decodeCache reverses any encoding applied to a file's content by encodeCache
+func decodeCache(s SubFile, buf []byte) ([]byte, bool) {
+	if cacheCipher != nil {
+		plain, err := openCache(buf)
+		if err != nil {
+			log.Printf("Could not decrypt cached file: [%d] %s: %s", s.ID, s.FileName, err.Error())
+			return nil, false
+		}
+		buf = plain
+	}
+
+	if s.compressCache() {
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			log.Printf("Could not decompress cached file: [%d] %s: %s", s.ID, s.FileName, err.Error())
+			return nil, false
+		}
+
+		plain, err := ioutil.ReadAll(r)
+		if err != nil {
+			log.Printf("Could not decompress cached file: [%d] %s: %s", s.ID, s.FileName, err.Error())
+			return nil, false
+		}
+		buf = plain
+	}
+
+	return buf, true
+}
+
+// encodeCache prepares a file's content for storage on disk, compressing and encrypting it if enabled
+func encodeCache(s SubFile, file []byte) ([]byte, error) {
+	if s.compressCache() {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(file); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		file = buf.Bytes()
+	}
+
+	if cacheCipher != nil {
+		return sealCache(file)
+	}
+
+	return file, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// chunkSize is the size of the pieces the chunk cache splits files into
+const chunkSize = 1024 * 1024
+
+// chunkCache keeps cached files in a private temporary directory as fixed-size chunks named by their SHA-1,
+// so that content shared between files, such as the same song on several accounts, is stored only once.
+// Files are read back whole into memory, so evicted content still read by open handles stays with them
+// until they release it.
+type chunkCache struct {
+	sync.RWMutex
+
+	// dir holds the chunk files, and is removed at shutdown
+	dir string
+
+	// files maps a cache key to its chunks, sums to the MD5 of its content once known, and refs to its
+	// number of open handles
+	files map[string]chunkedFile
+	sums  map[string]string
+	refs  map[string]int
+
+	// chunks counts the files using each chunk
+	chunks map[string]int
+
+	// total is the number of bytes held in chunk files
+	total int64
+}
+
+// chunkedFile lists the chunks of a cached file, in order
+type chunkedFile struct {
+	chunks []string
+	size   int64
+	added  time.Time
+}
+
+// newChunkCache returns an empty chunkCache in a new temporary directory
+func newChunkCache() (*chunkCache, error) {
+	dir, err := ioutil.TempDir("", "subfs-chunks")
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkCache{
+		dir:    dir,
+		files:  map[string]chunkedFile{},
+		sums:   map[string]string{},
+		refs:   map[string]int{},
+		chunks: map[string]int{},
+	}, nil
+}
+
+// chunkPath returns the path of a chunk file
+func (c *chunkCache) chunkPath(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+// Get reassembles a file's content from its chunks, if cached
+func (c *chunkCache) Get(s SubFile) ([]byte, bool) {
+	key := s.accountKey()
+
+	c.RLock()
+	f, ok := c.files[key]
+	c.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	buf := make([]byte, 0, f.size)
+	for _, name := range f.chunks {
+		chunk, err := ioutil.ReadFile(c.chunkPath(name))
+		if err != nil {
+			// Purge item from cache
+			log.Printf("Cache missing chunk %s: [%d] %s", name, s.ID, s.FileName)
+			c.Evict(key)
+			return nil, false
+		}
+		buf = append(buf, chunk...)
+	}
+	return decodeCache(s, buf)
+}
+
+// Put splits a file's content into chunks, writing those not already held, if the new ones fit
+func (c *chunkCache) Put(s SubFile, file []byte) {
+	data, err := encodeCache(s, file)
+	if err != nil {
+		log.Printf("Failed to encode cache file: %s", err.Error())
+		return
+	}
+	key := s.accountKey()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.files[key]; ok {
+		return
+	}
+
+	// Only chunks not yet held by another file take up more room
+	f := chunkedFile{size: int64(len(data)), added: time.Now()}
+	var stored int64
+	for start := 0; start < len(data); start += chunkSize {
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := sha1.Sum(data[start:end])
+		name := hex.EncodeToString(sum[:])
+		if c.chunks[name] == 0 && !contains(f.chunks, name) {
+			stored += int64(end - start)
+		}
+		f.chunks = append(f.chunks, name)
+	}
+	if !cacheFits(s, c.total, stored) {
+		return
+	}
+
+	log.Printf("Caching file in chunks: [%d] %s", s.ID, s.FileName)
+	for i, name := range f.chunks {
+		if c.chunks[name] == 0 {
+			start := i * chunkSize
+			end := start + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := ioutil.WriteFile(c.chunkPath(name), data[start:end], 0600); err != nil {
+				log.Printf("Failed to write cache chunk: %s", err.Error())
+				f.chunks = f.chunks[:i]
+				c.release(f)
+				return
+			}
+			c.total += int64(end - start)
+		}
+		c.chunks[name]++
+	}
+	c.files[key] = f
+	logCacheUse(c.total, stored)
+}
+
+// contains reports whether names holds name
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Evict removes a file, and any of its chunks no other file uses
+func (c *chunkCache) Evict(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if freed, ok := c.drop(key); ok {
+		logCacheUse(c.total, -freed)
+	}
+}
+
+// drop forgets a file and releases its chunks, returning the bytes freed.  The caller must hold the lock.
+func (c *chunkCache) drop(key string) (int64, bool) {
+	f, ok := c.files[key]
+	if !ok {
+		return 0, false
+	}
+
+	delete(c.files, key)
+	delete(c.sums, key)
+	return c.release(f), true
+}
+
+// release drops a file's hold on its chunks, removing those no longer used and returning the bytes freed.
+// The caller must hold the lock.
+func (c *chunkCache) release(f chunkedFile) int64 {
+	var freed int64
+	for _, name := range f.chunks {
+		c.chunks[name]--
+		if c.chunks[name] > 0 {
+			continue
+		}
+		delete(c.chunks, name)
+
+		path := c.chunkPath(name)
+		if info, err := os.Stat(path); err == nil {
+			freed += info.Size()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove cache chunk: %s", err.Error())
+		}
+	}
+	c.total -= freed
+	return freed
+}
+
+// Stats reports the number of files cached and the bytes held in chunks
+func (c *chunkCache) Stats() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+
+	return CacheStats{
+		Files: len(c.files),
+		Bytes: c.total,
+	}
+}
+
+// File never finds a file, as content is split across chunks
+func (c *chunkCache) File(s SubFile) (string, bool) {
+	return "", false
+}
+
+// Checksum returns the MD5 of a file's content, reassembling it on first use
+func (c *chunkCache) Checksum(s SubFile) (string, bool) {
+	key := s.accountKey()
+
+	c.RLock()
+	sum, ok := c.sums[key]
+	c.RUnlock()
+	if ok {
+		return sum, true
+	}
+
+	buf, ok := c.Get(s)
+	if !ok {
+		return "", false
+	}
+	sum = checksum(buf)
+
+	c.Lock()
+	if _, ok := c.files[key]; ok {
+		c.sums[key] = sum
+	}
+	c.Unlock()
+	return sum, true
+}
+
+// Open counts an open handle on a file
+func (c *chunkCache) Open(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]++
+}
+
+// Release drops an open handle on a file
+func (c *chunkCache) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]--
+	if c.refs[key] <= 0 {
+		delete(c.refs, key)
+	}
+}
+
+// Purge removes every file, returning the number removed
+func (c *chunkCache) Purge() int {
+	c.Lock()
+	defer c.Unlock()
+
+	count := len(c.files)
+	for key := range c.files {
+		c.drop(key)
+	}
+	return count
+}
+
+// Expire removes files cached longer than maxAge ago, unless open
+func (c *chunkCache) Expire(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for key, f := range c.files {
+		if f.added.Before(cutoff) && c.refs[key] == 0 {
+			c.drop(key)
+			count++
+		}
+	}
+	return count
+}
+
+// Close removes every file and the chunk directory at shutdown.  Open handles keep the content they read
+// until released.
+func (c *chunkCache) Close() int {
+	count := c.Purge()
+	if err := os.RemoveAll(c.dir); err != nil {
+		log.Printf("Failed to remove cache chunk directory: %s", err.Error())
+	}
+	return count
+}
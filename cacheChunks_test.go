@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestChunkCacheShared checks that the same content cached for two accounts is stored once, and outlives
+// the eviction of either copy
+func TestChunkCacheShared(t *testing.T) {
+	c, err := newChunkCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	file := fakeSong("Shared", fakeSongID, 3*chunkSize+100)
+	first := SubFile{acct: newTestFilesystem(t, newFakeServer(t, "First", 1, 1)).accounts[0], ID: fakeSongID, Suffix: "flac"}
+	second := SubFile{acct: newTestFilesystem(t, newFakeServer(t, "Second", 1, 1)).accounts[0], ID: fakeSongID, Suffix: "flac"}
+	c.Put(first, file)
+	c.Put(second, file)
+
+	if stats := c.Stats(); stats.Files != 2 || stats.Bytes != int64(len(file)) {
+		t.Fatalf("cached %d files in %d bytes, want 2 in %d", stats.Files, stats.Bytes, len(file))
+	}
+
+	c.Evict(first.accountKey())
+	if _, ok := c.Get(first); ok {
+		t.Fatal("evicted file still cached")
+	}
+	buf, ok := c.Get(second)
+	if !ok || !bytes.Equal(buf, file) {
+		t.Fatal("shared content lost with the other copy")
+	}
+
+	c.Evict(second.accountKey())
+	if stats := c.Stats(); stats.Files != 0 || stats.Bytes != 0 {
+		t.Fatalf("cached %d files in %d bytes after evicting both", stats.Files, stats.Bytes)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// cacheEncrypt enables encryption of cached media files on disk
+var cacheEncrypt = flag.Bool("cache-encrypt", false, "Encrypt cached files on disk, using the passphrase from $SUBFS_CACHE_PASSPHRASE, -cache-passphrase-file, or the keyring")
+
+// cachePassphraseFile is a file containing the cache encryption passphrase
+var cachePassphraseFile = flag.String("cache-passphrase-file", "", "File containing the passphrase for -cache-encrypt")
+
+// cacheCipher encrypts and decrypts cached files, or is nil when encryption is disabled
+var cacheCipher cipher.AEAD
+
+// cacheKeyIterations is the number of PBKDF2 iterations used to derive the cache key
+const cacheKeyIterations = 100000
+
+// initCacheEncryption derives the cache encryption key from the configured passphrase
+func initCacheEncryption() error {
+	passphrase, err := cachePassphrase()
+	if err != nil {
+		return err
+	}
+
+	salt, err := cacheSalt()
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(passphrase, salt, cacheKeyIterations, 32, sha256.New))
+	if err != nil {
+		return err
+	}
+
+	cacheCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// cachePassphrase finds the passphrase for cache encryption, trying the environment, the passphrase
+// file, and finally the desktop keyring via secret-tool
+func cachePassphrase() ([]byte, error) {
+	if p := os.Getenv("SUBFS_CACHE_PASSPHRASE"); p != "" {
+		return []byte(p), nil
+	}
+
+	if *cachePassphraseFile != "" {
+		p, err := ioutil.ReadFile(*cachePassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(p, "\r\n"), nil
+	}
+
+	p, err := exec.Command("secret-tool", "lookup", "application", "subfs").Output()
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("no cache passphrase found in $SUBFS_CACHE_PASSPHRASE, -cache-passphrase-file, or keyring")
+	}
+	return bytes.TrimRight(p, "\r\n"), nil
+}
+
+// cacheSaltSize is the length of the salt for key derivation
+const cacheSaltSize = 16
+
+// cacheSalt returns the salt for key derivation.  A shared cache directory keeps its salt alongside the
+// cached files so that every instance derives the same key, while private caches use a random salt.
+func cacheSalt() ([]byte, error) {
+	salt := make([]byte, cacheSaltSize)
+	if *cacheDir == "" {
+		_, err := rand.Read(salt)
+		return salt, err
+	}
+
+	name := filepath.Join(*cacheDir, "salt")
+	if existing, err := readCacheSalt(name); err == nil {
+		return existing, nil
+	}
+
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// Only one of several instances starting together creates the salt, and the others use the winner's
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return readCacheSalt(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(salt); err != nil {
+		f.Close()
+		os.Remove(name)
+		return nil, err
+	}
+	return salt, f.Close()
+}
+
+// readCacheSalt reads the salt of a shared cache directory, waiting briefly for an instance which is still
+// writing it
+func readCacheSalt(name string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		salt, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(salt) == cacheSaltSize {
+			return salt, nil
+		}
+		if attempt == 10 {
+			return nil, errors.New("salt in the cache directory is incomplete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sealCache encrypts a cached file's content, prefixing it with a random nonce
+func sealCache(plain []byte) ([]byte, error) {
+	nonce := make([]byte, cacheCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return cacheCipher.Seal(nonce, nonce, plain, nil), nil
+}
+
+// openCache decrypts content produced by sealCache
+func openCache(sealed []byte) ([]byte, error) {
+	size := cacheCipher.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("cached file is too short to decrypt")
+	}
+
+	return cacheCipher.Open(nil, sealed[:size], sealed[size:], nil)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dirCache keeps cached files in a directory which may be shared between several subfs instances, and
+// which survives restarts.  A manifest records every file in the directory, so that its size counts
+// against the cache limit from the start.
+type dirCache struct {
+	cacheFiles
+	dir string
+}
+
+// cacheManifestEntry describes one file in the cache directory's manifest
+type cacheManifestEntry struct {
+	Stored int64     `json:"stored"`
+	Added  time.Time `json:"added"`
+	MD5    string    `json:"md5,omitempty"`
+}
+
+// newDirCache returns a dirCache for dir, counting the files already listed in its manifest
+func newDirCache(dir string) (*dirCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &dirCache{
+		cacheFiles: newCacheFiles(false),
+		dir:        dir,
+	}
+
+	// Count files left by earlier runs and other instances, forgetting any which have since been removed,
+	// and removing any whose size doesn't match, having been truncated before writes were atomic
+	err := c.updateManifest(func(manifest map[string]cacheManifestEntry) {
+		for name, entry := range manifest {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				delete(manifest, name)
+				continue
+			}
+			if info.Size() != entry.Stored {
+				log.Printf("Removing truncated cache file: %s", name)
+				os.Remove(filepath.Join(dir, name))
+				delete(manifest, name)
+				continue
+			}
+			c.total += entry.Stored
+		}
+		c.total -= c.collect(manifest)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// manifestPath returns the location of the manifest
+func (c *dirCache) manifestPath() string {
+	return filepath.Join(c.dir, "manifest.json")
+}
+
+// updateManifest reads the manifest, lets update change it, and writes it back, all under an exclusive lock
+// so that instances sharing the directory don't lose each other's changes
+func (c *dirCache) updateManifest(update func(manifest map[string]cacheManifestEntry)) error {
+	lock, err := lockCacheFile(c.manifestPath(), true)
+	if err != nil {
+		return err
+	}
+	defer unlockCacheFile(lock)
+
+	manifest := map[string]cacheManifestEntry{}
+	if data, err := ioutil.ReadFile(c.manifestPath()); err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			log.Printf("Ignoring corrupt cache manifest %s: %s", c.manifestPath(), err.Error())
+		}
+	}
+
+	update(manifest)
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.manifestPath(), data, 0644)
+}
+
+// manifestName returns the name of a file within the cache directory, as recorded in the manifest
+func (c *dirCache) manifestName(s SubFile) string {
+	name, err := filepath.Rel(c.dir, s.cachePath())
+	if err != nil {
+		return s.cachePath()
+	}
+	return name
+}
+
+// Get returns a file's content, which another instance may have cached in the shared directory
+func (c *dirCache) Get(s SubFile) ([]byte, bool) {
+	name := s.cachePath()
+	if _, err := os.Stat(name); err != nil {
+		if _, ok := c.lookup(s.accountKey()); ok {
+			log.Printf("Cache missing: [%d] %s", s.ID, s.FileName)
+			c.Evict(s.accountKey())
+			err := c.updateManifest(func(manifest map[string]cacheManifestEntry) {
+				delete(manifest, c.manifestName(s))
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		return nil, false
+	}
+
+	lock, err := lockCacheFile(name, false)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	defer unlockCacheFile(lock)
+
+	buf, err := ioutil.ReadFile(name)
+	if err != nil || len(buf) == 0 {
+		return nil, false
+	}
+
+	if _, ok := c.lookup(s.accountKey()); !ok {
+		log.Printf("Shared cache hit: [%d] %s", s.ID, s.FileName)
+	}
+	return decodeCache(s, buf)
+}
+
+// File returns the file in the shared directory holding a file's content, if cached as is by any instance
+func (c *dirCache) File(s SubFile) (string, bool) {
+	if !storedPlain(s) {
+		return "", false
+	}
+	name := s.cachePath()
+	if _, err := os.Stat(name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// Put writes a file's content to the shared directory while holding its lock, and records it in the manifest
+func (c *dirCache) Put(s SubFile, file []byte) {
+	data, err := encodeCache(s, file)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !cacheFits(s, atomic.LoadInt64(&c.total), int64(len(data))) {
+		return
+	}
+
+	name := s.cachePath()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		log.Println(err)
+		return
+	}
+
+	lock, err := lockCacheFile(name, true)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer unlockCacheFile(lock)
+
+	// Write to a .part file, renamed into place once complete, so that a crash midway never leaves a
+	// truncated file which later reads would take for a cached one
+	part := name + ".part"
+	cFile, err := os.Create(part)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := writeComplete(cFile, data); err != nil {
+		log.Println(err)
+		cFile.Close()
+		os.Remove(part)
+		return
+	}
+	cFile.Close()
+	if err := os.Rename(part, name); err != nil {
+		log.Println(err)
+		os.Remove(part)
+		return
+	}
+
+	// Track the file under its final name, which expiry looks it up by
+	cFile, err = os.Open(name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	sum := checksum(file)
+
+	err = c.updateManifest(func(manifest map[string]cacheManifestEntry) {
+		manifest[c.manifestName(s)] = cacheManifestEntry{
+			Stored: int64(len(data)),
+			Added:  time.Now(),
+			MD5:    sum,
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Add file to cache map
+	log.Printf("Caching file: [%d] %s", s.ID, s.FileName)
+	c.add(s.accountKey(), *cFile, int64(len(data)), sum)
+}
+
+// Checksum returns the MD5 of a cached file's content, as recorded in the manifest by whichever instance
+// cached it, or else reads it back and records it there
+func (c *dirCache) Checksum(s SubFile) (string, bool) {
+	if sum, ok := c.sum(s.accountKey()); ok {
+		return sum, true
+	}
+
+	buf, ok := c.Get(s)
+	if !ok {
+		return "", false
+	}
+
+	var sum string
+	err := c.updateManifest(func(manifest map[string]cacheManifestEntry) {
+		entry, ok := manifest[c.manifestName(s)]
+		if !ok {
+			return
+		}
+		if entry.MD5 == "" {
+			entry.MD5 = checksum(buf)
+			manifest[c.manifestName(s)] = entry
+		}
+		sum = entry.MD5
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if sum == "" {
+		sum = checksum(buf)
+	}
+
+	c.setSum(s.accountKey(), sum)
+	return sum, true
+}
+
+// Expire removes files added to the directory longer than maxAge ago, by this or any other instance, as
+// recorded in the manifest
+func (c *dirCache) Expire(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+	count := 0
+
+	err := c.updateManifest(func(manifest map[string]cacheManifestEntry) {
+		for name, entry := range manifest {
+			if !entry.Added.Before(cutoff) {
+				continue
+			}
+
+			// Files known to this instance are evicted as usual, unless open, and others only uncounted
+			path := filepath.Join(c.dir, name)
+			if key, ok := c.keyFor(path); ok {
+				if c.inUse(key) {
+					continue
+				}
+				c.Evict(key)
+			} else {
+				logCacheUse(atomic.AddInt64(&c.total, -entry.Stored), -entry.Stored)
+			}
+
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			delete(manifest, name)
+			count++
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return count
+}
+
+// keyFor returns the cache key of a file known to this instance by its path
+func (c *dirCache) keyFor(path string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for key, f := range c.files {
+		if f.Name() == path {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// writeComplete writes data to a file and flushes it to disk, checking that all of it arrived
+func writeComplete(f *os.File, data []byte) error {
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(len(data)) {
+		return fmt.Errorf("cache file %s is %d bytes rather than %d", f.Name(), info.Size(), len(data))
+	}
+	return nil
+}
+
+// cacheGrace is how old an unlisted or partial file in the cache directory must be before it is taken to
+// be left over from a crash, rather than being written by another instance at this moment
+const cacheGrace = time.Hour
+
+// collect removes what earlier runs left behind in the cache directory, being .part files and files
+// missing from the manifest, and then the oldest files until the cache fits within -cache.  It returns
+// the bytes removed of those counted in the manifest.  The caller must hold the manifest lock.
+func (c *dirCache) collect(manifest map[string]cacheManifestEntry) int64 {
+	cutoff := time.Now().Add(-cacheGrace)
+	var orphans int
+	filepath.Walk(c.dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, name)
+		if err != nil || rel == "manifest.json" || rel == "salt" || strings.HasSuffix(rel, ".lock") {
+			return nil
+		}
+		if _, ok := manifest[rel]; ok && !strings.HasSuffix(rel, ".part") {
+			return nil
+		}
+
+		if err := os.Remove(name); err == nil {
+			orphans++
+		}
+		return nil
+	})
+	if orphans > 0 {
+		log.Printf("Removed %d orphaned cache file(s)", orphans)
+	}
+
+	// Remove the oldest files while over budget, from files left at a larger -cache
+	var total int64
+	names := make([]string, 0, len(manifest))
+	for name, entry := range manifest {
+		total += entry.Stored
+		names = append(names, name)
+	}
+	sort.Stable(manifestAgeSorter{names, manifest})
+
+	var removed int64
+	for _, name := range names {
+		if total-removed <= *cacheSize*1024*1024 {
+			break
+		}
+		os.Remove(filepath.Join(c.dir, name))
+		removed += manifest[name].Stored
+		delete(manifest, name)
+	}
+	if removed > 0 {
+		log.Printf("Removed %0.3f MB of cached files over the %d MB limit", float64(removed)/1024/1024, *cacheSize)
+	}
+	return removed
+}
+
+// manifestAgeSorter sorts cached file names from the oldest added
+type manifestAgeSorter struct {
+	names    []string
+	manifest map[string]cacheManifestEntry
+}
+
+func (s manifestAgeSorter) Len() int      { return len(s.names) }
+func (s manifestAgeSorter) Swap(i, j int) { s.names[i], s.names[j] = s.names[j], s.names[i] }
+func (s manifestAgeSorter) Less(i, j int) bool {
+	return s.manifest[s.names[i]].Added.Before(s.manifest[s.names[j]].Added)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// memoryCache keeps cached files in memory, bounded by -cache, so that nothing is ever written to disk.
+// Evicted content still read by open handles stays in memory until they release it.
+type memoryCache struct {
+	sync.RWMutex
+
+	// data maps a cache key to its content, sums to the MD5 of its content once known, added to when it
+	// was cached, and refs to its number of open handles
+	data  map[string][]byte
+	sums  map[string]string
+	added map[string]time.Time
+	refs  map[string]int
+
+	// total is the number of bytes held
+	total int64
+}
+
+// newMemoryCache returns an empty memoryCache
+func newMemoryCache() *memoryCache {
+	return &memoryCache{
+		data:  map[string][]byte{},
+		sums:  map[string]string{},
+		added: map[string]time.Time{},
+		refs:  map[string]int{},
+	}
+}
+
+// Get returns a file's content, if held
+func (c *memoryCache) Get(s SubFile) ([]byte, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	data, ok := c.data[s.accountKey()]
+	return data, ok
+}
+
+// Put holds a file's content, if it fits
+func (c *memoryCache) Put(s SubFile, data []byte) {
+	key := s.accountKey()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.data[key]; ok {
+		return
+	}
+	if !cacheFits(s, c.total, int64(len(data))) {
+		return
+	}
+
+	log.Printf("Caching file in memory: [%d] %s", s.ID, s.FileName)
+	c.data[key] = data
+	c.added[key] = time.Now()
+	c.total += int64(len(data))
+	logCacheUse(c.total, int64(len(data)))
+}
+
+// Evict drops a file's content
+func (c *memoryCache) Evict(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if size, ok := c.drop(key); ok {
+		logCacheUse(c.total, -size)
+	}
+}
+
+// drop forgets a file's content, returning its size.  The caller must hold the lock.
+func (c *memoryCache) drop(key string) (int64, bool) {
+	data, ok := c.data[key]
+	if !ok {
+		return 0, false
+	}
+
+	delete(c.data, key)
+	delete(c.sums, key)
+	delete(c.added, key)
+	c.total -= int64(len(data))
+	return int64(len(data)), true
+}
+
+// Stats reports the number of files and bytes held
+func (c *memoryCache) Stats() CacheStats {
+	c.RLock()
+	defer c.RUnlock()
+
+	return CacheStats{
+		Files: len(c.data),
+		Bytes: c.total,
+	}
+}
+
+// File never finds a file, as nothing is on disk
+func (c *memoryCache) File(s SubFile) (string, bool) {
+	return "", false
+}
+
+// Checksum returns the MD5 of a file's content, computing it on first use
+func (c *memoryCache) Checksum(s SubFile) (string, bool) {
+	key := s.accountKey()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if sum, ok := c.sums[key]; ok {
+		return sum, true
+	}
+	data, ok := c.data[key]
+	if !ok {
+		return "", false
+	}
+	c.sums[key] = checksum(data)
+	return c.sums[key], true
+}
+
+// Open counts an open handle on a file
+func (c *memoryCache) Open(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]++
+}
+
+// Release drops an open handle on a file
+func (c *memoryCache) Release(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.refs[key]--
+	if c.refs[key] <= 0 {
+		delete(c.refs, key)
+	}
+}
+
+// Purge drops every file, returning the number dropped
+func (c *memoryCache) Purge() int {
+	c.Lock()
+	defer c.Unlock()
+
+	count := len(c.data)
+	for key := range c.data {
+		c.drop(key)
+	}
+	return count
+}
+
+// Expire drops files cached longer than maxAge ago, unless open
+func (c *memoryCache) Expire(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for key, added := range c.added {
+		if added.Before(cutoff) && c.refs[key] == 0 {
+			c.drop(key)
+			count++
+		}
+	}
+	return count
+}
+
+// Close drops every file at shutdown.  Open handles keep the content they read until released.
+func (c *memoryCache) Close() int {
+	return c.Purge()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// noCacheMode turns off caching, so that reads go straight to the server, as does -cache=0
+var noCacheMode = flag.Bool("no-cache", false, "Cache nothing, translating reads into Range requests against the server, for devices where no temporary files may be written, as does -cache=0")
+
+// proxyReads reports whether files are read straight from the server, without caching their content
+func proxyReads() bool {
+	return *noCacheMode || *cacheSize == 0
+}
+
+// noCache is the cache backend when caching is off, which never holds anything
+type noCache struct{}
+
+// Get never finds a file
+func (noCache) Get(s SubFile) ([]byte, bool) {
+	return nil, false
+}
+
+// Put discards a file's content
+func (noCache) Put(s SubFile, data []byte) {}
+
+// Evict does nothing, as nothing is cached
+func (noCache) Evict(key string) {}
+
+// Stats reports an empty cache
+func (noCache) Stats() CacheStats {
+	return CacheStats{}
+}
+
+// File never finds a file
+func (noCache) File(s SubFile) (string, bool) {
+	return "", false
+}
+
+// Checksum never finds a file
+func (noCache) Checksum(s SubFile) (string, bool) {
+	return "", false
+}
+
+// Open and Release do nothing, as there are no files to keep
+func (noCache) Open(key string)    {}
+func (noCache) Release(key string) {}
+
+// Purge removes nothing
+func (noCache) Purge() int {
+	return 0
+}
+
+// Expire removes nothing
+func (noCache) Expire(maxAge time.Duration) int {
+	return 0
+}
+
+// Close releases nothing
+func (noCache) Close() int {
+	return 0
+}
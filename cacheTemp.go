@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tempCache keeps cached files in private temporary files, removed when evicted and at shutdown
+type tempCache struct {
+	cacheFiles
+}
+
+// newTempCache returns an empty tempCache
+func newTempCache() *tempCache {
+	return &tempCache{
+		cacheFiles: newCacheFiles(true),
+	}
+}
+
+// Get returns a file's content from its temporary file, if present
+func (c *tempCache) Get(s SubFile) ([]byte, bool) {
+	key := s.accountKey()
+	cFile, ok := c.lookup(key)
+	if !ok {
+		return nil, false
+	}
+
+	// Check for missing file, meaning the cached file got wiped out
+	buf, err := ioutil.ReadFile(cFile.Name())
+	if err == nil {
+		return decodeCache(s, buf)
+	}
+
+	// Purge item from cache
+	log.Printf("Cache missing: [%d] %s", s.ID, s.FileName)
+	c.Evict(key)
+	return nil, false
+}
+
+// File returns the temporary file holding a file's content, if cached as is
+func (c *tempCache) File(s SubFile) (string, bool) {
+	if !storedPlain(s) {
+		return "", false
+	}
+	f, ok := c.lookup(s.accountKey())
+	if !ok {
+		return "", false
+	}
+	return f.Name(), true
+}
+
+// Put writes a file's content to a new temporary file, if it fits
+func (c *tempCache) Put(s SubFile, file []byte) {
+	data, err := encodeCache(s, file)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if !cacheFits(s, atomic.LoadInt64(&c.total), int64(len(data))) {
+		return
+	}
+
+	// Generate a temporary file
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "subfs")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Write out temporary file
+	if _, err := tmpFile.Write(data); err != nil {
+		log.Println(err)
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return
+	}
+
+	// Add file to cache map
+	log.Printf("Caching file: [%d] %s", s.ID, s.FileName)
+	c.add(s.accountKey(), *tmpFile, int64(len(data)), checksum(file))
+}
+
+// Checksum returns the MD5 of a cached file's content, reading it back if it was not recorded
+func (c *tempCache) Checksum(s SubFile) (string, bool) {
+	if sum, ok := c.sum(s.accountKey()); ok {
+		return sum, true
+	}
+
+	buf, ok := c.Get(s)
+	if !ok {
+		return "", false
+	}
+	sum := checksum(buf)
+	c.setSum(s.accountKey(), sum)
+	return sum, true
+}
+
+// Expire removes temporary files cached longer than maxAge ago
+func (c *tempCache) Expire(maxAge time.Duration) int {
+	keys := c.expired(time.Now().Add(-maxAge))
+	for _, key := range keys {
+		c.Evict(key)
+	}
+	return len(keys)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// chapterFiles adds an ffmetadata chapter file beside media with known chapters or a bookmark
+var chapterFiles = flag.Bool("chapters", false, "Add <name>.ffmetadata chapter files beside media with a cue sheet or bookmark, for use with mpv --chapters-file")
+
+// chapter is a named position within a file, in seconds
+type chapter struct {
+	Start float64
+	Title string
+}
+
+// chapterSorter sorts chapters by their start
+type chapterSorter []chapter
+
+func (s chapterSorter) Len() int           { return len(s) }
+func (s chapterSorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s chapterSorter) Less(i, j int) bool { return s[i].Start < s[j].Start }
+
+// chapters returns the chapters of a file, from its cue sheet and its bookmark, or nil if neither is known
+func (s SubFile) chapters() []chapter {
+	chapters := []chapter{}
+
+	// Tracks of a cue sheet are chapters of the whole file
+	if s.CueLength == 0 {
+		sfs := s.acct.sfs
+		sfs.cueLock.Lock()
+		tracks := sfs.cueSheets[cueKey(s.acct, s.ID)]
+		sfs.cueLock.Unlock()
+
+		if len(tracks) >= 2 {
+			for _, t := range tracks {
+				title := t.Title
+				if title == "" {
+					title = fmt.Sprintf("Track %02d", t.Number)
+				}
+				chapters = append(chapters, chapter{t.Start, title})
+			}
+		}
+	}
+
+	// The position reached is a chapter of its own, to jump back to
+	if mark, ok := s.acct.sfs.bookmarks.get(s.acct, s.ID); ok && mark.Position > 0 {
+		chapters = append(chapters, chapter{float64(mark.Position) / 1000, "Bookmark"})
+	}
+
+	if len(chapters) == 0 {
+		return nil
+	}
+	sort.Stable(chapterSorter(chapters))
+	if chapters[0].Start > 0 {
+		chapters = append([]chapter{{0, "Start"}}, chapters...)
+	}
+	return chapters
+}
+
+// ffmetadata formats chapters in FFmpeg's metadata format, each running until the next one starts
+func (s SubFile) ffmetadata() []byte {
+	chapters := s.chapters()
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, ";FFMETADATA1")
+	for i, c := range chapters {
+		end := float64(s.Duration)
+		if i+1 < len(chapters) {
+			end = chapters[i+1].Start
+		}
+		if end <= c.Start {
+			continue
+		}
+
+		fmt.Fprintln(&buf, "[CHAPTER]")
+		fmt.Fprintln(&buf, "TIMEBASE=1/1000")
+		fmt.Fprintf(&buf, "START=%d\n", int64(c.Start*1000))
+		fmt.Fprintf(&buf, "END=%d\n", int64(end*1000))
+		fmt.Fprintf(&buf, "title=%s\n", ffmetadataEscape(c.Title))
+	}
+	return buf.Bytes()
+}
+
+// ffmetadataEscape escapes the characters with special meaning in FFmpeg metadata values
+func ffmetadataEscape(s string) string {
+	for _, c := range []string{"\\", "=", ";", "#", "\n"} {
+		s = strings.Replace(s, c, "\\"+c, -1)
+	}
+	return s
+}
+
+// addChapterFiles adds a chapter file beside each file of this directory with chapters, which are
+// regenerated on every read so that they follow the bookmark
+func (d SubDir) addChapterFiles(directories []fuse.Dirent) []fuse.Dirent {
+	for name, f := range d.files {
+		if f.IsArt || f.CueLength > 0 || f.Duration == 0 || f.chapters() == nil {
+			continue
+		}
+
+		chapterName := strings.TrimSuffix(name, "."+f.Suffix) + ".ffmetadata"
+		f := f
+		d.virtual[chapterName] = newVirtualFile(0, func() ([]byte, error) {
+			return f.ffmetadata(), nil
+		})
+		directories = append(directories, fuse.Dirent{
+			Name: chapterName,
+			Type: fuse.DT_File,
+		})
+	}
+	return directories
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// collation chooses how names are compared when subfs sorts them, as servers list them in byte order
+var collation = flag.String("collate", "bytes", "Order of sorted names: bytes, locale for the language of $LC_ALL, $LC_COLLATE or $LANG, or a language such as de or sv")
+
+// collator compares names under -collate.  A collate.Collator isn't safe for concurrent use, so sorts
+// take the lock while computing their keys.
+var collator struct {
+	sync.Mutex
+	once sync.Once
+	c    *collate.Collator
+	buf  collate.Buffer
+}
+
+// localeLanguage returns the language of the collation locale from the environment, such as "de-DE" for
+// LANG=de_DE.UTF-8, or an empty string for the C and POSIX locales
+func localeLanguage() string {
+	locale := ""
+	for _, name := range []string{"LC_ALL", "LC_COLLATE", "LANG"} {
+		if locale = os.Getenv(name); locale != "" {
+			break
+		}
+	}
+
+	// Drop the encoding and modifier, as in de_DE.UTF-8@euro
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "C" || locale == "POSIX" {
+		return ""
+	}
+	return strings.Replace(locale, "_", "-", -1)
+}
+
+// nameCollator returns the collator for -collate, or nil when names are compared byte by byte
+func nameCollator() *collate.Collator {
+	collator.once.Do(func() {
+		name := *collation
+		switch name {
+		case "bytes", "":
+			return
+		case "locale":
+			name = localeLanguage()
+		}
+
+		// Unknown languages still get Unicode's default collation, rather than byte order
+		tag := language.Und
+		if name != "" {
+			parsed, err := language.Parse(name)
+			if err != nil {
+				log.Printf("subfs: unknown collation language %s, using the default: %s", name, err.Error())
+			} else {
+				tag = parsed
+			}
+		}
+		collator.c = collate.New(tag)
+	})
+	return collator.c
+}
+
+// nameLess returns a comparison of the given names under -collate, computing each name's collation key
+// once up front rather than on every comparison
+func nameLess(names []string) func(a, b string) bool {
+	c := nameCollator()
+	if c == nil {
+		return func(a, b string) bool { return a < b }
+	}
+
+	collator.Lock()
+	defer collator.Unlock()
+
+	// Keys are copied out, as they only remain valid in the buffer until its next reset
+	keys := make(map[string]string, len(names))
+	for _, name := range names {
+		keys[name] = string(c.KeyFromString(&collator.buf, name))
+	}
+	collator.buf.Reset()
+
+	return func(a, b string) bool {
+		if keys[a] != keys[b] {
+			return keys[a] < keys[b]
+		}
+		return a < b
+	}
+}
+
+// direntNameLess returns a comparison of the names of directory entries under -collate
+func direntNameLess(entries []fuse.Dirent) func(a, b string) bool {
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return nameLess(names)
+}
+
+// nameSorter sorts names with a comparison function
+type nameSorter struct {
+	names []string
+	less  func(a, b string) bool
+}
+
+func (s nameSorter) Len() int           { return len(s.names) }
+func (s nameSorter) Swap(i, j int)      { s.names[i], s.names[j] = s.names[j], s.names[i] }
+func (s nameSorter) Less(i, j int) bool { return s.less(s.names[i], s.names[j]) }
+
+// sortNames sorts names under -collate
+func sortNames(names []string) {
+	sort.Sort(nameSorter{names, nameLess(names)})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// composersView adds the Composers directory, grouping known songs by their composer
+var composersView = flag.Bool("composers", false, "Add a Composers directory grouping songs seen so far by composer, as reported by OpenSubsonic servers")
+
+// apiContributor is a contributor to a song and their role, as listed by OpenSubsonic servers
+type apiContributor struct {
+	Role   string `json:"role"`
+	Artist struct {
+		ID   apiInt `json:"id"`
+		Name string `json:"name"`
+	} `json:"artist"`
+}
+
+// composer is a composer of a song, with their artist ID if the server knows them as an artist
+type composer struct {
+	Name string
+	ID   int64
+}
+
+// composers returns the composers of a song, from its contributors or else its composer tag
+func (c apiChild) composers() []composer {
+	composers := []composer{}
+	seen := map[string]bool{}
+	for _, contributor := range c.Contributors {
+		if contributor.Role != "composer" || contributor.Artist.Name == "" || seen[contributor.Artist.Name] {
+			continue
+		}
+		seen[contributor.Artist.Name] = true
+		composers = append(composers, composer{contributor.Artist.Name, int64(contributor.Artist.ID)})
+	}
+
+	if len(composers) == 0 && c.DisplayComposer != "" {
+		composers = append(composers, composer{Name: c.DisplayComposer})
+	}
+	return composers
+}
+
+// newComposersDir returns the Composers directory, holding a directory per composer of known songs, each
+// with a directory per album containing their works
+func newComposersDir(a *account) VirtualDir {
+	return newCachedDir(time.Minute, func() (map[string]fs.Node, error) {
+		works := map[string][]apiChild{}
+		for _, c := range a.songs.matching(func(c apiChild) bool { return len(c.composers()) > 0 }) {
+			for _, composer := range c.composers() {
+				name := limitName(sanitizeName(artistDisplayName(rewrite("artist", composer.Name))), composer.ID)
+				works[name] = append(works[name], c)
+			}
+		}
+
+		entries := map[string]fs.Node{}
+		for name, songs := range works {
+			entries[name] = newStaticDir(albumDirs(a, songs))
+		}
+		return entries, nil
+	})
+}
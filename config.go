@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config is the optional JSON configuration file given by the -config flag
+type Config struct {
+	// Users lists Subsonic accounts, each of which appears as a top-level directory
+	Users []UserConfig `json:"users"`
+
+	// Playlists defines smart playlists, shown for every account
+	Playlists []SmartPlaylistConfig `json:"playlists"`
+
+	// Audiobooks lists path prefixes, such as "/Audiobooks", below which directories hold audiobooks
+	Audiobooks []string `json:"audiobooks"`
+
+	// Rewrites lists regular expression rules which rewrite metadata before it is used in names
+	Rewrites []RewriteConfig `json:"rewrites"`
+
+	// Views lists further mount points, each showing one directory of the tree
+	Views []ViewConfig `json:"views"`
+}
+
+// UserConfig describes the credentials for one Subsonic account
+type UserConfig struct {
+	// Name of the top-level directory for this account, defaulting to User
+	Name string `json:"name"`
+
+	// Host of the Subsonic server, defaulting to the -host flag
+	Host string `json:"host"`
+
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	// PasswordFile holds the password instead, re-read on SIGHUP
+	PasswordFile string `json:"passwordFile"`
+}
+
+// SmartPlaylistConfig describes a playlist whose songs are chosen by the server on access
+type SmartPlaylistConfig struct {
+	// Name of the playlist's directory and m3u file
+	Name string `json:"name"`
+
+	// Genre, year range and minimum rating which songs must match, ignored when empty
+	Genre     string `json:"genre"`
+	FromYear  int64  `json:"fromYear"`
+	ToYear    int64  `json:"toYear"`
+	MinRating int64  `json:"minRating"`
+
+	// Size is the number of songs in the playlist, defaulting to 50
+	Size int `json:"size"`
+
+	// Order is either "random" (the default) or "newest", for recently added albums first
+	Order string `json:"order"`
+}
+
+// RewriteConfig is a rule which rewrites an artist, album or title string, applied to both filenames and
+// directory names
+type RewriteConfig struct {
+	// Field is one of artist, album or title
+	Field string `json:"field"`
+
+	// Pattern is a regular expression, and Replace its replacement, which may refer to groups as $1
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// ViewConfig is a further mount point of the same instance, sharing its accounts and cache, which shows
+// one directory of the tree as its root
+type ViewConfig struct {
+	// Mount is the directory the view is mounted at
+	Mount string `json:"mount"`
+
+	// Path of the directory shown, relative to the root of the tree, such as "Playlists"
+	Path string `json:"path"`
+}
+
+// loadConfig reads and parses the JSON configuration file at path
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := new(Config)
+	if err := json.NewDecoder(f).Decode(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
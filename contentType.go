@@ -0,0 +1,49 @@
+package main
+
+import (
+	"mime"
+	"strings"
+)
+
+// contentTypeSuffixes maps the audio content types servers report onto file suffixes, for servers which
+// report a transcode's content type without its suffix
+var contentTypeSuffixes = map[string]string{
+	"audio/mpeg":   "mp3",
+	"audio/mp3":    "mp3",
+	"audio/ogg":    "ogg",
+	"audio/opus":   "opus",
+	"audio/aac":    "aac",
+	"audio/mp4":    "m4a",
+	"audio/x-m4a":  "m4a",
+	"audio/flac":   "flac",
+	"audio/x-flac": "flac",
+	"audio/wav":    "wav",
+	"audio/x-wav":  "wav",
+	"audio/webm":   "webm",
+}
+
+// baseContentType returns a content type without its parameters, in lower case
+func baseContentType(contentType string) string {
+	if media, _, err := mime.ParseMediaType(contentType); err == nil {
+		return media
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// transcodedSuffix returns the suffix of this song's transcode as the server reports it, derived from
+// its transcoded content type if the suffix itself is missing, or empty if it isn't transcoded
+func (c apiChild) transcodedSuffix() string {
+	if c.TranscodedSuffix != "" {
+		return c.TranscodedSuffix
+	}
+	return contentTypeSuffixes[baseContentType(c.TranscodedContentType)]
+}
+
+// isMPEGAudio reports whether this file is served as MP3, going by its content type where the server
+// reported one and by its suffix otherwise
+func (s SubFile) isMPEGAudio() bool {
+	if s.ContentType != "" {
+		return contentTypeSuffixes[baseContentType(s.ContentType)] == "mp3"
+	}
+	return strings.EqualFold(s.Suffix, "mp3")
+}
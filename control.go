@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// controlSocket and controlAddr are where the control API is served, on a unix socket guarded by its file
+// permissions, or over HTTP guarded by controlToken
+var controlSocket = flag.String("control-socket", "", "Unix socket serving the control API, to refresh, pin, purge and show stats")
+var controlAddr = flag.String("control-addr", "", "Address serving the control API over HTTP, such as :8081, which requires -control-token")
+var controlToken = flag.String("control-token", "", "Bearer token required by the control API over -control-addr")
+
+// listenPrivate listens on a unix socket only its owner may connect to.  The socket is created with a
+// umask leaving it private from the start, rather than tightened once other users could already connect.
+func listenPrivate(name string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	l, err := net.Listen("unix", name)
+	syscall.Umask(old)
+	return l, err
+}
+
+// serveControl serves the control API on the unix socket and HTTP address given, if any
+func (sfs *Filesystem) serveControl() {
+	if *controlSocket == "" && *controlAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", sfs.controlRefresh)
+	mux.HandleFunc("/pin", sfs.controlPin)
+	mux.HandleFunc("/purge", sfs.controlPurge)
+	mux.HandleFunc("/stats", sfs.controlStats)
+
+	if *controlSocket != "" {
+		os.Remove(*controlSocket)
+		l, err := listenPrivate(*controlSocket)
+		if err != nil {
+			log.Fatalf("Could not serve control API at %s: %s", *controlSocket, err.Error())
+		}
+
+		go func() {
+			if err := http.Serve(l, mux); err != nil {
+				log.Printf("subfs: stopped serving control API at %s: %s", *controlSocket, err.Error())
+			}
+		}()
+	}
+
+	if *controlAddr != "" {
+		if *controlToken == "" {
+			log.Fatalf("Could not serve control API at %s: -control-token is required", *controlAddr)
+		}
+
+		go func() {
+			if err := http.ListenAndServe(*controlAddr, requireToken(*controlToken, mux)); err != nil {
+				log.Fatalf("Could not serve control API at %s: %s", *controlAddr, err.Error())
+			}
+		}()
+	}
+}
+
+// requireToken refuses requests which don't carry the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// controlPost refuses control operations not requested with POST, reporting whether to carry on
+func controlPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// controlRefresh refreshes every account's artist index and playlists now
+func (sfs *Filesystem) controlRefresh(w http.ResponseWriter, r *http.Request) {
+	if !controlPost(w, r) {
+		return
+	}
+
+	for _, a := range sfs.accounts {
+		a.requestRefresh()
+		a.invalidatePlaylists()
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// controlPin fetches every file below the path given, such as Playlists/Dinner, into the cache ahead of
+// time, replying once done with the number of files fetched
+func (sfs *Filesystem) controlPin(w http.ResponseWriter, r *http.Request) {
+	if !controlPost(w, r) {
+		return
+	}
+
+	root, _ := sfs.Root()
+	p := r.FormValue("path")
+	node, err := lookupPath(root, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	files, failed := pinNode(node)
+	log.Printf("subfs: pinned %d file(s) below %s, %d failed", files, p, failed)
+	fmt.Fprintf(w, "pinned %d file(s), %d failed\n", files, failed)
+}
+
+// pinNode reads every file below a node into the cache, returning the number of files read and failed
+func pinNode(node fs.Node) (int, int) {
+	if f, ok := node.(SubFile); ok {
+		if _, err := f.ReadAll(nil); err != nil {
+			log.Printf("subfs: could not pin [%d] %s: %s", f.ID, f.FileName, err)
+			return 0, 1
+		}
+		return 1, 0
+	}
+
+	dir, ok := node.(fs.HandleReadDirer)
+	if !ok {
+		return 0, 0
+	}
+	lookup, ok := node.(fs.NodeStringLookuper)
+	if !ok {
+		return 0, 0
+	}
+	entries, err := dir.ReadDir(nil)
+	if err != nil {
+		return 0, 1
+	}
+
+	var files, failed int
+	for _, e := range entries {
+		// Generated files such as playlists and notes are cheap, and only songs and art need fetching
+		child, err := lookup.Lookup(e.Name, nil)
+		if err != nil || (e.Type != fuse.DT_Dir && !isSubFile(child)) {
+			continue
+		}
+		f, n := pinNode(child)
+		files += f
+		failed += n
+	}
+	return files, failed
+}
+
+// isSubFile reports whether a node is a file served from the server
+func isSubFile(node fs.Node) bool {
+	_, ok := node.(SubFile)
+	return ok
+}
+
+// controlPurge empties the cache
+func (sfs *Filesystem) controlPurge(w http.ResponseWriter, r *http.Request) {
+	if !controlPost(w, r) {
+		return
+	}
+
+	n := sfs.cache.Purge()
+	log.Printf("subfs: purged %d cached file(s)", n)
+	fmt.Fprintf(w, "purged %d file(s)\n", n)
+}
+
+// controlStats reports cache usage, open handles, in-flight downloads, and index age
+func (sfs *Filesystem) controlStats(w http.ResponseWriter, r *http.Request) {
+	for _, line := range sfs.stats() {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+// passwordFile is a file holding the password for -user, read at startup and again on SIGHUP
+var passwordFile = flag.String("password-file", "", "File holding the password for -user, instead of -password, re-read on SIGHUP")
+
+// resolvePassword returns the password for an account from its password file if it has one, or else its
+// configured password, or else the desktop keyring via secret-tool
+func resolvePassword(config UserConfig) (string, error) {
+	if config.PasswordFile != "" {
+		p, err := ioutil.ReadFile(config.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(p), "\r\n"), nil
+	}
+
+	if config.Password != "" {
+		return config.Password, nil
+	}
+
+	// The keyring is the only source left, so failing to read it leaves the account without a password
+	p, err := exec.Command("secret-tool", "lookup", "application", "subfs", "user", config.User).Output()
+	if err != nil {
+		log.Printf("subfs: could not look up the password of %s with secret-tool: %s", config.User, err.Error())
+		return "", fmt.Errorf("no password for %s: set a password or password file, or store one in the keyring: %s", config.User, err.Error())
+	}
+	return strings.TrimRight(string(p), "\r\n"), nil
+}
+
+// password returns the account's current password, which a reload may replace
+func (a *account) password() string {
+	a.credLock.RLock()
+	defer a.credLock.RUnlock()
+	return a.Password
+}
+
+// reloadCredentials reads the account's password again from its password file, configuration or keyring,
+// and checks it with a ping, so that a changed password takes effect without remounting
+func (a *account) reloadCredentials() error {
+	password, err := resolvePassword(a.config)
+	if err != nil {
+		return err
+	}
+
+	a.credLock.Lock()
+	a.Password = password
+	a.credLock.Unlock()
+
+	if err := apiGet(a, "ping", url.Values{}, nil); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&a.authRejected, 0)
+	return nil
+}
+
+// noteAuthError reports the first rejection of the account's credentials since they last worked, as the
+// server then refuses every request, failed with EACCES, until the password is updated and reloaded
+func (a *account) noteAuthError(err error) {
+	if !isAuthError(err) {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&a.authRejected, 0, 1) {
+		log.Printf("subfs: server rejected the credentials for %s, update the password and send SIGHUP to reload it: %s", a.Name, err.Error())
+	}
+}
+
+// credentialsRejected reports whether the server is currently rejecting the account's credentials
+func (a *account) credentialsRejected() bool {
+	return atomic.LoadInt32(&a.authRejected) == 1
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/gosubsonic"
+)
+
+// splitCue enables virtual per-track files for single-file albums with a cue sheet
+var splitCue = flag.Bool("split-cue", false, "Expose single-file albums with a cue sheet as virtual per-track files")
+
+// cueBitRate is the bit rate in kbps of the MP3 transcodes served for cue sheet tracks
+const cueBitRate = 320
+
+// cueTrack is a single track within a cue sheet
+type cueTrack struct {
+	Number    int64
+	Title     string
+	Performer string
+
+	// Start of the track within the parent file, in seconds
+	Start float64
+}
+
+// cueKey identifies the cue sheet of a parent file, whose ID alone may name different files on other accounts
+func cueKey(a *account, id int64) string {
+	return fmt.Sprintf("%s/%d", a.Name, id)
+}
+
+// cueFiles synthesizes per-track virtual files for a directory containing exactly one audio file
+// along with a cue sheet, either listed alongside it or embedded in the file itself
+func (d SubDir) cueFiles(content *gosubsonic.Content) []SubFile {
+	// Find the single media file and any cue sheet listed next to it
+	var media []gosubsonic.Audio
+	var sheet *gosubsonic.Audio
+	for i, a := range content.Audio {
+		if strings.EqualFold(a.Suffix, "cue") {
+			sheet = &content.Audio[i]
+			continue
+		}
+		media = append(media, a)
+	}
+	if len(media) != 1 {
+		return nil
+	}
+	parent := media[0]
+
+	// Cue sheets are cached, so listings don't fetch them repeatedly
+	sfs := d.acct.sfs
+	key := cueKey(d.acct, parent.ID)
+	sfs.cueLock.Lock()
+	tracks, ok := sfs.cueSheets[key]
+	sfs.cueLock.Unlock()
+
+	if !ok {
+		switch {
+		case sheet != nil:
+			var err error
+			if tracks, err = d.readCueSheet(sheet.ID); err != nil {
+				log.Printf("subfs: failed to read cue sheet for %s: %s", parent.Path, err.Error())
+				return nil
+			}
+			sfs.cueLock.Lock()
+			sfs.cueSheets[key] = tracks
+			sfs.cueLock.Unlock()
+		case strings.EqualFold(parent.Suffix, "flac"):
+			// Reading the headers of a FLAC file for an embedded sheet would hold up the listing, so it is
+			// done in the background, and its tracks listed from then on
+			go d.loadFlacCueSheet(key, parent)
+			return nil
+		}
+	}
+	if len(tracks) < 2 {
+		return nil
+	}
+
+	files := make([]SubFile, 0, len(tracks))
+	for i, t := range tracks {
+		// Each track runs until the next one starts, or until the end of the file
+		end := float64(parent.DurationRaw)
+		if i+1 < len(tracks) {
+			end = tracks[i+1].Start
+		}
+		length := end - t.Start
+		if length <= 0 {
+			continue
+		}
+
+		// Describe the track as though it were a file of its own
+		a := parent
+		a.Track = t.Number
+		a.Title = t.Title
+		if a.Title == "" {
+			a.Title = fmt.Sprintf("Track %02d", t.Number)
+		}
+		if t.Performer != "" {
+			a.Artist = t.Performer
+		}
+		a.DurationRaw = int64(length)
+		a.Suffix = "mp3"
+		a.TranscodedSuffix = ""
+
+		filename, err := d.acct.sfs.formatFilename(a, a.Suffix, false)
+		if err != nil {
+			log.Printf("subfs: failed to format filename %s: %s", a.Path, err.Error())
+			continue
+		}
+		if len(filename) == 0 {
+			continue
+		}
+
+		files = append(files, SubFile{
+			acct:        d.acct,
+			ID:          parent.ID,
+			Created:     parent.Created,
+			FileName:    filename,
+			Size:        cueBytes(length),
+			Suffix:      a.Suffix,
+			ContentType: "audio/mpeg",
+			Tags:        audioTags(a),
+			CueStart:    t.Start,
+			CueLength:   length,
+		})
+	}
+
+	return files
+}
+
+// readCueSheet downloads and parses a cue sheet listed by the server
+func (d SubDir) readCueSheet(id int64) ([]cueTrack, error) {
+	stream, _, err := d.acct.openOriginal(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	return parseCueSheet(stream)
+}
+
+// loadFlacCueSheet reads the cue sheet embedded in a FLAC file into the cache, once however many listings
+// ask for it at once
+func (d SubDir) loadFlacCueSheet(key string, parent gosubsonic.Audio) {
+	sfs := d.acct.sfs
+	sfs.cueFlight.Do(key, func() (interface{}, error) {
+		tracks, err := d.readFlacCueSheet(parent.ID)
+		if err != nil {
+			log.Printf("subfs: failed to read cue sheet for %s: %s", parent.Path, err.Error())
+			return nil, err
+		}
+
+		sfs.cueLock.Lock()
+		sfs.cueSheets[key] = tracks
+		sfs.cueLock.Unlock()
+		return nil, nil
+	})
+}
+
+// readFlacCueSheet reads the metadata blocks at the start of a FLAC file, returning the tracks of an
+// embedded cue sheet, either as a CUESHEET block or a CUESHEET Vorbis comment
+func (d SubDir) readFlacCueSheet(id int64) ([]cueTrack, error) {
+	stream, _, err := d.acct.openOriginal(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var sampleRate uint64
+	var tracks []cueTrack
+	var sheet string
+	var hasSheet bool
+	err = flacBlocks(stream, func(blockType byte, block []byte) bool {
+		switch blockType {
+		// STREAMINFO, holding the sample rate in 20 bits starting at byte 10
+		case 0:
+			if len(block) >= 13 {
+				sampleRate = uint64(block[10])<<12 | uint64(block[11])<<4 | uint64(block[12])>>4
+			}
+		// VORBIS_COMMENT, which may hold a complete text cue sheet
+		case 4:
+			if sheet, hasSheet = vorbisComment(block, "CUESHEET"); hasSheet {
+				return false
+			}
+		// CUESHEET
+		case 5:
+			tracks = parseFlacCueSheet(block)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if hasSheet {
+		return parseCueSheet(strings.NewReader(sheet))
+	}
+
+	if sampleRate == 0 {
+		return nil, errors.New("missing FLAC sample rate")
+	}
+
+	// Binary cue sheets measure offsets in samples
+	for i := range tracks {
+		tracks[i].Start /= float64(sampleRate)
+	}
+	return tracks, nil
+}
+
+// flacBlocks reads the metadata blocks at the start of a FLAC stream, passing each to fn until it returns
+// false or the last block has been read
+func flacBlocks(stream io.Reader, fn func(blockType byte, block []byte) bool) error {
+	// Metadata precedes the audio frames, so only the start of the file is needed
+	r := bufio.NewReader(io.LimitReader(stream, 16*1024*1024))
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != "fLaC" {
+		return errors.New("not a FLAC file")
+	}
+
+	for last := false; !last; {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		last = header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+
+		block := make([]byte, length)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return err
+		}
+
+		if !fn(blockType, block) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// vorbisComment finds the named comment within a FLAC VORBIS_COMMENT block
+func vorbisComment(block []byte, name string) (string, bool) {
+	// Skip the vendor string
+	if len(block) < 8 {
+		return "", false
+	}
+	vendor := int(binary.LittleEndian.Uint32(block))
+	pos := 4 + vendor
+	if pos+4 > len(block) {
+		return "", false
+	}
+
+	count := int(binary.LittleEndian.Uint32(block[pos:]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(block); i++ {
+		length := int(binary.LittleEndian.Uint32(block[pos:]))
+		pos += 4
+		if pos+length > len(block) {
+			break
+		}
+
+		comment := string(block[pos : pos+length])
+		pos += length
+		if eq := strings.Index(comment, "="); eq > 0 && strings.EqualFold(comment[:eq], name) {
+			return comment[eq+1:], true
+		}
+	}
+
+	return "", false
+}
+
+// parseFlacCueSheet parses a FLAC CUESHEET block, returning its tracks with offsets in samples
+func parseFlacCueSheet(block []byte) []cueTrack {
+	// Catalog number, lead-in, CD flag, and reserved bytes precede the track count
+	pos := 128 + 8 + 1 + 258
+	if pos >= len(block) {
+		return nil
+	}
+	count := int(block[pos])
+	pos++
+
+	var tracks []cueTrack
+	for i := 0; i < count && pos+36 <= len(block); i++ {
+		offset := binary.BigEndian.Uint64(block[pos:])
+		number := int64(block[pos+8])
+		indexes := int(block[pos+35])
+		pos += 36
+
+		// The track starts at index point 1, or at its first index point if there is none
+		start := offset
+		for j := 0; j < indexes && pos+12 <= len(block); j++ {
+			indexOffset := binary.BigEndian.Uint64(block[pos:])
+			if block[pos+8] == 1 || j == 0 {
+				start = offset + indexOffset
+			}
+			pos += 12
+		}
+
+		// Skip the lead-out track
+		if number == 170 || number == 255 {
+			continue
+		}
+
+		tracks = append(tracks, cueTrack{
+			Number: number,
+			Start:  float64(start),
+		})
+	}
+
+	return tracks
+}
+
+// parseCueSheet parses the tracks from a text cue sheet
+func parseCueSheet(r io.Reader) ([]cueTrack, error) {
+	var tracks []cueTrack
+	var performer string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value := cueValue(fields[1:])
+
+		switch strings.ToUpper(fields[0]) {
+		case "TRACK":
+			number, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid track number %q", fields[1])
+			}
+			tracks = append(tracks, cueTrack{
+				Number:    number,
+				Performer: performer,
+			})
+		case "TITLE":
+			if len(tracks) > 0 {
+				tracks[len(tracks)-1].Title = value
+			}
+		case "PERFORMER":
+			// A performer before the first track applies to the whole album
+			if len(tracks) == 0 {
+				performer = value
+			} else {
+				tracks[len(tracks)-1].Performer = value
+			}
+		case "INDEX":
+			if len(tracks) == 0 || len(fields) < 3 || fields[1] != "01" {
+				continue
+			}
+			start, err := cueTime(fields[2])
+			if err != nil {
+				return nil, err
+			}
+			tracks[len(tracks)-1].Start = start
+		}
+	}
+
+	return tracks, scanner.Err()
+}
+
+// cueValue joins the fields of a cue sheet command, removing surrounding quotes
+func cueValue(fields []string) string {
+	return strings.Trim(strings.Join(fields, " "), "\"")
+}
+
+// cueTime parses a cue sheet mm:ss:ff timestamp, at 75 frames per second, into seconds
+func cueTime(s string) (float64, error) {
+	var m, sec, frames int
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &m, &sec, &frames); err != nil {
+		return 0, fmt.Errorf("invalid cue time %q", s)
+	}
+
+	return float64(m*60+sec) + float64(frames)/75, nil
+}
+
+// limitedReadCloser closes the underlying stream of a limited reader
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cueBytes returns the length in bytes of a stretch of the parent file's transcode, at its constant bit rate
+func cueBytes(seconds float64) int64 {
+	return int64(seconds * cueBitRate * 1000 / 8)
+}
+
+// openCueStream opens a cue sheet track's time range within an MP3 transcode of its parent file.  The
+// stream method's timeOffset only applies to video, so the transcode of the whole file is read from its
+// start, past any ID3 tag, and the track found at its constant bit rate.
+func (s SubFile) openCueStream() (io.ReadCloser, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(s.ID, 10))
+	params.Set("format", "mp3")
+	params.Set("maxBitRate", strconv.Itoa(cueBitRate))
+
+	log.Printf("Opening cue track stream: [%d] %s", s.ID, s.FileName)
+	stream, _, err := apiStream(s.acct, "stream", params, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	audio, err := skipID3v2(stream)
+	if err == nil {
+		_, err = io.CopyN(ioutil.Discard, audio, cueBytes(s.CueStart))
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	// Stop once the track's length has been read
+	return limitedReadCloser{
+		Reader: io.LimitReader(audio, cueBytes(s.CueLength)),
+		Closer: stream,
+	}, nil
+}
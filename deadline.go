@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// opTimeout is the longest a directory operation may wait on the server before failing
+var opTimeout = flag.Duration("op-timeout", time.Minute, "Longest a lookup, listing or generated file may wait on the server before failing with EIO, or 0 to wait indefinitely")
+
+// opResult is the outcome of an operation run by withDeadline
+type opResult struct {
+	value interface{}
+	err   fuse.Error
+}
+
+// withDeadline runs an operation, failing with EIO once -op-timeout passes or EINTR if interrupted, so
+// that a stalled server doesn't wedge whatever is listing the mount.  The operation carries on in the
+// background, so that a listing which completes late is still cached for the next attempt.
+func withDeadline(op string, intr fs.Intr, fn func() (interface{}, fuse.Error)) (interface{}, fuse.Error) {
+	if *opTimeout <= 0 {
+		return fn()
+	}
+
+	done := make(chan opResult, 1)
+	go func() {
+		value, err := fn()
+		done <- opResult{value, err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-intr:
+		return nil, fuse.EINTR
+	case <-time.After(*opTimeout):
+		log.Printf("subfs: %s timed out after %s", op, *opTimeout)
+		return nil, fuse.EIO
+	}
+}
+
+// lookupWithin looks up a name with withDeadline
+func lookupWithin(op string, intr fs.Intr, fn func() (fs.Node, fuse.Error)) (fs.Node, fuse.Error) {
+	value, err := withDeadline(op, intr, func() (interface{}, fuse.Error) {
+		return fn()
+	})
+	node, _ := value.(fs.Node)
+	return node, err
+}
+
+// readDirWithin lists a directory with withDeadline
+func readDirWithin(op string, intr fs.Intr, fn func() ([]fuse.Dirent, fuse.Error)) ([]fuse.Dirent, fuse.Error) {
+	value, err := withDeadline(op, intr, func() (interface{}, fuse.Error) {
+		return fn()
+	})
+	directories, _ := value.([]fuse.Dirent)
+	return directories, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"bazil.org/fuse/fs"
+	"github.com/mdlayher/gosubsonic"
+)
+
+// discLayout controls how multi-disc albums appear
+var discLayout = flag.String("discs", "server", "Layout of multi-disc albums: server, merge (disc-prefixed track numbers) or folders (Disc N subdirectories)")
+
+// discFolderPattern matches the names servers commonly give to per-disc folders, such as "CD1" or "Disc 2"
+var discFolderPattern = regexp.MustCompile(`(?i)^(cd|dis[ck])[ _.-]*(\d+)$`)
+
+// discFolder returns the disc number named by a per-disc folder, or 0 if it isn't one
+func discFolder(name string) int64 {
+	match := discFolderPattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	disc, _ := strconv.ParseInt(match[2], 10, 64)
+	return disc
+}
+
+// mergeDiscs returns a copy of a directory listing with the songs of any per-disc folders moved into it,
+// numbered by the disc folder if the server doesn't report disc numbers
+func (d SubDir) mergeDiscs(listing *musicDirectory) (*musicDirectory, error) {
+	merged := &musicDirectory{
+		Content: &gosubsonic.Content{
+			Audio: append([]gosubsonic.Audio{}, listing.Content.Audio...),
+			Video: listing.Content.Video,
+		},
+		Children: make(map[int64]apiChild, len(listing.Children)),
+	}
+	for id, c := range listing.Children {
+		merged.Children[id] = c
+	}
+
+	for _, dir := range listing.Content.Directories {
+		disc := discFolder(dir.Title)
+		if disc == 0 {
+			merged.Content.Directories = append(merged.Content.Directories, dir)
+			continue
+		}
+
+		discListing, err := fetchMusicDirectory(d.acct, dir.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range discListing.Content.Audio {
+			c := discListing.Children[a.ID]
+			if c.DiscNumber == 0 {
+				c.DiscNumber = disc
+			}
+			merged.Children[a.ID] = c
+			merged.Content.Audio = append(merged.Content.Audio, a)
+		}
+		merged.Content.Video = append(merged.Content.Video, discListing.Content.Video...)
+	}
+
+	return merged, nil
+}
+
+// multiDisc reports whether the songs of a directory span more than one disc
+func multiDisc(listing *musicDirectory) bool {
+	var first int64
+	for _, a := range listing.Content.Audio {
+		disc := listing.Children[a.ID].DiscNumber
+		if disc == 0 {
+			continue
+		}
+		if first == 0 {
+			first = disc
+		} else if disc != first {
+			return true
+		}
+	}
+	return false
+}
+
+// discFilename prefixes a filename with its disc number, so that merged discs sort in order
+func discFilename(disc int64, filename string) string {
+	return fmt.Sprintf("%d-%s", disc, filename)
+}
+
+// discDirName returns the name of the subdirectory holding a disc's songs
+func discDirName(disc int64) string {
+	return fmt.Sprintf("Disc %d", disc)
+}
+
+// addDiscFile places a file into the subdirectory of its disc, creating it if needed
+func addDiscFile(discs map[int64]map[string]fs.Node, disc int64, f SubFile) {
+	if discs[disc] == nil {
+		discs[disc] = map[string]fs.Node{}
+	}
+	discs[disc][f.FileName] = f
+}
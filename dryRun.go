@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// lookupPath walks a slash-separated path from the given node, returning the node it names
+func lookupPath(node fs.Node, p string) (fs.Node, error) {
+	for _, name := range strings.Split(p, "/") {
+		// Skip empty components from leading, trailing, or doubled slashes
+		if name == "" {
+			continue
+		}
+
+		dir, ok := node.(fs.NodeStringLookuper)
+		if !ok {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+
+		next, err := dir.Lookup(name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no such file or directory", name)
+		}
+		node = next
+	}
+
+	return node, nil
+}
+
+// printTree writes the virtual tree below node to w, descending at most depth levels
+func printTree(w io.Writer, node fs.Node, depth int, indent string) error {
+	if depth <= 0 {
+		return nil
+	}
+
+	dir, ok := node.(fs.HandleReadDirer)
+	if !ok {
+		return nil
+	}
+
+	entries, err := dir.ReadDir(nil)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %v", err)
+	}
+
+	// Sort entries so output is stable between runs
+	names := make([]string, 0, len(entries))
+	types := make(map[string]fuse.DirentType, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+		types[e.Name] = e.Type
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if types[name] != fuse.DT_Dir {
+			fmt.Fprintf(w, "%s%s\n", indent, name)
+			continue
+		}
+
+		fmt.Fprintf(w, "%s%s/\n", indent, name)
+
+		child, err := dir.(fs.NodeStringLookuper).Lookup(name, nil)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s: %v", name, err)
+		}
+
+		if err := printTree(w, child, depth-1, indent+"    "); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables which may set any flag, such as SUBFS_CACHE_DIR for -cache-dir
+const envPrefix = "SUBFS_"
+
+// envName returns the environment variable which sets a flag
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnv sets every flag not given on the command line from its environment variable, if present
+func applyEnv() {
+	// Flags given on the command line take precedence
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(value); err != nil {
+			log.Fatalf("Invalid value for %s: %s", envName(f.Name), err.Error())
+		}
+	})
+}
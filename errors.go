@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Subsonic API error codes which map onto something other than EIO
+const (
+	apiErrorWrongCredentials = 40
+	apiErrorTokenAuth        = 41
+	apiErrorNotAuthorized    = 50
+	apiErrorTrialExpired     = 60
+	apiErrorNotFound         = 70
+)
+
+// isAuthError reports whether an error is the server rejecting the account's credentials
+func isAuthError(err error) bool {
+	if e, ok := err.(apiError); ok {
+		return e.Code == apiErrorWrongCredentials || e.Code == apiErrorTokenAuth
+	}
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "wrong username or password")
+}
+
+// fuseError maps an error from the Subsonic server or the network onto a FUSE errno, so that callers can
+// tell a genuinely missing file (ENOENT) apart from an authentication problem (EACCES), a timeout
+// (ETIMEDOUT), or any other server or network failure (EIO)
+func fuseError(err error) fuse.Error {
+	if err == nil {
+		return nil
+	}
+
+	// Requests are refused while the server is known to be unreachable
+	if err == errOffline {
+		return fuse.Errno(syscall.EHOSTDOWN)
+	}
+
+	// Methods newer than the targeted API version are never sent
+	if err == errUnsupportedMethod {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+
+	// Errors reported by the server carry a well-defined code
+	if e, ok := err.(apiError); ok {
+		switch e.Code {
+		case apiErrorWrongCredentials, apiErrorTokenAuth, apiErrorNotAuthorized, apiErrorTrialExpired:
+			return fuse.Errno(syscall.EACCES)
+		case apiErrorNotFound:
+			return fuse.ENOENT
+		}
+		return fuse.EIO
+	}
+
+	// Network timeouts, including those wrapped by net/http
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+
+	// gosubsonic only exposes the server's error message, so fall back to matching on it
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "wrong username or password"), strings.Contains(msg, "not authorized"):
+		return fuse.Errno(syscall.EACCES)
+	case strings.Contains(msg, "not found"):
+		return fuse.ENOENT
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+
+	return fuse.EIO
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// TestMain keeps subfs' logging out of test and benchmark output, unless run with -v
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	// Sizes found while reading are never saved over the user's own
+	*sizesPath = ""
+	os.Exit(m.Run())
+}
+
+// Fixed IDs of the fake server's library: one folder holding one artist with one album
+const (
+	fakeFolderID = 1
+	fakeArtistID = 10
+	fakeAlbumID  = 100
+	fakeSongID   = 1000
+)
+
+// fakeServer is a Subsonic server answering the API methods subfs calls, from a library of one album
+// whose names and song content are set apart by the server's name
+type fakeServer struct {
+	*httptest.Server
+
+	name  string
+	songs map[int64][]byte
+
+	// dirs lists the entries of each directory by ID, as returned by getMusicDirectory
+	dirs map[int64][]map[string]interface{}
+}
+
+// newFakeServer starts a fake server holding an album of tracks songs, each size bytes long, which is shut
+// down at the end of the test
+func newFakeServer(tb testing.TB, name string, tracks int, size int) *fakeServer {
+	srv := &fakeServer{
+		name:  name,
+		songs: map[int64][]byte{},
+		dirs:  map[int64][]map[string]interface{}{},
+	}
+
+	artist, album := name+" Artist", name+" Album"
+	srv.dirs[fakeArtistID] = []map[string]interface{}{{
+		"id":       fakeAlbumID,
+		"parent":   fakeArtistID,
+		"isDir":    true,
+		"title":    album,
+		"artist":   artist,
+		"year":     2001,
+		"coverArt": fakeAlbumID,
+		"created":  "2020-01-02T03:04:05",
+	}}
+	for i := 0; i < tracks; i++ {
+		id := int64(fakeSongID + i)
+		title := fmt.Sprintf("%s Song %d", name, i+1)
+		srv.songs[id] = fakeSong(name, id, size)
+		srv.dirs[fakeAlbumID] = append(srv.dirs[fakeAlbumID], map[string]interface{}{
+			"id":          id,
+			"parent":      fakeAlbumID,
+			"title":       title,
+			"album":       album,
+			"artist":      artist,
+			"track":       i + 1,
+			"year":        2001,
+			"coverArt":    fakeAlbumID,
+			"size":        size,
+			"contentType": "audio/flac",
+			"suffix":      "flac",
+			"duration":    180,
+			"bitRate":     900,
+			"path":        fmt.Sprintf("%s/%s/%02d - %s.flac", artist, album, i+1, title),
+			"created":     "2020-01-02T03:04:05",
+		})
+	}
+
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serve))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// fakeSong returns the content of a song, which differs by server and ID
+func fakeSong(name string, id int64, size int) []byte {
+	pattern := []byte(fmt.Sprintf("%s:%d;", name, id))
+	return bytes.Repeat(pattern, size/len(pattern)+1)[:size]
+}
+
+// serve answers a request for an API method
+func (srv *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/rest/"), ".view")
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+
+	switch method {
+	case "ping":
+		srv.respond(w, nil)
+	case "getMusicFolders":
+		srv.respond(w, map[string]interface{}{
+			"musicFolders": map[string]interface{}{
+				"musicFolder": []map[string]interface{}{{"id": fakeFolderID, "name": "Music"}},
+			},
+		})
+	case "getIndexes":
+		srv.respond(w, map[string]interface{}{
+			"indexes": map[string]interface{}{
+				"lastModified": time.Now().UnixNano() / int64(time.Millisecond),
+				"index": []map[string]interface{}{{
+					"name":   srv.name[:1],
+					"artist": []map[string]interface{}{{"id": fakeArtistID, "name": srv.name + " Artist"}},
+				}},
+			},
+		})
+	case "getMusicDirectory":
+		children, ok := srv.dirs[id]
+		if !ok {
+			srv.fail(w, apiErrorNotFound, "directory not found")
+			return
+		}
+		srv.respond(w, map[string]interface{}{
+			"directory": map[string]interface{}{"id": id, "child": children},
+		})
+	case "download", "stream":
+		song, ok := srv.songs[id]
+		if !ok {
+			srv.fail(w, apiErrorNotFound, "song not found")
+			return
+		}
+		w.Header().Set("Content-Type", "audio/flac")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(song))
+	default:
+		srv.fail(w, apiErrorNotFound, "unknown method "+method)
+	}
+}
+
+// respond writes a successful response envelope holding fields
+func (srv *fakeServer) respond(w http.ResponseWriter, fields map[string]interface{}) {
+	response := map[string]interface{}{
+		"status":        "ok",
+		"version":       "1.16.1",
+		"type":          "fake",
+		"serverVersion": "1.0",
+	}
+	for k, v := range fields {
+		response[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"subsonic-response": response})
+}
+
+// fail writes a response envelope holding an API error
+func (srv *fakeServer) fail(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subsonic-response": map[string]interface{}{
+			"status": "failed",
+			"error":  map[string]interface{}{"code": code, "message": message},
+		},
+	})
+}
+
+// testFilenames is the default filename template
+const testFilenames = `{{printf "%02d - %s - %s.%s" .A.Track .A.Artist .A.Title .A.Suffix}}`
+
+// newTestFilesystem returns an instance serving the fake server's library from a memory cache, through
+// an account made without gosubsonic, so that only subfs' own requests reach the server
+func newTestFilesystem(tb testing.TB, srv *fakeServer) *Filesystem {
+	a := accountFor(UserConfig{Name: srv.name, Host: srv.URL, User: "test", Password: "test"}, "test")
+	a.version = negotiateAPIVersion(a)
+	a.quirks = detectQuirks(a)
+
+	sfs := newFilesystem([]*account{a}, template.Must(template.New("filenameTemplate").Parse(testFilenames)), newMemoryCache())
+	sfs.dirnameTemplate = template.Must(template.New("dirnameTemplate").Parse("{{.Name}}"))
+	return sfs
+}
+
+// albumDir returns the fake server's album as listed by an instance
+func albumDir(sfs *Filesystem) SubDir {
+	d := NewSubDir(sfs.accounts[0], fakeAlbumID, false, false)
+	d.Path = "Album"
+	return d
+}
+
+// readFile opens the file called name in d and reads it to w in chunks of chunk bytes, as the kernel does,
+// returning the number of bytes read
+func readFile(d SubDir, name string, chunk int, w io.Writer) (int64, error) {
+	node, err := d.Lookup(name, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not find %s: %v", name, err)
+	}
+	f, ok := node.(SubFile)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a song", name)
+	}
+
+	handle, err := f.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not open %s: %v", name, err)
+	}
+	defer handle.(fs.HandleReleaser).Release(&fuse.ReleaseRequest{}, nil)
+
+	var offset int64
+	for {
+		resp := &fuse.ReadResponse{}
+		req := &fuse.ReadRequest{Offset: offset, Size: chunk}
+		if err := handle.(fs.HandleReader).Read(req, resp, nil); err != nil {
+			return offset, fmt.Errorf("could not read %s at %d: %v", name, req.Offset, err)
+		}
+		if len(resp.Data) == 0 {
+			return offset, nil
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return offset, err
+		}
+		offset += int64(len(resp.Data))
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mdlayher/gosubsonic"
+)
+
+// badChars lists characters which should be replaced in filenames
+var badChars = []string{"/", "\\"}
+
+// asciiNames transliterates generated names to ASCII, for devices which can't handle UTF-8
+var asciiNames = flag.Bool("ascii-names", false, "Transliterate non-ASCII characters in generated names, such as \"Sigur Rós\" to \"Sigur Ros\"")
+
+// albumYearPrefix prefixes the albums of an artist with their year, so that they sort chronologically by name
+var albumYearPrefix = flag.Bool("album-year-prefix", false, "Prefix album directory names within an artist with their year, as \"1969 - Abbey Road\"")
+
+// nameMax is the longest name in bytes which subfs generates, as kernels refuse longer names from readdir
+var nameMax = flag.Int("name-max", 255, "Maximum length in bytes of generated names, longer ones are truncated")
+
+// limitName truncates a name longer than -name-max, keeping its extension and appending the ID of the
+// entry, so that names truncated to the same prefix stay distinct
+func limitName(name string, id int64) string {
+	if len(name) <= *nameMax {
+		return name
+	}
+
+	ext := path.Ext(name)
+	if len(ext) > 16 || strings.ContainsAny(ext, " ") {
+		ext = ""
+	}
+	suffix := fmt.Sprintf("~%d%s", id, ext)
+
+	// Cut on a character boundary, so that no partial UTF-8 sequence remains
+	keep := *nameMax - len(suffix)
+	if keep < 0 {
+		keep = 0
+	}
+	base := name[:len(name)-len(ext)]
+	if keep >= len(base) {
+		return name
+	}
+	for keep > 0 && !utf8.RuneStart(base[keep]) {
+		keep--
+	}
+
+	return base[:keep] + suffix
+}
+
+// nameCounter counts the entries of a directory which share each name, so that duplicates can be qualified
+type nameCounter map[string]int
+
+// qualify returns name unchanged if no other entry shares it, and otherwise appends the year, or the ID
+// when the year is unknown or also shared, so that same-named albums don't shadow each other
+func (c nameCounter) qualify(name string, year int64, id int64, years map[string]int) string {
+	if c[name] < 2 {
+		return name
+	}
+	if year != 0 && years[fmt.Sprintf("%s (%d)", name, year)] < 2 {
+		return fmt.Sprintf("%s (%d)", name, year)
+	}
+	return fmt.Sprintf("%s [%d]", name, id)
+}
+
+// yearPrefix prefixes an album name with its year under -album-year-prefix, leaving albums of unknown
+// year as they are
+func yearPrefix(name string, year int64) string {
+	if !*albumYearPrefix || year == 0 {
+		return name
+	}
+	return fmt.Sprintf("%d - %s", year, name)
+}
+
+// sanitizeName replaces any characters which may cause trouble with filesystem display
+func sanitizeName(name string) string {
+	for _, b := range badChars {
+		name = strings.Replace(name, b, "_", -1)
+	}
+	if *asciiNames {
+		name = transliterate(name)
+	}
+	return name
+}
+
+// formatFilename renders the filename template for an audio file served with the given suffix, and
+// whether the user starred it.  An empty result means the template chose to hide this file.
+func (sfs *Filesystem) formatFilename(a gosubsonic.Audio, suffix string, starred bool) (string, error) {
+	// Apply rewrite rules before templating
+	a.Artist = rewrite("artist", a.Artist)
+	a.Album = rewrite("album", a.Album)
+	a.Title = rewrite("title", a.Title)
+
+	// Predefined audio filename format
+	var filenameCtx = struct {
+		A        gosubsonic.Audio
+		Artist   string
+		Album    string
+		Track    int64
+		Title    string
+		Suffix   string
+		Path     string
+		Filename string
+		Basename string
+		Created  time.Time
+		Starred  bool
+	}{
+		A:        a,
+		Artist:   a.Artist,
+		Album:    a.Album,
+		Track:    a.Track,
+		Title:    a.Title,
+		Suffix:   suffix,
+		Path:     a.Path,
+		Filename: path.Base(a.Path),
+		Basename: strings.TrimSuffix(path.Base(a.Path), "."+a.Suffix),
+		Created:  a.Created,
+		Starred:  starred,
+	}
+
+	var filenameBuffer bytes.Buffer
+	if err := sfs.filenameTemplate.Execute(&filenameBuffer, filenameCtx); err != nil {
+		return "", err
+	}
+
+	return limitName(sanitizeName(filenameBuffer.String()), a.ID), nil
+}
+
+// formatDirname renders the directory name template for an album, given the name subfs would otherwise
+// use, falling back to that name if the template fails or renders nothing
+func (sfs *Filesystem) formatDirname(c apiChild, name string) string {
+	rating := c.UserRating
+	if rating < 0 {
+		rating = 0
+	} else if rating > 5 {
+		rating = 5
+	}
+
+	var dirnameCtx = struct {
+		Name    string
+		Artist  string
+		Album   string
+		Year    int64
+		Genre   string
+		Rating  int64
+		Stars   string
+		Starred bool
+	}{
+		Name:    name,
+		Artist:  rewrite("artist", c.Artist),
+		Album:   rewrite("album", c.Title),
+		Year:    c.Year,
+		Genre:   c.Genre,
+		Rating:  c.UserRating,
+		Stars:   strings.Repeat("★", int(rating)) + strings.Repeat("☆", int(5-rating)),
+		Starred: c.starred(),
+	}
+
+	var dirnameBuffer bytes.Buffer
+	if err := sfs.dirnameTemplate.Execute(&dirnameBuffer, dirnameCtx); err != nil {
+		log.Printf("subfs: failed to format directory name %s: %s", name, err.Error())
+		return limitName(sanitizeName(name), int64(c.ID))
+	}
+	if dirnameBuffer.Len() == 0 {
+		return limitName(sanitizeName(name), int64(c.ID))
+	}
+
+	return limitName(sanitizeName(dirnameBuffer.String()), int64(c.ID))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"text/template"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Filesystem holds the state of one subfs instance, shared by all of its nodes through their account.
+// Several instances may run in one process.
+type Filesystem struct {
+	// accounts stores every Subsonic account mounted by this instance
+	accounts []*account
+
+	// mountPoint is the absolute path where this instance is mounted, used to build paths in playlists,
+	// and views are the further mount points showing parts of its tree
+	mountPoint string
+	views      []mountedView
+
+	// filenameTemplate describes how to format a filename
+	filenameTemplate *template.Template
+
+	// dirnameTemplate describes how to format an album's directory name
+	dirnameTemplate *template.Template
+
+	// cache stores the content of files which have been read
+	cache Cache
+
+	// sizes stores any corrected transcoded filesizes.  We find out the corrected size during a Fuse
+	// callback, and we don't have a shared reference to a SubFile then.
+	sizes *sizeStore
+
+	// downloads holds the downloads currently in progress, guarded by downloadsLock
+	downloadsLock sync.Mutex
+	downloads     map[*download]bool
+
+	// cueSheets caches the parsed cue sheet for each parent file, by account and ID, guarded by cueLock
+	cueLock   sync.Mutex
+	cueSheets map[string][]cueTrack
+
+	// bursts holds the recent times files were opened in each directory, for -thumbnail-burst, guarded
+	// by burstLock
+	burstLock sync.Mutex
+	bursts    map[string][]time.Time
+
+	// locals finds local copies of files under -local-music, if set
+	locals *localIndex
+
+	// bookmarks remembers the position reached within audiobook files
+	bookmarks *bookmarkStore
+
+	// openHandles is the number of files currently open, and alive is 1 while mounted and served
+	openHandles int64
+	alive       int32
+
+	// directoryFlight, artFlight, streamFlight, cueFlight and tailFlight deduplicate concurrent fetches of
+	// the same directory, art, file, embedded cue sheet or end of a file
+	directoryFlight flightGroup
+	artFlight       flightGroup
+	streamFlight    flightGroup
+	cueFlight       flightGroup
+	tailFlight      flightGroup
+}
+
+// newFilesystem returns an instance serving the given accounts, with filenames formatted by tmpl and
+// files cached in cache
+func newFilesystem(accounts []*account, tmpl *template.Template, cache Cache) *Filesystem {
+	sfs := &Filesystem{
+		accounts:         accounts,
+		filenameTemplate: tmpl,
+		cache:            cache,
+		sizes:            loadSizes(*sizesPath),
+		downloads:        map[*download]bool{},
+		cueSheets:        map[string][]cueTrack{},
+		bursts:           map[string][]time.Time{},
+		bookmarks:        loadBookmarks(*bookmarksPath),
+		locals:           indexLocalMusic(*localMusic),
+	}
+
+	for _, a := range accounts {
+		a.sfs = sfs
+	}
+	return sfs
+}
+
+// Root is called to get the root directory node of this filesystem
+func (sfs *Filesystem) Root() (fs.Node, fuse.Error) {
+	// With several accounts, each gets its own top-level directory
+	if len(sfs.accounts) > 1 {
+		return AccountsDir{sfs: sfs}, nil
+	}
+
+	return NewSubDir(sfs.accounts[0], -1, true, false), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestFilesystemsIndependent runs two instances in one process, against servers whose libraries share IDs
+// but not names or content, listing and reading both at once.  Each must only ever see its own server, and
+// under go test -race, the two must share no unguarded state.
+func TestFilesystemsIndependent(t *testing.T) {
+	servers := []*fakeServer{
+		newFakeServer(t, "First", 4, 200*1024),
+		newFakeServer(t, "Second", 4, 300*1024),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for _, srv := range servers {
+		sfs := newTestFilesystem(t, srv)
+
+		// Several readers of each instance share its listings, fetches and cache
+		for reader := 0; reader < 4; reader++ {
+			wg.Add(1)
+			go func(srv *fakeServer, sfs *Filesystem) {
+				defer wg.Done()
+				errs <- readAlbum(srv, sfs)
+			}(srv, sfs)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// readAlbum lists the album of an instance and reads each of its songs, checking them against the server's
+func readAlbum(srv *fakeServer, sfs *Filesystem) error {
+	d := albumDir(sfs)
+	entries, err := d.ReadDir(nil)
+	if err != nil {
+		return fmt.Errorf("%s: could not list album: %v", srv.name, err)
+	}
+	listed := map[string]bool{}
+	for _, e := range entries {
+		listed[e.Name] = true
+	}
+
+	for i := 0; i < len(srv.songs); i++ {
+		name := fmt.Sprintf("%02d - %s Artist - %s Song %d.flac", i+1, srv.name, srv.name, i+1)
+		if !listed[name] {
+			return fmt.Errorf("%s: album doesn't list %s", srv.name, name)
+		}
+
+		var data bytes.Buffer
+		if _, err := readFile(d, name, readChunk, &data); err != nil {
+			return fmt.Errorf("%s: %v", srv.name, err)
+		}
+		if song := srv.songs[int64(fakeSongID+i)]; !bytes.Equal(data.Bytes(), song) {
+			return fmt.Errorf("%s: %s read back %d bytes, differing from the %d served", srv.name, name, data.Len(), len(song))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// fileHandle is an open SubFile.  Each handle holds a reference on the file's cache key, so that the
+// cache never removes a file another process still has open.
+//
+// Reads are served straight from the cached file at the requested offset where possible, and otherwise
+// from the file's content held by the handle.  Players read the header, the end and then the middle of a
+// file at once, so reads at any offset run concurrently once the content is available.
+type fileHandle struct {
+	readOnlyFile
+
+	file SubFile
+	key  string
+
+	// cached is the open cache file read from, or data the content if it isn't cached as is
+	lock   sync.RWMutex
+	cached *os.File
+	data   []byte
+
+	// tail is the end of the file starting at tailStart, fetched alone for reads near the end, or noTail
+	// set if the server can't serve it
+	tail      []byte
+	tailStart int64
+	noTail    bool
+
+	// proxy is the stream reads are served from when caching is off, positioned at proxyOffset
+	proxy       io.ReadCloser
+	proxyOffset int64
+
+	// thumbnail is set when the file was opened by a thumbnailer, for -thumbnail-burst
+	thumbnail bool
+}
+
+// tailFetchSize is the length of the end of a file fetched on its own, enough for ID3v1 and APE tags,
+// seek tables and most MP4 moov atoms
+const tailFetchSize = 4 * 1024 * 1024
+
+// Open returns a handle on this file, holding a reference on its cached content until released
+func (s SubFile) Open(req *fuse.OpenRequest, resp *fuse.OpenResponse, intr fs.Intr) (fs.Handle, fuse.Error) {
+	sfs := s.acct.sfs
+	key := s.accountKey()
+
+	sfs.cache.Open(key)
+	atomic.AddInt64(&sfs.openHandles, 1)
+
+	h := &fileHandle{
+		file:      s,
+		key:       key,
+		thumbnail: sfs.noteOpen(s),
+	}
+
+	// A thumbnailer is answered from metadata, which mustn't linger in the page cache for real readers
+	if h.thumbnail {
+		resp.Flags |= fuse.OpenDirectIO
+	}
+
+	// Audiobooks are read piece by piece, remembering how far they were read
+	if s.Audiobook {
+		return &bookHandle{handle: h}, nil
+	}
+	return h, nil
+}
+
+// openCached opens the cached file for direct reads, if it is cached as is.  The caller must hold the lock.
+func (h *fileHandle) openCached() bool {
+	if h.cached != nil {
+		return true
+	}
+
+	name, ok := h.file.acct.sfs.cache.File(h.file)
+	if !ok {
+		return false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	h.cached = f
+	return true
+}
+
+// load makes the file's content available to this handle, from the cached file if possible, or else
+// fetching the whole file.  Concurrent reads waiting on the fetch share a single stream.
+func (h *fileHandle) load(intr fs.Intr) fuse.Error {
+	h.lock.RLock()
+	loaded := h.cached != nil || h.data != nil
+	h.lock.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	h.lock.Lock()
+	loaded = h.data != nil || h.openCached()
+	h.lock.Unlock()
+	if loaded {
+		return nil
+	}
+
+	data, err := h.file.ReadAll(intr)
+	if err != nil {
+		return err
+	}
+
+	// Fetching the file usually caches it as well, so that its content needn't be held here
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.data == nil && !h.openCached() {
+		h.data = data
+	}
+	return nil
+}
+
+// readTail serves a read near the end of a file which hasn't been fetched yet, such as a player looking
+// for tags or an MP4 moov atom, by fetching just the end of the file with a Range request.  Only originals
+// are fetched this way, as only their size is known exactly.
+func (h *fileHandle) readTail(req *fuse.ReadRequest) ([]byte, bool) {
+	s := h.file
+	size := s.GetSize()
+	if !s.Lossless || s.IsVideo || s.IsArt || s.CueLength > 0 || s.acct.isOffline() {
+		return nil, false
+	}
+	if size <= 2*tailFetchSize || req.Offset < size-tailFetchSize {
+		return nil, false
+	}
+
+	h.lock.RLock()
+	loaded := h.cached != nil || h.data != nil
+	h.lock.RUnlock()
+	if loaded {
+		return nil, false
+	}
+
+	h.lock.Lock()
+	if h.noTail || h.data != nil || h.openCached() {
+		h.lock.Unlock()
+		return nil, false
+	}
+	tail, tailStart := h.tail, h.tailStart
+	h.lock.Unlock()
+
+	// The tail is fetched without holding the lock, so that reads elsewhere in the file carry on meanwhile,
+	// and shared with other handles reading the same end
+	if tail == nil {
+		start := size - tailFetchSize
+		value, err := s.acct.sfs.tailFlight.Do(h.key, func() (interface{}, error) {
+			return s.fetchTail(start)
+		})
+
+		h.lock.Lock()
+		if err != nil {
+			h.noTail = true
+			h.lock.Unlock()
+			return nil, false
+		}
+		h.tail, h.tailStart = value.([]byte), start
+		tail, tailStart = h.tail, h.tailStart
+		h.lock.Unlock()
+	}
+
+	// Reads at or past the end of the file find nothing
+	offset := req.Offset - tailStart
+	if offset >= int64(len(tail)) {
+		return []byte{}, true
+	}
+	end := offset + int64(req.Size)
+	if end > int64(len(tail)) {
+		end = int64(len(tail))
+	}
+	return tail[offset:end], true
+}
+
+// errNoTail is returned when the server can't serve the end of a file on its own
+var errNoTail = errors.New("subfs: server can't serve the end of the file alone")
+
+// fetchTail fetches the end of the file from start with a Range request
+func (s SubFile) fetchTail(start int64) ([]byte, error) {
+	log.Printf("Opening tail stream: [%d] %s from %d", s.ID, s.FileName, start)
+	stream, partial, err := s.openStreamAt(start)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer stream.Close()
+	if !partial {
+		return nil, errNoTail
+	}
+
+	// Reading one byte past the expected end confirms the size, without which the tail would be misplaced
+	tail, err := readStream(io.LimitReader(stream, tailFetchSize+1), tailFetchSize+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(tail) != tailFetchSize {
+		return nil, errNoTail
+	}
+	return tail, nil
+}
+
+// readProxied serves a read straight from a stream of the file when caching is off, keeping the stream
+// open while reads move forward, skipping ahead on it to the offset of each, and opening another only
+// for a read behind it
+func (h *fileHandle) readProxied(req *fuse.ReadRequest) ([]byte, fuse.Error) {
+	if h.file.acct.isOffline() {
+		return nil, fuseError(errOffline)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.proxy != nil && req.Offset < h.proxyOffset {
+		h.proxy.Close()
+		h.proxy = nil
+	}
+
+	// Reads ahead of the stream, such as after the kernel's readahead, discard what lies in between
+	if h.proxy != nil && req.Offset > h.proxyOffset {
+		n, err := io.CopyN(ioutil.Discard, h.proxy, req.Offset-h.proxyOffset)
+		h.proxyOffset += n
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			log.Println(err)
+			h.proxy.Close()
+			h.proxy = nil
+			return nil, fuse.EIO
+		}
+	}
+	if h.proxy == nil {
+		log.Printf("Opening proxied stream: [%d] %s at %d", h.file.ID, h.file.FileName, req.Offset)
+		stream, start, err := h.file.openProxy(req.Offset)
+		if err != nil {
+			log.Println(err)
+			return nil, fuseError(err)
+		}
+		h.proxy = stream
+
+		// Streams which can't begin at the offset are read up to it
+		if _, err := io.CopyN(ioutil.Discard, stream, req.Offset-start); err != nil {
+			h.proxy.Close()
+			h.proxy = nil
+			if err == io.EOF {
+				return nil, nil
+			}
+			log.Println(err)
+			return nil, fuse.EIO
+		}
+		h.proxyOffset = req.Offset
+	}
+
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.proxy, buf)
+	h.proxyOffset += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Println(err)
+		h.proxy.Close()
+		h.proxy = nil
+		return nil, fuse.EIO
+	}
+	return buf[:n], nil
+}
+
+// Read returns part of the file at any offset, from the cached file if possible, or else fetching the
+// whole file first.  Reads near the end of a file not yet fetched only fetch its end.  With caching off,
+// reads are passed on to the server instead, and thumbnailers are answered from metadata alone.
+func (h *fileHandle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.Intr) fuse.Error {
+	if data, ok, err := h.readThumbnail(req); ok {
+		resp.Data = data
+		return err
+	}
+
+	if proxyReads() && !h.file.IsArt {
+		data, err := h.readProxied(req)
+		resp.Data = data
+		return err
+	}
+
+	if data, ok := h.readTail(req); ok {
+		resp.Data = data
+		return nil
+	}
+
+	if err := h.load(intr); err != nil {
+		return err
+	}
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if h.cached != nil {
+		buf := make([]byte, req.Size)
+		n, err := h.cached.ReadAt(buf, req.Offset)
+		if err != nil && err != io.EOF {
+			log.Println(err)
+			return fuse.EIO
+		}
+		resp.Data = buf[:n]
+		return nil
+	}
+
+	if req.Offset >= int64(len(h.data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	resp.Data = h.data[req.Offset:end]
+	return nil
+}
+
+// Release drops this handle's reference, removing the cached file if it was evicted while open
+func (h *fileHandle) Release(req *fuse.ReleaseRequest, intr fs.Intr) fuse.Error {
+	h.lock.Lock()
+	if h.cached != nil {
+		h.cached.Close()
+		h.cached = nil
+	}
+	if h.proxy != nil {
+		h.proxy.Close()
+		h.proxy = nil
+	}
+	h.data = nil
+	h.tail = nil
+	h.lock.Unlock()
+
+	sfs := h.file.acct.sfs
+	atomic.AddInt64(&sfs.openHandles, -1)
+	sfs.cache.Release(h.key)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// readChunk is the size of the reads made by the kernel
+const readChunk = 128 * 1024
+
+// benchmarkRead reads the first song of the fake server's album, purging the cache before each read if
+// cached is unset, so that every read fetches it from the server
+func benchmarkRead(b *testing.B, cached bool) {
+	srv := newFakeServer(b, "Bench", 1, benchmarkFileSize)
+	sfs := newTestFilesystem(b, srv)
+	d := albumDir(sfs)
+	if _, err := d.ReadDir(nil); err != nil {
+		b.Fatal(err)
+	}
+	name := "01 - Bench Artist - Bench Song 1.flac"
+
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			sfs.cache.Purge()
+		}
+		if _, err := readFile(d, name, readChunk, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadUncached reads a song fetched from the server on every read
+func BenchmarkReadUncached(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+// BenchmarkReadCached reads a song held in the cache
+func BenchmarkReadCached(b *testing.B) {
+	benchmarkRead(b, true)
+}
+
+// TestRead checks that a song reads back exactly as served, both when fetched and once cached
+func TestRead(t *testing.T) {
+	srv := newFakeServer(t, "Test", 1, 300*1024)
+	sfs := newTestFilesystem(t, srv)
+	d := albumDir(sfs)
+	if _, err := d.ReadDir(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pass := range []string{"fetched", "cached"} {
+		var data bytes.Buffer
+		if _, err := readFile(d, "01 - Test Artist - Test Song 1.flac", readChunk, &data); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data.Bytes(), srv.songs[fakeSongID]) {
+			t.Fatalf("%s song read back %d bytes, differing from the %d served", pass, data.Len(), len(srv.songs[fakeSongID]))
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+// healthAddr is the address of the optional HTTP healthcheck, metrics and status endpoints
+var healthAddr = flag.String("health-addr", "", "Address to serve an HTTP healthcheck at /health, metrics at /metrics and status at /status, such as :8080")
+
+// serveHealth serves the healthcheck endpoint, which reports 200 while the mount is alive and 503 otherwise,
+// along with metrics and status
+func (sfs *Filesystem) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&sfs.alive) == 0 {
+			http.Error(w, "not mounted", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", sfs.serveMetrics)
+	mux.HandleFunc("/status", sfs.serveStatus)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Could not serve healthcheck at %s: %s", addr, err.Error())
+		}
+	}()
+}
+
+// checkFuseDevice exits with a clear error when the FUSE device is missing, as is common in containers
+func checkFuseDevice() {
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	if _, err := os.Stat("/dev/fuse"); os.IsNotExist(err) {
+		log.Fatalf("Could not find /dev/fuse: in a container, add --device /dev/fuse --cap-add SYS_ADMIN")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// layout chooses how artists and albums are arranged below each music folder
+var layout = flag.String("layout", "server", "Arrangement of artists and albums: server (the server's file layout), album-artist (albums grouped by ID3 album artist) or normalized (always Artist/Album/Track)")
+
+// layoutTTL is how long the contents of rearranged directories are kept before asking the server again
+const layoutTTL = 10 * time.Minute
+
+// id3Artist is an artist from the server's ID3 tag index
+type id3Artist struct {
+	ID   apiInt `json:"id"`
+	Name string `json:"name"`
+}
+
+// id3Album is an album from the server's ID3 tag index.  Cover art is taken from its songs instead, as
+// album cover art IDs are often not numeric.
+type id3Album struct {
+	ID      apiInt  `json:"id"`
+	Name    string  `json:"name"`
+	Artist  string  `json:"artist"`
+	Year    int64   `json:"year"`
+	Genre   string  `json:"genre"`
+	Created apiTime `json:"created"`
+
+	// Whether the album is a compilation, as reported by OpenSubsonic servers
+	IsCompilation bool     `json:"isCompilation"`
+	ReleaseTypes  []string `json:"releaseTypes"`
+}
+
+// albumArtistEntries returns a directory for each album artist in a music folder, or all folders if id is -1
+func albumArtistEntries(a *account, id int64) (map[string]fs.Node, error) {
+	params := url.Values{}
+	if id != -1 {
+		params.Set("musicFolderId", strconv.FormatInt(id, 10))
+	}
+
+	var res struct {
+		Artists struct {
+			Index []struct {
+				Artist []id3Artist `json:"artist"`
+			} `json:"index"`
+		} `json:"artists"`
+	}
+	if err := apiGet(a, "getArtists", params, &res); err != nil {
+		log.Printf("subfs: failed to retrieve album artists: %s", err.Error())
+		return nil, err
+	}
+
+	entries := map[string]fs.Node{}
+	for _, index := range res.Artists.Index {
+		for _, artist := range index.Artist {
+			artistID := int64(artist.ID)
+			artistName := artist.Name
+			entries[limitName(sanitizeName(artistDisplayName(rewrite("artist", artist.Name))), artistID)] = newCachedDir(layoutTTL, func() (map[string]fs.Node, error) {
+				return albumEntries(a, artistID, artistName)
+			})
+		}
+	}
+	return entries, nil
+}
+
+// albumEntries returns a directory for each album of an album artist, along with their collaborations
+func albumEntries(a *account, artistID int64, artist string) (map[string]fs.Node, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(artistID, 10))
+
+	var res struct {
+		Artist struct {
+			Album []id3Album `json:"album"`
+		} `json:"artist"`
+	}
+	if err := apiGet(a, "getArtist", params, &res); err != nil {
+		log.Printf("subfs: failed to retrieve albums of artist %d: %s", artistID, err.Error())
+		return nil, err
+	}
+
+	// Qualify albums sharing a title with their year or ID
+	names, years := nameCounter{}, nameCounter{}
+	for _, album := range res.Artist.Album {
+		name := limitName(sanitizeName(yearPrefix(rewrite("album", album.Name), album.Year)), int64(album.ID))
+		names[name]++
+		years[fmt.Sprintf("%s (%d)", name, album.Year)]++
+	}
+
+	entries := map[string]fs.Node{}
+	for _, album := range res.Artist.Album {
+		albumID := int64(album.ID)
+		name := names.qualify(limitName(sanitizeName(yearPrefix(rewrite("album", album.Name), album.Year)), albumID), album.Year, albumID, years)
+		entries[name] = albumSongsDir(a, albumID)
+	}
+	if dir := collaborationsDir(a, artist); dir != nil {
+		entries[collaborationsName] = dir
+	}
+	return entries, nil
+}
+
+// albumSongsDir returns a directory holding the songs of an album, which warns once of songs the server
+// counted but which have no file, and reports them as user.subfs.incomplete
+func albumSongsDir(a *account, albumID int64) VirtualDir {
+	counts := struct {
+		sync.Mutex
+		loaded bool
+		listed int64
+		songs  int64
+	}{}
+
+	dir := newCachedDir(layoutTTL, func() (map[string]fs.Node, error) {
+		entries, listed, songs, err := songEntries(a, albumID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Warn once rather than on every refresh, unless the count changes
+		counts.Lock()
+		defer counts.Unlock()
+		if listed != songs && (!counts.loaded || counts.listed != listed) {
+			log.Printf("subfs: album %d lists %d of the %d songs reported by the server", albumID, listed, songs)
+		}
+		counts.loaded, counts.listed, counts.songs = true, listed, songs
+		return entries, nil
+	})
+	dir.xattrs = func() map[string]string {
+		attrs := map[string]string{}
+		if _, err := dir.entries(); err != nil {
+			return attrs
+		}
+
+		counts.Lock()
+		defer counts.Unlock()
+		if counts.listed != counts.songs {
+			attrs["user.subfs.incomplete"] = fmt.Sprintf("%d/%d", counts.listed, counts.songs)
+		}
+		return attrs
+	}
+	return dir
+}
+
+// songEntries returns the songs of an album, as both original and transcoded files, along with its cover,
+// and the number of songs listed out of those the server counted
+func songEntries(a *account, albumID int64) (map[string]fs.Node, int64, int64, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(albumID, 10))
+
+	var res struct {
+		Album struct {
+			SongCount int64      `json:"songCount"`
+			Song      []apiChild `json:"song"`
+		} `json:"album"`
+	}
+	if err := apiGet(a, "getAlbum", params, &res); err != nil {
+		log.Printf("subfs: failed to retrieve album %d: %s", albumID, err.Error())
+		return nil, 0, 0, err
+	}
+
+	// Count the songs given at least one file
+	entries := audioEntries(a, res.Album.Song)
+	songs := map[int64]bool{}
+	for _, node := range entries {
+		if f, ok := node.(SubFile); ok && !f.IsArt {
+			songs[f.ID] = true
+		}
+	}
+	return entries, int64(len(songs)), res.Album.SongCount, nil
+}
+
+// audioEntries returns files for a list of songs, both as originals and transcodes unless streaming raw
+// files, along with a cover
+func audioEntries(a *account, songs []apiChild) map[string]fs.Node {
+	entries := map[string]fs.Node{}
+	var coverArt int64
+	versions := []bool{true, false}
+	if *streamRaw {
+		versions = []bool{true}
+	}
+	for _, c := range songs {
+		for _, original := range versions {
+			suffix := c.Suffix
+			if !original {
+				suffix = c.transcodedSuffix()
+			}
+
+			// If suffix is empty (source is lossy), skip this file
+			if suffix == "" {
+				continue
+			}
+
+			filename, err := a.sfs.formatFilename(c.audio(), suffix, c.starred())
+			if err != nil || filename == "" {
+				continue
+			}
+
+			f := newAudioFile(a, c, original)
+			f.FileName = filename
+			entries[filename] = f
+		}
+
+		if coverArt == 0 {
+			coverArt = int64(c.CoverArt)
+		}
+	}
+
+	if coverArt != 0 {
+		entries["cover.jpg"] = SubFile{
+			acct:     a,
+			ID:       coverArt,
+			FileName: "cover.jpg",
+			IsArt:    true,
+			ArtSize:  *artSize,
+		}
+	}
+	return entries
+}
+
+// normalizedDepth is how many levels below an artist are searched for songs in the normalized layout
+const normalizedDepth = 4
+
+// normalizedArtistDir returns an artist directory holding exactly one level of albums, however deeply the
+// server nests the artist's songs, along with their collaborations
+func normalizedArtistDir(a *account, artistID int64, artist string) VirtualDir {
+	return newCachedDir(layoutTTL, func() (map[string]fs.Node, error) {
+		albums := map[string][]apiChild{}
+		if err := collectAlbums(a, artistID, "", normalizedDepth, albums); err != nil {
+			return nil, err
+		}
+
+		entries := map[string]fs.Node{}
+		for name, songs := range albums {
+			entries[limitName(sanitizeName(rewrite("album", name)), int64(songs[0].ID))] = newStaticDir(audioEntries(a, songs))
+		}
+		if dir := collaborationsDir(a, artist); dir != nil {
+			entries[collaborationsName] = dir
+		}
+		return entries, nil
+	})
+}
+
+// collectAlbums walks a directory and its subdirectories, grouping their songs by album tag, or by the
+// name of the directory holding them if untagged
+func collectAlbums(a *account, id int64, title string, depth int, albums map[string][]apiChild) error {
+	result, err := a.sfs.directoryFlight.Do(a.Name+"/"+strconv.FormatInt(id, 10), func() (interface{}, error) {
+		return fetchMusicDirectory(a, id)
+	})
+	if err != nil {
+		log.Printf("subfs: failed to retrieve directory %d: %s", id, err.Error())
+		return err
+	}
+	listing := result.(*musicDirectory)
+
+	for _, song := range listing.Content.Audio {
+		c := listing.Children[song.ID]
+		album := c.Album
+		if album == "" {
+			album = title
+		}
+		if album == "" {
+			album = "Unknown Album"
+		}
+		albums[album] = append(albums[album], c)
+	}
+
+	if depth == 0 {
+		return nil
+	}
+	for _, dir := range listing.Content.Directories {
+		if err := collectAlbums(a, dir.ID, dir.Title, depth-1, albums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// localMusic is a directory holding local copies of part of the library, served instead of downloading
+var localMusic = flag.String("local-music", "", "Directory of local copies of the library, matched by path or by artist, album and title, and read instead of downloading them")
+
+// localIndex finds local copies of original files under -local-music, by their path relative to the
+// directory and by their tags
+type localIndex struct {
+	sync.RWMutex
+
+	// paths maps the lower-case trailing artist/album/file components of a path, or more of them, to a
+	// local file, and tags maps tagKey to one.  Keys shared by several local files map to "", matching none.
+	paths map[string]string
+	tags  map[string]string
+}
+
+// minPathParts is the fewest trailing path components, as in Artist/Album/Track.flac, matching a local copy
+const minPathParts = 3
+
+// indexKey records a local file under key, unless another already has it, which leaves the key ambiguous.
+// The caller must hold the lock.
+func indexKey(index map[string]string, key string, name string) {
+	if current, ok := index[key]; ok && current != name {
+		index[key] = ""
+		return
+	}
+	index[key] = name
+}
+
+// trackPrefix matches a track number at the start of a filename, as in "01 - Title" or "1. Title"
+var trackPrefix = regexp.MustCompile(`^\d+(\s*[-.]\s*|\s+)`)
+
+// indexLocalMusic returns an index of the files below dir, filled in the background, or nil if dir is unset
+func indexLocalMusic(dir string) *localIndex {
+	if dir == "" {
+		return nil
+	}
+
+	l := &localIndex{
+		paths: map[string]string{},
+		tags:  map[string]string{},
+	}
+	go l.walk(dir)
+	return l
+}
+
+// tagKey returns the key matching local copies to songs, ignoring case
+func tagKey(artist, album, title, suffix string) string {
+	return strings.ToLower(strings.Join([]string{
+		strings.TrimSpace(artist),
+		strings.TrimSpace(album),
+		strings.TrimSpace(title),
+		suffix,
+	}, "\x00"))
+}
+
+// walk indexes every file below dir, by path and by tags.  Tags are read from FLAC files, and otherwise
+// guessed from an Artist/Album/01 - Title layout.
+func (l *localIndex) walk(dir string) {
+	log.Printf("subfs: indexing local music in %s", dir)
+	count := 0
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		// Guess the tags from the path, then prefer any real ones
+		suffix := strings.TrimPrefix(path.Ext(rel), ".")
+		parts := strings.Split(rel, "/")
+		var artist, album string
+		title := trackPrefix.ReplaceAllString(strings.TrimSuffix(parts[len(parts)-1], path.Ext(rel)), "")
+		if len(parts) >= 3 {
+			artist, album = parts[len(parts)-3], parts[len(parts)-2]
+		}
+		if strings.EqualFold(suffix, "flac") {
+			artist, album, title = flacFileTags(name, artist, album, title)
+		}
+
+		l.Lock()
+		lower := strings.Split(strings.ToLower(rel), "/")
+		for i := 0; i+minPathParts <= len(lower); i++ {
+			indexKey(l.paths, strings.Join(lower[i:], "/"), name)
+		}
+		if artist != "" && album != "" && title != "" {
+			indexKey(l.tags, tagKey(artist, album, title, suffix), name)
+		}
+		l.Unlock()
+		count++
+		return nil
+	})
+	if err != nil {
+		log.Printf("subfs: failed to index local music in %s: %s", dir, err.Error())
+	}
+	log.Printf("subfs: indexed %d local files in %s", count, dir)
+}
+
+// flacFileTags returns the artist, album and title tagged in a FLAC file, keeping those given for any
+// which are missing
+func flacFileTags(name string, artist, album, title string) (string, string, string) {
+	f, err := os.Open(name)
+	if err != nil {
+		return artist, album, title
+	}
+	defer f.Close()
+
+	flacBlocks(f, func(blockType byte, block []byte) bool {
+		// VORBIS_COMMENT
+		if blockType != 4 {
+			return true
+		}
+		if value, ok := vorbisComment(block, "ARTIST"); ok {
+			artist = value
+		}
+		if value, ok := vorbisComment(block, "ALBUM"); ok {
+			album = value
+		}
+		if value, ok := vorbisComment(block, "TITLE"); ok {
+			title = value
+		}
+		return false
+	})
+	return artist, album, title
+}
+
+// find returns the local copy of a song's original file, matched by its path on the server, or at least
+// its artist, album and file components, or else by its tags.  Matches shared by several local files are
+// refused, rather than reading the wrong one, as are tag matches whose size differs from the server's
+// listed size, as they are another rip or encode of the song.
+func (l *localIndex) find(s SubFile) (string, bool) {
+	if l == nil || !s.Lossless || s.IsVideo || s.IsArt || s.CueLength > 0 {
+		return "", false
+	}
+
+	l.RLock()
+	defer l.RUnlock()
+
+	parts := strings.Split(strings.ToLower(s.Path), "/")
+	for i := 0; i+minPathParts <= len(parts); i++ {
+		if name, ok := l.paths[strings.Join(parts[i:], "/")]; ok {
+			return name, name != ""
+		}
+	}
+
+	name, ok := l.tags[tagKey(s.Tags.Artist, s.Tags.Album, s.Tags.Title, s.Suffix)]
+	if !ok || name == "" || s.Size <= 0 {
+		return "", false
+	}
+	if info, err := os.Stat(name); err != nil || info.Size() != s.Size {
+		return "", false
+	}
+	return name, true
+}
+
+// localCopy is a local copy of a file being read, which is never cached, as it is read again just as fast
+type localCopy struct {
+	*os.File
+}
+
+// openLocal opens the local copy of this file at offset, if there is one.  Copies whose size differs from
+// the server's listed size are skipped, so that originals stay byte for byte identical to the server's.
+func (s SubFile) openLocal(offset int64) (io.ReadCloser, bool) {
+	name, ok := s.acct.sfs.locals.find(s)
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	info, err := f.Stat()
+	if err == nil && s.Size > 0 && info.Size() != s.Size {
+		log.Printf("Skipping local copy of [%d] %s, whose size differs from the server's: %s", s.ID, s.FileName, name)
+		f.Close()
+		return nil, false
+	}
+	if err == nil && offset > 0 {
+		_, err = f.Seek(offset, os.SEEK_SET)
+	}
+	if err != nil {
+		log.Println(err)
+		f.Close()
+		return nil, false
+	}
+
+	log.Printf("Opening local copy: [%d] %s from %s", s.ID, s.FileName, name)
+	return localCopy{f}, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"bazil.org/fuse"
+)
+
+// logLevel chooses how much subfs logs: info logs as usual, and debug adds detailed tracing
+var logLevel = flag.String("log-level", "info", "Logging level: info, or debug for detailed tracing")
+
+// fuseDebug logs the FUSE protocol messages exchanged with the kernel, at the debug level
+var fuseDebug = flag.Bool("fuse-debug", false, "Log FUSE protocol messages exchanged with the kernel, implying -log-level=debug")
+
+// debugf logs a message only at the debug level
+func debugf(format string, v ...interface{}) {
+	if *logLevel == "debug" {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// initLogging applies the logging flags, routing FUSE protocol messages into the debug level if asked
+func initLogging() {
+	if *logLevel != "info" && *logLevel != "debug" {
+		log.Fatalf("Unknown -log-level: %s", *logLevel)
+	}
+
+	if *fuseDebug {
+		*logLevel = "debug"
+		fuse.Debug = func(msg interface{}) {
+			debugf("fuse: %v", msg)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mdlayher/gosubsonic"
+)
+
+// apiInt is an integer which the server may encode as either a JSON number or a string
+type apiInt int64
+
+// UnmarshalJSON accepts both numbers and numeric strings
+func (i *apiInt) UnmarshalJSON(data []byte) error {
+	data = bytes.Trim(data, `"`)
+	if len(data) == 0 || string(data) == "null" {
+		*i = 0
+		return nil
+	}
+
+	v, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = apiInt(v)
+	return nil
+}
+
+// apiTime is a timestamp, which servers format with or without fractional seconds and time zones
+type apiTime struct {
+	time.Time
+}
+
+// apiTimeLayouts lists the timestamp layouts seen from Subsonic-compatible servers
+var apiTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.000",
+}
+
+// UnmarshalJSON parses any of the known timestamp layouts, leaving unknown ones zero
+func (t *apiTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil
+	}
+
+	for _, layout := range apiTimeLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return nil
+}
+
+// replayGain holds ReplayGain values reported by OpenSubsonic servers
+type replayGain struct {
+	TrackGain *float64 `json:"trackGain"`
+	AlbumGain *float64 `json:"albumGain"`
+	TrackPeak *float64 `json:"trackPeak"`
+	AlbumPeak *float64 `json:"albumPeak"`
+}
+
+// apiChild is a directory entry as returned by the Subsonic API, including fields which gosubsonic
+// doesn't expose, such as OpenSubsonic extensions
+type apiChild struct {
+	ID                    apiInt      `json:"id"`
+	Parent                apiInt      `json:"parent"`
+	IsDir                 bool        `json:"isDir"`
+	IsVideo               bool        `json:"isVideo"`
+	Title                 string      `json:"title"`
+	Album                 string      `json:"album"`
+	Artist                string      `json:"artist"`
+	Track                 int64       `json:"track"`
+	DiscNumber            int64       `json:"discNumber"`
+	Year                  int64       `json:"year"`
+	Genre                 string      `json:"genre"`
+	CoverArt              apiInt      `json:"coverArt"`
+	Size                  int64       `json:"size"`
+	ContentType           string      `json:"contentType"`
+	Suffix                string      `json:"suffix"`
+	TranscodedContentType string      `json:"transcodedContentType"`
+	TranscodedSuffix      string      `json:"transcodedSuffix"`
+	Duration              int64       `json:"duration"`
+	BitRate               int64       `json:"bitRate"`
+	Path                  string      `json:"path"`
+	Created               apiTime     `json:"created"`
+	Changed               apiTime     `json:"changed"`
+	AlbumID               apiInt      `json:"albumId"`
+	ArtistID              apiInt      `json:"artistId"`
+	UserRating            int64       `json:"userRating"`
+	Starred               apiTime     `json:"starred"`
+	ReplayGain            *replayGain `json:"replayGain"`
+
+	// Composers of the song, as reported by OpenSubsonic servers
+	DisplayComposer string           `json:"displayComposer"`
+	Contributors    []apiContributor `json:"contributors"`
+}
+
+// musicDirectory is the content of a directory, both in gosubsonic's form and with the full
+// entries returned by the server, keyed by ID
+type musicDirectory struct {
+	Content  *gosubsonic.Content
+	Children map[int64]apiChild
+}
+
+// fetchMusicDirectory retrieves a directory's content directly from the Subsonic API
+func fetchMusicDirectory(a *account, id int64) (*musicDirectory, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(id, 10))
+
+	var res struct {
+		Directory struct {
+			Child []apiChild `json:"child"`
+		} `json:"directory"`
+	}
+	if err := apiGet(a, "getMusicDirectory", params, &res); err != nil {
+		return nil, err
+	}
+	a.songs.record(res.Directory.Child)
+
+	dir := &musicDirectory{
+		Content:  new(gosubsonic.Content),
+		Children: make(map[int64]apiChild, len(res.Directory.Child)),
+	}
+	for _, c := range res.Directory.Child {
+		dir.Children[int64(c.ID)] = c
+
+		switch {
+		case c.IsDir:
+			dir.Content.Directories = append(dir.Content.Directories, c.directory())
+		case c.IsVideo:
+			dir.Content.Video = append(dir.Content.Video, c.video())
+		default:
+			dir.Content.Audio = append(dir.Content.Audio, c.audio())
+		}
+	}
+
+	return dir, nil
+}
+
+// modified returns when an entry last changed on the server, falling back to when it was added
+func (c apiChild) modified() time.Time {
+	if !c.Changed.IsZero() {
+		return c.Changed.Time
+	}
+	return c.Created.Time
+}
+
+// starred returns whether the user has starred this entry
+func (c apiChild) starred() bool {
+	return !c.Starred.IsZero()
+}
+
+// directory converts a directory entry to gosubsonic's form
+func (c apiChild) directory() gosubsonic.Directory {
+	return gosubsonic.Directory{
+		ID:       int64(c.ID),
+		Parent:   int64(c.Parent),
+		Title:    c.Title,
+		Artist:   c.Artist,
+		CoverArt: int64(c.CoverArt),
+	}
+}
+
+// audio converts an audio entry to gosubsonic's form, as used by filename templates, keeping every field
+// the server returned which gosubsonic has room for
+func (c apiChild) audio() gosubsonic.Audio {
+	return gosubsonic.Audio{
+		ID:                    int64(c.ID),
+		Parent:                int64(c.Parent),
+		Title:                 c.Title,
+		Album:                 c.Album,
+		Artist:                c.Artist,
+		Track:                 c.Track,
+		DiscNumber:            c.DiscNumber,
+		Year:                  c.Year,
+		Genre:                 c.Genre,
+		CoverArt:              int64(c.CoverArt),
+		Size:                  c.Size,
+		ContentType:           c.ContentType,
+		Suffix:                c.Suffix,
+		TranscodedContentType: c.TranscodedContentType,
+		TranscodedSuffix:      c.transcodedSuffix(),
+		DurationRaw:           c.Duration,
+		Duration:              time.Duration(c.Duration) * time.Second,
+		BitRate:               c.BitRate,
+		Path:                  c.Path,
+		IsDir:                 c.IsDir,
+		IsVideo:               c.IsVideo,
+		AlbumID:               int64(c.AlbumID),
+		ArtistID:              int64(c.ArtistID),
+		Created:               c.Created.Time,
+	}
+}
+
+// video converts a video entry to gosubsonic's form
+func (c apiChild) video() gosubsonic.Video {
+	return gosubsonic.Video{
+		ID:                    int64(c.ID),
+		Parent:                int64(c.Parent),
+		Title:                 c.Title,
+		CoverArt:              int64(c.CoverArt),
+		Size:                  c.Size,
+		ContentType:           c.ContentType,
+		Suffix:                c.Suffix,
+		TranscodedContentType: c.TranscodedContentType,
+		TranscodedSuffix:      c.TranscodedSuffix,
+		DurationRaw:           c.Duration,
+		Duration:              time.Duration(c.Duration) * time.Second,
+		BitRate:               c.BitRate,
+		Path:                  c.Path,
+		IsVideo:               c.IsVideo,
+		Created:               c.Created.Time,
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+)
+
+// maxRegisteredDirs bounds the directories a nodeRegistry remembers, along with their listings, so that
+// walking a large library doesn't grow memory for the life of the mount
+const maxRegisteredDirs = 4096
+
+// nodeRegistry remembers the latest directory listed at each path of an account's tree, so that
+// directories the kernel already resolved pick up what a refresh of the index changed, such as new IDs,
+// instead of diverging until remount.  Only the most recently used maxRegisteredDirs paths are kept.
+type nodeRegistry struct {
+	sync.Mutex
+
+	// dirs maps a path to its element of order, which holds its SubDir, most recently used first
+	dirs  map[string]*list.Element
+	order *list.List
+}
+
+// newNodeRegistry returns an empty nodeRegistry
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{
+		dirs:  map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// register remembers a directory at its path, unless one from a later generation is already there,
+// forgetting the least recently used path if there are too many
+func (r *nodeRegistry) register(d SubDir) {
+	r.Lock()
+	defer r.Unlock()
+
+	if e, ok := r.dirs[d.Path]; ok {
+		if e.Value.(SubDir).generation > d.generation {
+			return
+		}
+		e.Value = d
+		r.order.MoveToFront(e)
+		return
+	}
+
+	r.dirs[d.Path] = r.order.PushFront(d)
+	if r.order.Len() > maxRegisteredDirs {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.dirs, oldest.Value.(SubDir).Path)
+	}
+}
+
+// lookup returns the directory remembered at path, if any, marking it recently used
+func (r *nodeRegistry) lookup(path string) (SubDir, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	e, ok := r.dirs[path]
+	if !ok {
+		return SubDir{}, false
+	}
+	r.order.MoveToFront(e)
+	return e.Value.(SubDir), true
+}
+
+// inTree reports whether this directory was placed in the account's tree by a listing, rather than
+// gathered into a view such as Starred, whose directories aren't refreshed
+func (d SubDir) inTree() bool {
+	return d.Root || d.generation > 0
+}
+
+// refreshed returns the directory listed at this one's path since it was resolved, if a refresh of the
+// index changed it, or else this directory
+func (d SubDir) refreshed() SubDir {
+	if !d.inTree() {
+		return d
+	}
+
+	fresh, ok := d.acct.nodes.lookup(d.Path)
+	if !ok || fresh.generation <= d.generation || fresh.Root != d.Root {
+		return d
+	}
+	if fresh.ID == d.ID && fresh.Modified.Equal(d.Modified) && fresh.CoverArt == d.CoverArt {
+		return d
+	}
+	return fresh
+}
+
+// registerChildren places the subdirectories found by a listing of this directory in the tree, at the
+// generation of the index they were listed from
+func (d SubDir) registerChildren(dirs map[string]SubDir, generation int64) {
+	if !d.inTree() {
+		return
+	}
+
+	for name, sub := range dirs {
+		sub.generation = generation
+		dirs[name] = sub
+		d.acct.nodes.register(sub)
+	}
+}
+
+// relistIndex lists the root and each music folder again once the index has been refreshed, so that
+// directories the kernel holds for them, and for their artists, find their fresh counterparts
+func (a *account) relistIndex() {
+	root := NewSubDir(a, -1, true, false)
+	if _, err := root.readDir(nil); err != nil {
+		log.Printf("subfs: failed to list the refreshed index of %s: %v", a.Name, err)
+		return
+	}
+	for _, sub := range root.listing.current().dirs {
+		if !sub.Folder {
+			continue
+		}
+		if _, err := sub.readDir(nil); err != nil {
+			log.Printf("subfs: failed to list the refreshed index of %s: %v", a.Name, err)
+		}
+	}
+}
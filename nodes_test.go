@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestNodeRegistryBounded checks that the registry forgets the least recently used directories beyond
+// maxRegisteredDirs, keeping those still looked up
+func TestNodeRegistryBounded(t *testing.T) {
+	r := newNodeRegistry()
+	for i := 0; i < maxRegisteredDirs*2; i++ {
+		d := NewSubDir(nil, int64(i), false, false)
+		d.Path = "/Artist " + strconv.Itoa(i)
+		r.register(d)
+
+		// The first directory stays in use throughout
+		if _, ok := r.lookup("/Artist 0"); !ok {
+			t.Fatalf("first directory forgotten after registering %d", i+1)
+		}
+	}
+
+	if len(r.dirs) != maxRegisteredDirs || r.order.Len() != maxRegisteredDirs {
+		t.Fatalf("registry holds %d paths, want %d", len(r.dirs), maxRegisteredDirs)
+	}
+	if _, ok := r.lookup("/Artist 1"); ok {
+		t.Fatal("least recently used directory still registered")
+	}
+	if d, ok := r.lookup("/Artist " + strconv.Itoa(maxRegisteredDirs*2-1)); !ok || d.ID != int64(maxRegisteredDirs*2-1) {
+		t.Fatal("latest directory not registered")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// overlayDir is a writable local directory layered over the tree, for adding files the server lacks
+var overlayDir = flag.String("overlay", "", "Writable local directory layered over the tree: its files appear alongside the server's, taking the place of any with the same name, and files written within subfs land in it")
+
+// overlayPath returns the local path layered over a path of this account's tree, with several accounts
+// each getting a directory of their own, or an empty string without -overlay
+func (a *account) overlayPath(p string) string {
+	if *overlayDir == "" {
+		return ""
+	}
+	root := *overlayDir
+	if len(a.sfs.accounts) > 1 {
+		root = filepath.Join(root, a.Name)
+	}
+	return filepath.Join(root, filepath.FromSlash(p))
+}
+
+// overlayParent is a directory which local files can be created in or renamed into
+type overlayParent interface {
+	overlayDirPath() string
+}
+
+// overlayDirPath returns the local directory layered over this one, or an empty string without -overlay
+func (d SubDir) overlayDirPath() string {
+	return d.acct.overlayPath(d.Path)
+}
+
+// overlayError converts an error from the local filesystem into the errno it carries
+func overlayError(err error) fuse.Error {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return fuse.Errno(errno)
+	}
+	log.Println(err)
+	return fuse.EIO
+}
+
+// overlayNode returns the node of a local file or directory, or nil if there is none
+func overlayNode(local string) (fs.Node, os.FileInfo) {
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, nil
+	}
+	if info.IsDir() {
+		return OverlayDir{path: local}, info
+	}
+	return OverlayFile{path: local}, info
+}
+
+// overlayDirents adds the local entries of a directory to its listing, leaving out names already listed
+func overlayDirents(local string, directories []fuse.Dirent) []fuse.Dirent {
+	if local == "" {
+		return directories
+	}
+	infos, err := ioutil.ReadDir(local)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return directories
+	}
+
+	listed := map[string]bool{}
+	for _, e := range directories {
+		listed[e.Name] = true
+	}
+	for _, info := range infos {
+		if listed[info.Name()] {
+			continue
+		}
+		entryType := fuse.DT_File
+		if info.IsDir() {
+			entryType = fuse.DT_Dir
+		}
+		directories = append(directories, fuse.Dirent{
+			Name: info.Name(),
+			Type: entryType,
+		})
+	}
+	return directories
+}
+
+// overlayCreate creates a local file in a directory, creating the directory too if needed
+func overlayCreate(local string, req *fuse.CreateRequest) (fs.Node, fs.Handle, fuse.Error) {
+	if local == "" {
+		return nil, nil, readOnlyError()
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return nil, nil, overlayError(err)
+	}
+
+	name := filepath.Join(local, req.Name)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, req.Mode.Perm())
+	if err != nil {
+		return nil, nil, overlayError(err)
+	}
+	return OverlayFile{path: name}, &overlayHandle{file: f}, nil
+}
+
+// overlayMkdir creates a local directory in a directory, creating the directory too if needed
+func overlayMkdir(local string, req *fuse.MkdirRequest) (fs.Node, fuse.Error) {
+	if local == "" {
+		return nil, readOnlyError()
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return nil, overlayError(err)
+	}
+
+	name := filepath.Join(local, req.Name)
+	if err := os.Mkdir(name, req.Mode.Perm()); err != nil {
+		return nil, overlayError(err)
+	}
+	return OverlayDir{path: name}, nil
+}
+
+// overlayRemove removes a local file or directory.  The server's own files can't be removed.
+func overlayRemove(local string, req *fuse.RemoveRequest) fuse.Error {
+	if local == "" {
+		return readOnlyError()
+	}
+
+	name := filepath.Join(local, req.Name)
+	if _, err := os.Lstat(name); err != nil {
+		return readOnlyError()
+	}
+	if err := os.Remove(name); err != nil {
+		return overlayError(err)
+	}
+	return nil
+}
+
+// overlayRename moves a local file or directory into another directory of the overlay.  The server's
+// own files can't be moved.
+func overlayRename(local string, req *fuse.RenameRequest, newDir fs.Node) fuse.Error {
+	parent, ok := newDir.(overlayParent)
+	if local == "" || !ok || parent.overlayDirPath() == "" {
+		return readOnlyError()
+	}
+
+	name := filepath.Join(local, req.OldName)
+	if _, err := os.Lstat(name); err != nil {
+		return readOnlyError()
+	}
+	if err := os.MkdirAll(parent.overlayDirPath(), 0755); err != nil {
+		return overlayError(err)
+	}
+	if err := os.Rename(name, filepath.Join(parent.overlayDirPath(), req.NewName)); err != nil {
+		return overlayError(err)
+	}
+	return nil
+}
+
+// OverlayDir is a directory which only exists in the overlay
+type OverlayDir struct {
+	readOnlyDir
+
+	path string
+}
+
+// Attr returns the attributes of the local directory
+func (d OverlayDir) Attr() fuse.Attr {
+	return overlayAttr(d.path)
+}
+
+// overlayDirPath returns the local directory
+func (d OverlayDir) overlayDirPath() string {
+	return d.path
+}
+
+// Lookup finds a local file or directory
+func (d OverlayDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	node, _ := overlayNode(filepath.Join(d.path, name))
+	if node == nil {
+		return nil, fuse.ENOENT
+	}
+	return node, nil
+}
+
+// ReadDir lists the local directory
+func (d OverlayDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	return overlayDirents(d.path, []fuse.Dirent{}), nil
+}
+
+// Create creates a local file
+func (d OverlayDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
+	return overlayCreate(d.path, req)
+}
+
+// Mkdir creates a local directory
+func (d OverlayDir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	return overlayMkdir(d.path, req)
+}
+
+// Remove removes a local file or directory
+func (d OverlayDir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
+	return overlayRemove(d.path, req)
+}
+
+// Rename moves a local file or directory
+func (d OverlayDir) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.Error {
+	return overlayRename(d.path, req, newDir)
+}
+
+// OverlayFile is a file in the overlay, which may take the place of one of the server's
+type OverlayFile struct {
+	readOnlyFile
+
+	path string
+}
+
+// Attr returns the attributes of the local file
+func (f OverlayFile) Attr() fuse.Attr {
+	return overlayAttr(f.path)
+}
+
+// overlayAttr returns the attributes of a local file or directory
+func overlayAttr(name string) fuse.Attr {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fuse.Attr{}
+	}
+
+	attr := fuse.Attr{
+		Size:  uint64(info.Size()),
+		Mode:  info.Mode(),
+		Mtime: info.ModTime(),
+	}
+	if *reexport {
+		attr.Inode = stableInode("overlay/" + name)
+	}
+	if info.IsDir() {
+		attr.Nlink = dirNlink
+	}
+	return attr
+}
+
+// Open opens the local file for reading and writing, or only reading if it isn't writable
+func (f OverlayFile) Open(req *fuse.OpenRequest, resp *fuse.OpenResponse, intr fs.Intr) (fs.Handle, fuse.Error) {
+	file, err := os.OpenFile(f.path, os.O_RDWR, 0)
+	if os.IsPermission(err) {
+		file, err = os.Open(f.path)
+	}
+	if err != nil {
+		return nil, overlayError(err)
+	}
+	return &overlayHandle{file: file}, nil
+}
+
+// Setattr truncates the local file, or changes its mode or modification time
+func (f OverlayFile) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	if req.Valid&fuse.SetattrSize != 0 {
+		if err := os.Truncate(f.path, int64(req.Size)); err != nil {
+			return overlayError(err)
+		}
+	}
+	if req.Valid&fuse.SetattrMode != 0 {
+		if err := os.Chmod(f.path, req.Mode.Perm()); err != nil {
+			return overlayError(err)
+		}
+	}
+	if req.Valid&fuse.SetattrMtime != 0 {
+		if err := os.Chtimes(f.path, req.Mtime, req.Mtime); err != nil {
+			return overlayError(err)
+		}
+	}
+
+	resp.Attr = f.Attr()
+	return nil
+}
+
+// Fsync does nothing, as writes are flushed when the file is released
+func (f OverlayFile) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
+	return nil
+}
+
+// overlayHandle is an open local file
+type overlayHandle struct {
+	file *os.File
+}
+
+// Read reads from the local file at any offset
+func (h *overlayHandle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.Intr) fuse.Error {
+	buf := make([]byte, req.Size)
+	n, err := h.file.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return overlayError(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Write writes to the local file at any offset
+func (h *overlayHandle) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	n, err := h.file.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	if err != nil {
+		return overlayError(err)
+	}
+	return nil
+}
+
+// Flush writes the local file out to disk
+func (h *overlayHandle) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
+	if err := h.file.Sync(); err != nil {
+		return overlayError(err)
+	}
+	return nil
+}
+
+// Release closes the local file
+func (h *overlayHandle) Release(req *fuse.ReleaseRequest, intr fs.Intr) fuse.Error {
+	if err := h.file.Close(); err != nil {
+		return overlayError(err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// playlists adds the Playlists directory
+var playlists = flag.Bool("playlists", false, "Add a Playlists directory with a directory of songs for each of the server's playlists")
+
+// playlistTTL is how long playlists are kept before asking the server again, separately from the artist
+// index, as playlists change much more often
+var playlistTTL = flag.Duration("playlist-ttl", time.Minute, "How long playlists are kept before asking the server again")
+
+// apiPlaylist is a playlist as returned by getPlaylists and getPlaylist.  Cover art is kept as a string,
+// as servers often use IDs such as "pl-12" for playlist covers.
+type apiPlaylist struct {
+	ID        apiInt     `json:"id"`
+	Name      string     `json:"name"`
+	Comment   string     `json:"comment"`
+	Owner     string     `json:"owner"`
+	Public    bool       `json:"public"`
+	SongCount int64      `json:"songCount"`
+	Duration  int64      `json:"duration"`
+	Created   apiTime    `json:"created"`
+	Changed   apiTime    `json:"changed"`
+	CoverArt  string     `json:"coverArt"`
+	Entry     []apiChild `json:"entry"`
+}
+
+// newPlaylistsDir returns the Playlists directory, holding a directory for each playlist
+func newPlaylistsDir(a *account) VirtualDir {
+	return newExpiringDir(*playlistTTL, a.playlistGeneration, func() (map[string]fs.Node, error) {
+		var res struct {
+			Playlists struct {
+				Playlist []apiPlaylist `json:"playlist"`
+			} `json:"playlists"`
+		}
+		if err := apiGet(a, "getPlaylists", url.Values{}, &res); err != nil {
+			log.Printf("subfs: failed to retrieve playlists: %s", err.Error())
+			return nil, err
+		}
+
+		entries := map[string]fs.Node{}
+		for _, p := range res.Playlists.Playlist {
+			id := int64(p.ID)
+			entries[limitName(sanitizeName(p.Name), id)] = newExpiringDir(*playlistTTL, a.playlistGeneration, func() (map[string]fs.Node, error) {
+				return playlistEntries(a, id)
+			})
+		}
+		return entries, nil
+	})
+}
+
+// playlistEntries returns the songs of a playlist, prefixed by their position, along with its cover art
+// as cover.jpg and a description as playlist.txt
+func playlistEntries(a *account, id int64) (map[string]fs.Node, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(id, 10))
+
+	var res struct {
+		Playlist apiPlaylist `json:"playlist"`
+	}
+	if err := apiGet(a, "getPlaylist", params, &res); err != nil {
+		log.Printf("subfs: failed to retrieve playlist %d: %s", id, err.Error())
+		return nil, err
+	}
+	p := res.Playlist
+
+	entries := map[string]fs.Node{}
+	for i, c := range p.Entry {
+		filename, err := a.sfs.formatFilename(c.audio(), c.Suffix, c.starred())
+		if err != nil || filename == "" {
+			continue
+		}
+		filename = fmt.Sprintf("%02d - %s", i+1, filename)
+
+		f := newAudioFile(a, c, true)
+		f.FileName = filename
+		entries[filename] = f
+	}
+
+	// Use the playlist's own cover if it has a numeric ID, or else the first song's
+	coverArt, err := strconv.ParseInt(p.CoverArt, 10, 64)
+	if err != nil && len(p.Entry) > 0 {
+		coverArt = int64(p.Entry[0].CoverArt)
+	}
+	if coverArt != 0 {
+		entries["cover.jpg"] = SubFile{
+			acct:     a,
+			ID:       coverArt,
+			FileName: "cover.jpg",
+			IsArt:    true,
+			ArtSize:  *artSize,
+		}
+	}
+
+	entries["playlist.txt"] = newVirtualFile(0, func() ([]byte, error) {
+		return p.description(), nil
+	})
+	return entries, nil
+}
+
+// description returns a short text describing a playlist
+func (p apiPlaylist) description() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "name: %s\n", p.Name)
+	if p.Comment != "" {
+		fmt.Fprintf(&buf, "comment: %s\n", p.Comment)
+	}
+	fmt.Fprintf(&buf, "owner: %s\n", p.Owner)
+	fmt.Fprintf(&buf, "public: %t\n", p.Public)
+	fmt.Fprintf(&buf, "songs: %d\n", p.SongCount)
+	fmt.Fprintf(&buf, "duration: %d\n", p.Duration)
+	if !p.Created.IsZero() {
+		fmt.Fprintf(&buf, "created: %s\n", p.Created.Format("2006-01-02 15:04:05"))
+	}
+	if !p.Changed.IsZero() {
+		fmt.Fprintf(&buf, "changed: %s\n", p.Changed.Format("2006-01-02 15:04:05"))
+	}
+	return buf.Bytes()
+}
+
+// playlistGeneration returns a counter which changes whenever subfs itself changes a playlist
+func (a *account) playlistGeneration() int64 {
+	return atomic.LoadInt64(&a.playlistsChanged)
+}
+
+// invalidatePlaylists discards every cached playlist, to be called after subfs changes one on the server
+func (a *account) invalidatePlaylists() {
+	atomic.AddInt64(&a.playlistsChanged, 1)
+}
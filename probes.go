@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"path"
+	"strings"
+)
+
+// probeNames lists the names which file managers and desktops look up in every directory they visit,
+// which subfs answers as missing without listing the directory from the server
+var probeNames = flag.String("ignore-names", ".DS_Store,._*,.Trash*,autorun.inf,desktop.ini,Thumbs.db", "Comma-separated patterns of probed names, such as .DS_Store, which never exist and are refused without asking the server")
+
+// isProbe reports whether a looked up name matches one of the -ignore-names patterns, ignoring case
+func isProbe(name string) bool {
+	if *probeNames == "" {
+		return false
+	}
+
+	name = strings.ToLower(name)
+	for _, pattern := range strings.Split(*probeNames, ",") {
+		if matched, _ := path.Match(strings.ToLower(strings.TrimSpace(pattern)), name); matched {
+			return true
+		}
+	}
+	return false
+}
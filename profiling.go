@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofAddr is the address of the optional Go profiling endpoints
+var pprofAddr = flag.String("pprof-addr", "", "Address to serve Go profiling endpoints at /debug/pprof/, such as localhost:6060")
+
+// servePprof serves the runtime profiles on their own listener, kept apart from -health-addr so that
+// profiling is never exposed by accident alongside a public healthcheck
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Could not serve profiling at %s: %s", addr, err.Error())
+		}
+	}()
+}
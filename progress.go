@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// download is the progress of one file being fetched from the server
+type download struct {
+	acct     *account
+	ID       int64
+	FileName string
+	Expected int64
+	Started  time.Time
+
+	// fetched is the number of bytes received, and lastRead the UnixNano time of the last read
+	fetched  int64
+	lastRead int64
+}
+
+// progressReader counts the bytes read from a stream for its download
+type progressReader struct {
+	io.ReadCloser
+	d *download
+}
+
+// trackDownload registers a stream as a download in progress, until the returned stream is closed
+func trackDownload(s SubFile, stream io.ReadCloser) io.ReadCloser {
+	d := &download{
+		acct:     s.acct,
+		ID:       s.ID,
+		FileName: s.FileName,
+		Expected: s.GetSize(),
+		Started:  time.Now(),
+		lastRead: time.Now().UnixNano(),
+	}
+
+	sfs := s.acct.sfs
+	sfs.downloadsLock.Lock()
+	sfs.downloads[d] = true
+	sfs.downloadsLock.Unlock()
+
+	return &progressReader{
+		ReadCloser: stream,
+		d:          d,
+	}
+}
+
+// Read counts the bytes read
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.d.fetched, int64(n))
+	atomic.StoreInt64(&r.d.lastRead, time.Now().UnixNano())
+	return n, err
+}
+
+// Close ends the download
+func (r *progressReader) Close() error {
+	sfs := r.d.acct.sfs
+	sfs.downloadsLock.Lock()
+	delete(sfs.downloads, r.d)
+	sfs.downloadsLock.Unlock()
+
+	return r.ReadCloser.Close()
+}
+
+// String describes the download's progress, including how long it has been since data last arrived
+func (d *download) String() string {
+	fetched := atomic.LoadInt64(&d.fetched)
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&d.lastRead)))
+	elapsed := time.Since(d.Started).Seconds()
+
+	percent := 0.0
+	if d.Expected > 0 {
+		percent = float64(fetched) * 100 / float64(d.Expected)
+	}
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(fetched) / 1024 / elapsed
+	}
+
+	return fmt.Sprintf("[%d] %s: %d / %d bytes (%0.1f%%), %0.1f KB/s, idle %s",
+		d.ID, d.FileName, fetched, d.Expected, percent, rate, idle-idle%time.Second)
+}
+
+// downloadStatus lists the downloads in progress, optionally only those of one account
+func (sfs *Filesystem) downloadStatus(a *account) []byte {
+	sfs.downloadsLock.Lock()
+	lines := make([]string, 0, len(sfs.downloads))
+	for d := range sfs.downloads {
+		if a == nil || d.acct == a {
+			lines = append(lines, d.String())
+		}
+	}
+	sfs.downloadsLock.Unlock()
+
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+	return buf.Bytes()
+}
+
+// serveStatus writes the state of each server and all downloads in progress
+func (sfs *Filesystem) serveStatus(w http.ResponseWriter, r *http.Request) {
+	for _, a := range sfs.accounts {
+		fmt.Fprintf(w, "[%s]\n", a.Name)
+		w.Write(a.serverStatus())
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w, "downloads:")
+	w.Write(sfs.downloadStatus(nil))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// qualityViews adds the Quality directory, grouping known songs by their format and bitrate
+var qualityViews = flag.Bool("quality", false, "Add a Quality directory grouping songs seen so far by format and bitrate")
+
+// noCoverArt adds the No Cover Art directory, listing known albums without any cover art
+var noCoverArt = flag.Bool("no-cover-art", false, "Add a No Cover Art directory of albums seen so far which have no cover art")
+
+// crawl walks the whole library in the background, so that views built from known songs are complete
+var crawl = flag.Bool("crawl", false, "Walk the whole library in the background to learn about every song, for views of songs seen so far such as Quality")
+
+// crawlDelay is the pause between directory requests while crawling, to go easy on the server
+const crawlDelay = 100 * time.Millisecond
+
+// losslessSuffixes lists the suffixes of lossless audio formats
+var losslessSuffixes = map[string]bool{
+	"aif":  true,
+	"aiff": true,
+	"ape":  true,
+	"dff":  true,
+	"dsf":  true,
+	"flac": true,
+	"tta":  true,
+	"wav":  true,
+	"wv":   true,
+}
+
+// qualityClass is a directory within Quality, and the songs it holds
+type qualityClass struct {
+	Name    string
+	matches func(c apiChild) bool
+}
+
+// qualityClasses lists the directories of the Quality view.  A song may be in several.
+var qualityClasses = []qualityClass{
+	{"Lossless", func(c apiChild) bool {
+		return losslessSuffixes[strings.ToLower(c.Suffix)]
+	}},
+	{"High Bitrate (256k+)", func(c apiChild) bool {
+		return !losslessSuffixes[strings.ToLower(c.Suffix)] && c.BitRate >= 256
+	}},
+	{"Medium Bitrate (160-255k)", func(c apiChild) bool {
+		return !losslessSuffixes[strings.ToLower(c.Suffix)] && c.BitRate >= 160 && c.BitRate < 256
+	}},
+	{"Low Bitrate (<160k)", func(c apiChild) bool {
+		return !losslessSuffixes[strings.ToLower(c.Suffix)] && c.BitRate > 0 && c.BitRate < 160
+	}},
+	{"Unknown Bitrate", func(c apiChild) bool {
+		return !losslessSuffixes[strings.ToLower(c.Suffix)] && c.BitRate == 0
+	}},
+}
+
+// songStore remembers the metadata of every song seen in a directory listing, by ID
+type songStore struct {
+	sync.RWMutex
+	songs map[int64]apiChild
+}
+
+// record remembers the songs among a directory's children
+func (m *songStore) record(children []apiChild) {
+	m.Lock()
+	defer m.Unlock()
+	for _, c := range children {
+		if !c.IsDir && !c.IsVideo {
+			m.songs[int64(c.ID)] = c
+		}
+	}
+}
+
+// matching returns the known songs accepted by a filter
+func (m *songStore) matching(filter func(c apiChild) bool) []apiChild {
+	m.RLock()
+	defer m.RUnlock()
+
+	songs := []apiChild{}
+	for _, c := range m.songs {
+		if filter(c) {
+			songs = append(songs, c)
+		}
+	}
+	return songs
+}
+
+// newQualityDir returns the Quality directory, holding a directory per class of songs
+func newQualityDir(a *account) VirtualDir {
+	entries := map[string]fs.Node{}
+	for _, class := range qualityClasses {
+		class := class
+		entries[class.Name] = newCachedDir(time.Minute, func() (map[string]fs.Node, error) {
+			return albumDirs(a, a.songs.matching(class.matches)), nil
+		})
+	}
+	return newStaticDir(entries)
+}
+
+// newNoCoverArtDir returns the No Cover Art directory, holding a directory per album of which no known
+// song has cover art
+func newNoCoverArtDir(a *account) VirtualDir {
+	return newCachedDir(time.Minute, func() (map[string]fs.Node, error) {
+		// Albums are recognized by their directory, as any one song with art gives the album art
+		withArt := map[apiInt]bool{}
+		for _, c := range a.songs.matching(func(c apiChild) bool { return c.CoverArt != 0 }) {
+			withArt[c.Parent] = true
+		}
+		return albumDirs(a, a.songs.matching(func(c apiChild) bool {
+			return c.CoverArt == 0 && !withArt[c.Parent]
+		})), nil
+	})
+}
+
+// albumDirs groups songs into a directory per album, named "Artist - Album"
+func albumDirs(a *account, songs []apiChild) map[string]fs.Node {
+	albums := map[string]map[string]fs.Node{}
+	for _, c := range songs {
+		name := limitName(sanitizeName(fmt.Sprintf("%s - %s", rewrite("artist", c.Artist), rewrite("album", c.Album))), int64(c.Parent))
+		if albums[name] == nil {
+			albums[name] = map[string]fs.Node{}
+		}
+
+		filename, err := a.sfs.formatFilename(c.audio(), c.Suffix, c.starred())
+		if err != nil || filename == "" {
+			continue
+		}
+		f := newAudioFile(a, c, true)
+		f.FileName = filename
+		albums[name][filename] = f
+	}
+
+	entries := map[string]fs.Node{}
+	for name, files := range albums {
+		entries[name] = newStaticDir(files)
+	}
+	return entries
+}
+
+// crawlLibrary walks every directory of the library once, so that the song store knows every song
+func (a *account) crawlLibrary() {
+	dirs := []int64{}
+	for _, artists := range a.index() {
+		for _, artist := range artists {
+			dirs = append(dirs, artist.ID)
+		}
+	}
+
+	log.Printf("subfs: crawling library of %s", a.Name)
+	count := 0
+	for len(dirs) > 0 {
+		id := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+
+		listing, err := fetchMusicDirectory(a, id)
+		if err != nil {
+			log.Printf("subfs: failed to crawl directory %d: %s", id, err.Error())
+			continue
+		}
+		count++
+		for _, dir := range listing.Content.Directories {
+			dirs = append(dirs, dir.ID)
+		}
+
+		<-time.After(crawlDelay)
+	}
+	log.Printf("subfs: crawled %d directories of %s", count, a.Name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// radio enables instant mix playlists within each directory
+var radio = flag.Bool("radio", false, "Add an instant mix playlist, \"Radio (based on X).m3u\", to each directory")
+
+// radioSize is the number of songs in an instant mix playlist
+const radioSize = 50
+
+// radioPlaylist returns a playlist of songs similar to this directory's artist or album
+func (d SubDir) radioPlaylist(listing *musicDirectory) VirtualFile {
+	// Prefer the ID3 artist of any song within the directory, which getSimilarSongs2 requires
+	var artistID int64
+	for _, c := range listing.Children {
+		if c.ArtistID != 0 {
+			artistID = int64(c.ArtistID)
+			break
+		}
+	}
+
+	return newVirtualFile(10*time.Minute, func() ([]byte, error) {
+		songs, err := similarSongs(d.acct, d.ID, artistID)
+		if err != nil {
+			return nil, err
+		}
+		return playlistM3U(d.acct, songs), nil
+	})
+}
+
+// radioName returns the name of this directory's instant mix playlist
+func (d SubDir) radioName() string {
+	return sanitizeName(fmt.Sprintf("Radio (based on %s).m3u", d.Name))
+}
+
+// similarSongs fetches songs similar to an ID3 artist using getSimilarSongs2, or when no artist is
+// known, similar to a directory using getSimilarSongs
+func similarSongs(a *account, dirID int64, artistID int64) ([]apiChild, error) {
+	// Servers without similar songs get an empty playlist rather than a failed read
+	if a.quirks.noSimilar || !a.supports("getSimilarSongs") {
+		return nil, nil
+	}
+
+	params := url.Values{}
+	params.Set("count", strconv.Itoa(radioSize))
+
+	if artistID != 0 {
+		params.Set("id", strconv.FormatInt(artistID, 10))
+
+		var res struct {
+			SimilarSongs struct {
+				Song []apiChild `json:"song"`
+			} `json:"similarSongs2"`
+		}
+		err := apiGet(a, "getSimilarSongs2", params, &res)
+		return res.SimilarSongs.Song, err
+	}
+
+	params.Set("id", strconv.FormatInt(dirID, 10))
+
+	var res struct {
+		SimilarSongs struct {
+			Song []apiChild `json:"song"`
+		} `json:"similarSongs"`
+	}
+	err := apiGet(a, "getSimilarSongs", params, &res)
+	return res.SimilarSongs.Song, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// readOnlyErrno chooses the error returned for attempts to change the server's files
+var readOnlyErrno = flag.String("readonly-errno", "erofs", "Error returned for attempts to change the server's files: erofs, eacces or eperm, for applications which handle one better than another")
+
+// readOnlyErrnos maps each -readonly-errno to its error
+var readOnlyErrnos = map[string]fuse.Errno{
+	"erofs":  fuse.Errno(syscall.EROFS),
+	"eacces": fuse.Errno(syscall.EACCES),
+	"eperm":  fuse.Errno(syscall.EPERM),
+}
+
+// readOnlyError returns the error for an attempt to change the server's files, as chosen by -readonly-errno
+func readOnlyError() fuse.Error {
+	if errno, ok := readOnlyErrnos[*readOnlyErrno]; ok {
+		return errno
+	}
+	return fuse.Errno(syscall.EROFS)
+}
+
+// readOnlyDir refuses every change to a directory, because subfs is read-only.  Directory nodes embed
+// it, so that each refuses changes with the same error.
+type readOnlyDir struct{}
+
+// Create does nothing, because subfs is read-only
+func (readOnlyDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
+	return nil, nil, readOnlyError()
+}
+
+// Fsync does nothing, because subfs is read-only
+func (readOnlyDir) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Link does nothing, because subfs is read-only
+func (readOnlyDir) Link(req *fuse.LinkRequest, node fs.Node, intr fs.Intr) (fs.Node, fuse.Error) {
+	return nil, readOnlyError()
+}
+
+// Mkdir does nothing, because subfs is read-only
+func (readOnlyDir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	return nil, readOnlyError()
+}
+
+// Mknod does nothing, because subfs is read-only
+func (readOnlyDir) Mknod(req *fuse.MknodRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	return nil, readOnlyError()
+}
+
+// Remove does nothing, because subfs is read-only
+func (readOnlyDir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Removexattr does nothing, because subfs is read-only
+func (readOnlyDir) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Rename does nothing, because subfs is read-only
+func (readOnlyDir) Rename(req *fuse.RenameRequest, node fs.Node, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Setattr does nothing, because subfs is read-only
+func (readOnlyDir) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Setxattr does nothing, because subfs is read-only
+func (readOnlyDir) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Symlink does nothing, because subfs is read-only
+func (readOnlyDir) Symlink(req *fuse.SymlinkRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	return nil, readOnlyError()
+}
+
+// readOnlyFile refuses every change to a file, because subfs is read-only.  File nodes, and handles on
+// them, embed it, so that each refuses changes with the same error.
+type readOnlyFile struct{}
+
+// Fsync does nothing, because subfs is read-only
+func (readOnlyFile) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Removexattr does nothing, because subfs is read-only
+func (readOnlyFile) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Setattr does nothing, because subfs is read-only
+func (readOnlyFile) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Setxattr does nothing, because subfs is read-only
+func (readOnlyFile) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
+
+// Write does nothing, because subfs is read-only
+func (readOnlyFile) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	return readOnlyError()
+}
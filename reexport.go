@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// reexport gives nodes inode numbers derived from their server IDs, for sharing the mount over Samba or NFS
+var reexport = flag.Bool("reexport", false, "Give files and directories stable inode numbers derived from their server IDs, for re-exporting the mount over Samba or NFS")
+
+// stableInode hashes a node's identity into an inode number, steering clear of 0, which lets FUSE choose
+// one from the node's path, and 1, which is the root
+func stableInode(identity string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(identity))
+	if inode := h.Sum64(); inode > 1 {
+		return inode
+	}
+	return 2
+}
+
+// inode returns the stable inode number of this directory with -reexport, or 0 otherwise
+func (d SubDir) inode() uint64 {
+	if !*reexport {
+		return 0
+	}
+	return stableInode(fmt.Sprintf("dir/%s/%d/%t/%t", d.acct.Name, d.ID, d.Root, d.Folder))
+}
+
+// inode returns the stable inode number of this file with -reexport, or 0 otherwise.  Originals,
+// transcodes and art sizes of one song each get their own.
+func (s SubFile) inode() uint64 {
+	if !*reexport {
+		return 0
+	}
+	return stableInode(fmt.Sprintf("file/%s/%s", s.acct.Name, s.cacheKey()))
+}
+
+// virtualIdentity names a generated entry of this directory by its account and path, from which its stable
+// inode number is derived
+func (d SubDir) virtualIdentity(name string) string {
+	return d.acct.Name + d.Path + "/" + name
+}
+
+// placeVirtual gives a generated directory or file the identity its stable inode number is derived from,
+// with -reexport, as generated nodes have no server ID
+func placeVirtual(node fs.Node, identity string) fs.Node {
+	if !*reexport {
+		return node
+	}
+
+	switch n := node.(type) {
+	case VirtualDir:
+		n.identity = identity
+		return n
+	case VirtualFile:
+		n.identity = identity
+		return n
+	}
+	return node
+}
+
+// virtualInode returns the stable inode number of a generated node with -reexport, or 0 otherwise or if it
+// was reached without a path
+func virtualInode(identity string) uint64 {
+	if !*reexport || identity == "" {
+		return 0
+	}
+	return stableInode("virtual/" + identity)
+}
+
+// entryInode returns the stable inode number of a node listed under the given identity
+func entryInode(node fs.Node, identity string) uint64 {
+	switch n := node.(type) {
+	case SubDir:
+		return n.inode()
+	case SubFile:
+		return n.inode()
+	case VirtualDir, VirtualFile:
+		return virtualInode(identity)
+	}
+	return 0
+}
+
+// direntInodes fills in the inode numbers of listed directories and files with -reexport, so that they
+// match those reported by stat, as NFS and Samba clients expect
+func (d SubDir) direntInodes(directories []fuse.Dirent) []fuse.Dirent {
+	if !*reexport {
+		return directories
+	}
+
+	snapshot := d.listing.current()
+	if snapshot == nil {
+		return directories
+	}
+	for i, entry := range directories {
+		if dir, ok := snapshot.dirs[entry.Name]; ok {
+			directories[i].Inode = dir.inode()
+		} else if f, ok := snapshot.files[entry.Name]; ok {
+			directories[i].Inode = f.inode()
+		} else if node, ok := snapshot.virtual[entry.Name]; ok {
+			directories[i].Inode = entryInode(node, d.virtualIdentity(entry.Name))
+		}
+	}
+	return directories
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// TestVirtualInodes checks that with -reexport, generated directories and files are listed with the same
+// stable inode numbers stat reports for them, which differ between paths
+func TestVirtualInodes(t *testing.T) {
+	*reexport = true
+	defer func() { *reexport = false }()
+
+	file := newVirtualFile(time.Minute, func() ([]byte, error) { return []byte("generated"), nil })
+	root := newStaticDir(map[string]fs.Node{
+		"A": newStaticDir(map[string]fs.Node{"file.txt": file}),
+		"B": newStaticDir(map[string]fs.Node{"file.txt": file}),
+	})
+	root.identity = "Test/Root"
+
+	inodes := map[uint64]string{}
+	dirents, err := root.ReadDir(nil)
+	if err != nil {
+		t.Fatalf("could not list: %v", err)
+	}
+	for _, dirent := range dirents {
+		node, err := root.Lookup(dirent.Name, nil)
+		if err != nil {
+			t.Fatalf("could not find %s: %v", dirent.Name, err)
+		}
+		dir := node.(VirtualDir)
+		if inode := dir.Attr().Inode; inode == 0 || inode != dirent.Inode {
+			t.Fatalf("%s listed with inode %d, but stat reports %d", dirent.Name, dirent.Inode, inode)
+		}
+		inodes[dirent.Inode] = dirent.Name
+
+		node, err = dir.Lookup("file.txt", nil)
+		if err != nil {
+			t.Fatalf("could not find %s/file.txt: %v", dirent.Name, err)
+		}
+		inodes[node.Attr().Inode] = dirent.Name + "/file.txt"
+	}
+
+	if len(inodes) != 4 {
+		t.Fatalf("expected 4 distinct inodes, got %v", inodes)
+	}
+}
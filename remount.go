@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// remount enables remounting the filesystem when serving it fails, rather than exiting.  Unmounting it
+// cleanly always exits.
+var remount = flag.Bool("remount", true, "Unmount and remount automatically when the mount dies, instead of exiting; a clean unmount still exits")
+
+// maxRemountDelay is the longest wait between remount attempts
+const maxRemountDelay = time.Minute
+
+// serveMount mounts the filesystem at dir and serves it in the background, reporting when serving stops:
+// with nil once the connection ends, whether dir was unmounted or the kernel aborted it, or else with the
+// error which stopped it
+func (sfs *Filesystem) serveMount(dir string, serveChan chan<- error) (*fuse.Conn, error) {
+	c, err := fuse.Mount(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.StoreInt32(&sfs.alive, 1)
+	go func() {
+		serveChan <- fs.Serve(c, sfs)
+	}()
+	return c, nil
+}
+
+// mountEscapes decodes the octal escapes of spaces and other characters in /proc/self/mounts
+var mountEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// stillMounted reports whether dir is still a FUSE mount after serving it stopped, as when the kernel
+// aborted the connection, rather than it having been unmounted
+func stillMounted(dir string) bool {
+	// A mount whose connection was aborted can't even be looked at
+	if _, err := os.Stat(dir); err != nil {
+		if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOTCONN {
+			return true
+		}
+	}
+
+	data, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && mountEscapes.Replace(fields[1]) == abs && strings.HasPrefix(fields[2], "fuse") {
+			return true
+		}
+	}
+	return false
+}
+
+// remountWithBackoff cleans up a dead mount and mounts it again, waiting longer after each failed attempt
+func (sfs *Filesystem) remountWithBackoff(dir string, c *fuse.Conn, serveChan chan<- error) *fuse.Conn {
+	atomic.StoreInt32(&sfs.alive, 0)
+
+	delay := time.Second
+	for {
+		// Clean up whatever is left of the previous mount
+		if err := fuse.Unmount(dir); err != nil {
+			log.Printf("subfs: could not unmount %s: %s", dir, err.Error())
+		}
+		if c != nil {
+			c.Close()
+			c = nil
+		}
+
+		log.Printf("subfs: remounting %s in %s", dir, delay)
+		<-time.After(delay)
+
+		var err error
+		if c, err = sfs.serveMount(dir, serveChan); err == nil {
+			log.Printf("subfs: remounted %s", dir)
+			return c
+		}
+		log.Printf("subfs: could not remount %s: %s", dir, err.Error())
+
+		// Back off before trying again
+		delay *= 2
+		if delay > maxRemountDelay {
+			delay = maxRemountDelay
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"bazil.org/fuse"
+)
+
+// replayGainTags enables ReplayGain values in rewritten tags
+var replayGainTags = flag.Bool("replaygain-tags", false, "Include server-reported ReplayGain values in tags rewritten by -fix-tags")
+
+// replayGainSidecars adds a sidecar file of ReplayGain values beside each song the server reports them for
+var replayGainSidecars = flag.Bool("replaygain-sidecars", false, "Add <name>.replaygain files beside songs with server-reported ReplayGain values, for players which only read sidecars")
+
+// values returns ReplayGain values formatted as they appear in tags, keyed by tag name
+func (r *replayGain) values() map[string]string {
+	values := map[string]string{}
+	if r == nil {
+		return values
+	}
+
+	if r.TrackGain != nil {
+		values["REPLAYGAIN_TRACK_GAIN"] = fmt.Sprintf("%.2f dB", *r.TrackGain)
+	}
+	if r.TrackPeak != nil {
+		values["REPLAYGAIN_TRACK_PEAK"] = fmt.Sprintf("%.6f", *r.TrackPeak)
+	}
+	if r.AlbumGain != nil {
+		values["REPLAYGAIN_ALBUM_GAIN"] = fmt.Sprintf("%.2f dB", *r.AlbumGain)
+	}
+	if r.AlbumPeak != nil {
+		values["REPLAYGAIN_ALBUM_PEAK"] = fmt.Sprintf("%.6f", *r.AlbumPeak)
+	}
+
+	return values
+}
+
+// r128Gain converts a ReplayGain gain, relative to 89 dB SPL, into an Opus R128 gain, relative to -23 LUFS
+// in Q7.8 fixed point
+func r128Gain(gain float64) int64 {
+	return int64(math.Floor((gain-5)*256 + 0.5))
+}
+
+// sidecar formats ReplayGain values as TAG=value lines, along with their R128 equivalents
+func (r *replayGain) sidecar() []byte {
+	values := r.values()
+	if r.TrackGain != nil {
+		values["R128_TRACK_GAIN"] = fmt.Sprintf("%d", r128Gain(*r.TrackGain))
+	}
+	if r.AlbumGain != nil {
+		values["R128_ALBUM_GAIN"] = fmt.Sprintf("%d", r128Gain(*r.AlbumGain))
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s=%s\n", name, values[name])
+	}
+	return buf.Bytes()
+}
+
+// addReplayGainFiles adds a .replaygain sidecar beside each file of this directory with ReplayGain values
+func (d SubDir) addReplayGainFiles(directories []fuse.Dirent) []fuse.Dirent {
+	added := map[string]bool{}
+	for name, f := range d.files {
+		if f.IsArt || f.ReplayGain == nil || len(f.ReplayGain.values()) == 0 {
+			continue
+		}
+
+		sidecarName := strings.TrimSuffix(name, "."+f.Suffix) + ".replaygain"
+		if added[sidecarName] {
+			continue
+		}
+		added[sidecarName] = true
+
+		// Originals and transcodes of a song share one sidecar
+		r := f.ReplayGain
+		d.virtual[sidecarName] = newVirtualFile(0, func() ([]byte, error) {
+			return r.sidecar(), nil
+		})
+		directories = append(directories, fuse.Dirent{
+			Name: sidecarName,
+			Type: fuse.DT_File,
+		})
+	}
+	return directories
+}
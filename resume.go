@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// downloadRetries is the number of times an interrupted download is resumed before giving up
+var downloadRetries = flag.Int("download-retries", 3, "Number of times to resume an interrupted download before failing the read")
+
+// resumingReader reads a file's stream, reopening it from the last received byte when it fails partway
+type resumingReader struct {
+	file    SubFile
+	stream  io.ReadCloser
+	offset  int64
+	retries int
+}
+
+// resumeStream wraps a stream opened for a file, so that interrupted transfers are resumed
+func resumeStream(s SubFile, stream io.ReadCloser) io.ReadCloser {
+	return &resumingReader{
+		file:    s,
+		stream:  stream,
+		retries: *downloadRetries,
+	}
+}
+
+// Read reads from the stream, resuming it with a Range request on failure while retries remain
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.stream.Read(p)
+		r.offset += int64(n)
+		if err == nil || err == io.EOF || r.retries == 0 {
+			return n, err
+		}
+
+		// Hand back what was received before resuming
+		r.retries--
+		log.Printf("Resuming download at %d bytes: [%d] %s: %s", r.offset, r.file.ID, r.file.FileName, err.Error())
+		if resumeErr := r.resume(); resumeErr != nil {
+			log.Printf("Could not resume download: [%d] %s: %s", r.file.ID, r.file.FileName, resumeErr.Error())
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the stream at the current offset, skipping already received bytes if the server
+// doesn't support ranges
+func (r *resumingReader) resume() error {
+	r.stream.Close()
+
+	stream, partial, err := r.file.openStreamAt(r.offset)
+	if err != nil {
+		return err
+	}
+
+	if !partial {
+		if _, err := io.CopyN(ioutil.Discard, stream, r.offset); err != nil {
+			stream.Close()
+			return err
+		}
+	}
+
+	r.stream = stream
+	return nil
+}
+
+// Close closes the current stream
+func (r *resumingReader) Close() error {
+	return r.stream.Close()
+}
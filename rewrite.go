@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rewriteRules are the compiled metadata rewrite rules from the configuration file
+var rewriteRules []rewriteRule
+
+// rewriteRule is a compiled RewriteConfig
+type rewriteRule struct {
+	field   string
+	pattern *regexp.Regexp
+	replace string
+}
+
+// compileRewrites compiles the metadata rewrite rules from the configuration file
+func compileRewrites(configs []RewriteConfig) error {
+	for _, c := range configs {
+		switch c.Field {
+		case "artist", "album", "title":
+		default:
+			return fmt.Errorf("rewrite rule %q: unknown field %q", c.Pattern, c.Field)
+		}
+
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return err
+		}
+
+		rewriteRules = append(rewriteRules, rewriteRule{
+			field:   c.Field,
+			pattern: re,
+			replace: c.Replace,
+		})
+	}
+	return nil
+}
+
+// rewrite applies every rule for a field to a string, in order
+func rewrite(field string, s string) string {
+	for _, r := range rewriteRules {
+		if r.field == field {
+			s = r.pattern.ReplaceAllString(s, r.replace)
+		}
+	}
+	return s
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// searchCount is the most artists, albums and songs each listed for a search
+var searchCount = flag.Int("search-results", 50, "Most artists, albums and songs each listed in .subfs/results for a query written to .subfs/search")
+
+// searchResults holds the latest query written to .subfs/search, and what the server found for it
+type searchResults struct {
+	sync.Mutex
+	query string
+	items *starredItems
+}
+
+// run asks the server for a query, keeping what it finds as the latest results.  An empty query clears them.
+func (r *searchResults) run(a *account, query string) error {
+	items := &starredItems{}
+	if query != "" {
+		params := url.Values{}
+		params.Set("query", query)
+		params.Set("artistCount", strconv.Itoa(*searchCount))
+		params.Set("albumCount", strconv.Itoa(*searchCount))
+		params.Set("songCount", strconv.Itoa(*searchCount))
+
+		var res struct {
+			SearchResult starredItems `json:"searchResult2"`
+		}
+		if err := apiGet(a, "search2", params, &res); err != nil {
+			log.Printf("subfs: failed to search for %q: %s", query, err.Error())
+			return err
+		}
+		items = &res.SearchResult
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.query = query
+	r.items = items
+	return nil
+}
+
+// latest returns the latest query and its results, which are empty before the first search
+func (r *searchResults) latest() (string, *starredItems) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.items == nil {
+		return r.query, &starredItems{}
+	}
+	return r.query, r.items
+}
+
+// newResultsDir returns .subfs/results, listing the Artists, Albums and Songs found by the latest search
+func newResultsDir(a *account) VirtualDir {
+	return newStaticDir(itemDirs(a, func() (*starredItems, error) {
+		_, items := a.searches.latest()
+		return items, nil
+	}))
+}
+
+// SearchFile is .subfs/search, which searches the server for each query written to it, such as with
+// echo "miles davis" > .subfs/search, and reads back the latest query
+type SearchFile struct {
+	readOnlyFile
+
+	acct *account
+}
+
+// content returns the latest query, as read back from the file
+func (f SearchFile) content() []byte {
+	query, _ := f.acct.searches.latest()
+	if query == "" {
+		return []byte{}
+	}
+	return []byte(query + "\n")
+}
+
+// Attr returns the attributes of the file, which is writable
+func (f SearchFile) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: 0644,
+		Size: uint64(len(f.content())),
+	}
+}
+
+// Open returns a handle which reads the latest query, or takes a new one
+func (f SearchFile) Open(req *fuse.OpenRequest, resp *fuse.OpenResponse, intr fs.Intr) (fs.Handle, fuse.Error) {
+	return &searchHandle{acct: f.acct}, nil
+}
+
+// Setattr accepts the truncation preceding a write, as a new query replaces the latest one anyway
+func (f SearchFile) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	resp.Attr = f.Attr()
+	return nil
+}
+
+// searchHandle is an open .subfs/search, gathering a query written to it until it is flushed
+type searchHandle struct {
+	acct *account
+
+	lock    sync.Mutex
+	query   bytes.Buffer
+	written bool
+}
+
+// Read reads back the latest query
+func (h *searchHandle) Read(req *fuse.ReadRequest, resp *fuse.ReadResponse, intr fs.Intr) fuse.Error {
+	content := SearchFile{acct: h.acct}.content()
+	if req.Offset >= int64(len(content)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(content)) {
+		end = int64(len(content))
+	}
+	resp.Data = content[req.Offset:end]
+	return nil
+}
+
+// Write gathers part of a query, which is run once the file is flushed
+func (h *searchHandle) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.query.Write(req.Data)
+	h.written = true
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush runs the query written, if any, failing the close if the server can't be searched
+func (h *searchHandle) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.written {
+		return nil
+	}
+	h.written = false
+
+	query := strings.TrimSpace(h.query.String())
+	h.query.Reset()
+	_, err := withDeadline("search for "+query, intr, func() (interface{}, fuse.Error) {
+		if err := h.acct.searches.run(h.acct, query); err != nil {
+			return nil, fuseError(err)
+		}
+		return nil, nil
+	})
+	return err
+}
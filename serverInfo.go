@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// serverInfo describes the server beyond whether it is reachable, as shown in .subfs/server
+type serverInfo struct {
+	// APIVersion is the Subsonic API version reported by ping, and ServerVersion the implementation's own
+	APIVersion    string
+	ServerVersion string
+
+	// licensed is set once getLicense has answered, since servers without licenses don't implement it
+	licensed       bool
+	LicenseValid   bool
+	LicenseExpires time.Time
+
+	// scanned is set once getScanStatus has answered, with LastScan only known to some servers
+	scanned  bool
+	Scanning bool
+	Count    int64
+	LastScan time.Time
+}
+
+// apiLicense is the license returned by getLicense
+type apiLicense struct {
+	Valid          bool    `json:"valid"`
+	LicenseExpires apiTime `json:"licenseExpires"`
+}
+
+// apiScanStatus is the state of the library scan returned by getScanStatus
+type apiScanStatus struct {
+	Scanning bool    `json:"scanning"`
+	Count    int64   `json:"count"`
+	LastScan apiTime `json:"lastScan"`
+}
+
+// refreshServerInfo records the versions from a ping response, and fetches the license and scan status
+// again.  Methods the server lacks leave their part unknown rather than failing the watchdog.
+func (a *account) refreshServerInfo(apiVersion string, serverVersion string) {
+	info := serverInfo{
+		APIVersion:    apiVersion,
+		ServerVersion: serverVersion,
+	}
+
+	var license struct {
+		License apiLicense `json:"license"`
+	}
+	if err := apiGet(a, "getLicense", url.Values{}, &license); err == nil {
+		info.licensed = true
+		info.LicenseValid = license.License.Valid
+		info.LicenseExpires = license.License.LicenseExpires.Time
+	} else {
+		debugf("subfs: could not get license for %s: %s", a.Name, err.Error())
+	}
+
+	// Servers too old for getScanStatus leave the scan unknown
+	if a.supports("getScanStatus") {
+		var scan struct {
+			ScanStatus apiScanStatus `json:"scanStatus"`
+		}
+		if err := apiGet(a, "getScanStatus", url.Values{}, &scan); err == nil {
+			info.scanned = true
+			info.Scanning = scan.ScanStatus.Scanning
+			info.Count = scan.ScanStatus.Count
+			info.LastScan = scan.ScanStatus.LastScan.Time
+		} else {
+			debugf("subfs: could not get scan status for %s: %s", a.Name, err.Error())
+		}
+	}
+
+	a.infoLock.Lock()
+	a.info = info
+	a.infoLock.Unlock()
+}
+
+// serverInfo returns the most recently gathered description of the server
+func (a *account) serverInfo() serverInfo {
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	return a.info
+}
+
+// text formats server info for .subfs/server, omitting whatever the server didn't report
+func (info serverInfo) text() []byte {
+	var buf bytes.Buffer
+	if info.APIVersion != "" {
+		fmt.Fprintf(&buf, "api version: %s\n", info.APIVersion)
+	}
+	if info.ServerVersion != "" {
+		fmt.Fprintf(&buf, "server version: %s\n", info.ServerVersion)
+	}
+
+	if info.licensed {
+		license := "valid"
+		if !info.LicenseValid {
+			license = "invalid"
+		}
+		if !info.LicenseExpires.IsZero() {
+			license += ", expires " + info.LicenseExpires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(&buf, "license: %s\n", license)
+	}
+
+	if info.scanned {
+		fmt.Fprintf(&buf, "scanning: %t\nsongs scanned: %d\n", info.Scanning, info.Count)
+		if !info.LastScan.IsZero() {
+			fmt.Fprintf(&buf, "last scan: %s\n", info.LastScan.Format(time.RFC3339))
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// shutdownTimeout bounds how long subfs takes to exit once asked to, after which the mount is detached
+// lazily and whatever is left of the cache is abandoned
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Longest time taken to unmount and clean up the cache at exit, after which the mount is detached lazily")
+
+// unmountRetry is the delay between attempts to unmount while files are still in use
+const unmountRetry = 250 * time.Millisecond
+
+// unmount unmounts dir, retrying until deadline while it is busy, and then detaching it lazily, so that
+// it disappears once the processes using it let go
+func unmount(dir string, deadline time.Time) error {
+	for attempt := 1; ; attempt++ {
+		err := fuse.Unmount(dir)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(unmountRetry).After(deadline) {
+			log.Printf("subfs: could not unmount %s after %d attempt(s), detaching it lazily: %s", dir, attempt, err.Error())
+			return lazyUnmount(dir)
+		}
+		<-time.After(unmountRetry)
+	}
+}
+
+// lazyUnmount detaches dir at once, leaving processes which still use it to finish
+func lazyUnmount(dir string) error {
+	cmd := exec.Command("umount", "-f", dir)
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("fusermount", "-u", "-z", dir)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// releaseCache releases the cached files at exit, giving up at deadline so that exiting never hangs on a
+// slow disk.  Files left behind in a -cache-dir are collected at the next mount.
+func (sfs *Filesystem) releaseCache(deadline time.Time) {
+	// Sizes still waiting to be saved are saved now
+	if err := sfs.sizes.flush(); err != nil {
+		log.Printf("subfs: could not save sizes: %s", err.Error())
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- sfs.cache.Close()
+	}()
+
+	select {
+	case count := <-done:
+		log.Printf("subfs: released %d cached file(s)", count)
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Printf("subfs: gave up releasing cached files after -shutdown-timeout")
+	}
+}
+
+// unmounted cleans up after dir was unmounted from outside, unmounting any views and releasing the cache
+// within -shutdown-timeout
+func (sfs *Filesystem) unmounted(c *fuse.Conn) {
+	deadline := time.Now().Add(*shutdownTimeout)
+
+	sfs.unmountViews(deadline)
+	if err := c.Close(); err != nil {
+		log.Printf("subfs: could not close connection: %s", err.Error())
+	}
+	sfs.releaseCache(deadline)
+}
+
+// shutdown unmounts any views and then dir, and releases the cache, within -shutdown-timeout, exiting
+// nonzero if the mount can't even be detached
+func (sfs *Filesystem) shutdown(dir string, c *fuse.Conn) {
+	deadline := time.Now().Add(*shutdownTimeout)
+
+	sfs.unmountViews(deadline)
+	if err := unmount(dir, deadline); err != nil {
+		log.Printf("subfs: could not unmount %s, halting! %s", dir, err.Error())
+		sfs.releaseCache(deadline)
+		os.Exit(1)
+	}
+
+	// Close the FUSE filesystem
+	if err := c.Close(); err != nil {
+		log.Printf("subfs: could not close connection: %s", err.Error())
+	}
+
+	// Release the cached files, leaving any still open through a lazily detached mount
+	sfs.releaseCache(deadline)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+)
+
+// flightGroup deduplicates concurrent calls which share a key, so that only one call is in flight
+// at a time and every caller waiting on that key receives its result
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is an in-flight or completed call within a flightGroup
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// Do executes fn for key, unless a call for key is already in flight, in which case it waits for
+// that call and returns its result instead
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+
+	// Wait on the call already in flight
+	if c, ok := g.calls[key]; ok {
+		g.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.Unlock()
+
+	c.val, c.err = fn()
+	c.wg.Done()
+
+	// Forget the call so later requests fetch fresh results
+	g.Lock()
+	delete(g.calls, key)
+	g.Unlock()
+
+	return c.val, c.err
+}
+
+// inFlight returns the number of calls currently in flight
+func (g *flightGroup) inFlight() int {
+	g.Lock()
+	defer g.Unlock()
+	return len(g.calls)
+}
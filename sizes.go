@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sizesPath is the file remembering the actual sizes of files whose size was estimated, such as transcodes
+var sizesPath = flag.String("sizes", filepath.Join(os.Getenv("HOME"), ".subfs-sizes.json"), "File remembering the actual sizes of transcoded files once read, or empty to forget them at exit")
+
+// sizesSaveDelay is how long changed sizes wait before being saved, so that reads finishing together are
+// saved in one write
+const sizesSaveDelay = 5 * time.Second
+
+// sizeStore holds the actual sizes of files found when reading them, keyed by account name and cache key,
+// so that transcodes and originals of one song keep separate sizes, and saved to sizesPath shortly after
+// they change
+type sizeStore struct {
+	sync.RWMutex
+	path  string
+	sizes map[string]int64
+
+	// saveLock serializes saves, and pending is set while a save is scheduled
+	saveLock sync.Mutex
+	pending  bool
+}
+
+// loadSizes reads the sizes saved at path, starting afresh if there are none
+func loadSizes(path string) *sizeStore {
+	st := &sizeStore{
+		path:  path,
+		sizes: map[string]int64{},
+	}
+	if path == "" {
+		return st
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("subfs: could not read sizes: %s", err.Error())
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, &st.sizes); err != nil {
+		log.Printf("subfs: could not parse sizes %s: %s", path, err.Error())
+	}
+	return st
+}
+
+// sizeKey identifies a file's size
+func sizeKey(s SubFile) string {
+	return s.accountKey()
+}
+
+// get returns the actual size of a file, if known
+func (st *sizeStore) get(s SubFile) (int64, bool) {
+	st.RLock()
+	defer st.RUnlock()
+	size, ok := st.sizes[sizeKey(s)]
+	return size, ok
+}
+
+// set records the actual size of a file, scheduling a save unless one is already pending
+func (st *sizeStore) set(s SubFile, size int64) {
+	st.Lock()
+	defer st.Unlock()
+
+	st.sizes[sizeKey(s)] = size
+	if st.path == "" || st.pending {
+		return
+	}
+	st.pending = true
+	time.AfterFunc(sizesSaveDelay, func() {
+		if err := st.flush(); err != nil {
+			log.Printf("subfs: could not save sizes: %s", err.Error())
+		}
+	})
+}
+
+// flush saves the sizes if any changed since the last save, as at exit
+func (st *sizeStore) flush() error {
+	st.Lock()
+	pending := st.pending
+	st.pending = false
+	st.Unlock()
+
+	if !pending {
+		return nil
+	}
+	return st.save()
+}
+
+// save writes every size to disk, replacing the previous file atomically.  Saves are serialized, so that
+// an older snapshot never replaces a newer one.
+func (st *sizeStore) save() error {
+	if st.path == "" {
+		return nil
+	}
+
+	st.saveLock.Lock()
+	defer st.saveLock.Unlock()
+
+	st.RLock()
+	data, err := json.Marshal(st.sizes)
+	st.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// Write to a file of its own beside the sizes, which is renamed over them once complete
+	tmp, err := ioutil.TempFile(filepath.Dir(st.path), filepath.Base(st.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), st.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// smartPlaylistTTL is how long the songs chosen for a smart playlist are kept before asking the server again
+const smartPlaylistTTL = 10 * time.Minute
+
+// smartPlaylist is a smart playlist for an account, along with its most recently chosen songs
+type smartPlaylist struct {
+	sync.Mutex
+	acct    *account
+	config  SmartPlaylistConfig
+	songs   []apiChild
+	fetched time.Time
+}
+
+// newSmartPlaylistsDir returns a directory holding a subdirectory and m3u file for each smart playlist
+func newSmartPlaylistsDir(a *account) VirtualDir {
+	entries := map[string]fs.Node{}
+	for _, config := range a.smartPlaylists {
+		p := &smartPlaylist{
+			acct:   a,
+			config: config,
+		}
+
+		name := sanitizeName(config.Name)
+		entries[name] = VirtualDir{entries: p.entries}
+		entries[name+".m3u"] = newVirtualFile(smartPlaylistTTL, func() ([]byte, error) {
+			songs, err := p.evaluate()
+			if err != nil {
+				return nil, err
+			}
+			return playlistM3U(p.acct, songs), nil
+		})
+	}
+	return newStaticDir(entries)
+}
+
+// entries returns a file for each song in the playlist, prefixed by its position
+func (p *smartPlaylist) entries() (map[string]fs.Node, error) {
+	songs, err := p.evaluate()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]fs.Node{}
+	for i, c := range songs {
+		filename, err := p.acct.sfs.formatFilename(c.audio(), c.Suffix, c.starred())
+		if err != nil || filename == "" {
+			continue
+		}
+		filename = fmt.Sprintf("%02d - %s", i+1, filename)
+
+		f := newAudioFile(p.acct, c, true)
+		f.FileName = filename
+		entries[filename] = f
+	}
+	return entries, nil
+}
+
+// evaluate returns the songs matching the playlist, asking the server again once the previous result expires
+func (p *smartPlaylist) evaluate() ([]apiChild, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.songs != nil && time.Since(p.fetched) < smartPlaylistTTL {
+		return p.songs, nil
+	}
+
+	var songs []apiChild
+	var err error
+	if p.config.Order == "newest" {
+		songs, err = p.newestSongs()
+	} else {
+		songs, err = p.randomSongs()
+	}
+	if err != nil {
+		log.Printf("subfs: failed to evaluate smart playlist %s: %s", p.config.Name, err.Error())
+		return nil, err
+	}
+
+	p.songs = songs
+	p.fetched = time.Now()
+	return songs, nil
+}
+
+// size returns the number of songs in the playlist
+func (p *smartPlaylist) size() int {
+	if p.config.Size > 0 {
+		return p.config.Size
+	}
+	return 50
+}
+
+// matches reports whether a song passes the playlist's filters
+func (p *smartPlaylist) matches(c apiChild) bool {
+	if p.config.Genre != "" && c.Genre != p.config.Genre {
+		return false
+	}
+	if p.config.FromYear != 0 && c.Year < p.config.FromYear {
+		return false
+	}
+	if p.config.ToYear != 0 && c.Year > p.config.ToYear {
+		return false
+	}
+	return c.UserRating >= p.config.MinRating
+}
+
+// filter returns up to size songs which pass the playlist's filters
+func (p *smartPlaylist) filter(songs []apiChild, chosen []apiChild) []apiChild {
+	for _, c := range songs {
+		if len(chosen) >= p.size() {
+			break
+		}
+		if p.matches(c) {
+			chosen = append(chosen, c)
+		}
+	}
+	return chosen
+}
+
+// randomSongs chooses songs using getRandomSongs, which filters by genre and year on the server
+func (p *smartPlaylist) randomSongs() ([]apiChild, error) {
+	params := url.Values{}
+	params.Set("size", strconv.Itoa(p.size()))
+	if p.config.Genre != "" {
+		params.Set("genre", p.config.Genre)
+	}
+	if p.config.FromYear != 0 {
+		params.Set("fromYear", strconv.FormatInt(p.config.FromYear, 10))
+	}
+	if p.config.ToYear != 0 {
+		params.Set("toYear", strconv.FormatInt(p.config.ToYear, 10))
+	}
+
+	// Ratings can't be filtered by the server, so ask for as many songs as allowed and filter them here
+	if p.config.MinRating > 0 {
+		params.Set("size", "500")
+	}
+
+	var res struct {
+		RandomSongs struct {
+			Song []apiChild `json:"song"`
+		} `json:"randomSongs"`
+	}
+	if err := apiGet(p.acct, "getRandomSongs", params, &res); err != nil {
+		return nil, err
+	}
+
+	return p.filter(res.RandomSongs.Song, []apiChild{}), nil
+}
+
+// newestSongs chooses songs from the most recently added albums, using getAlbumList2 and getAlbum
+func (p *smartPlaylist) newestSongs() ([]apiChild, error) {
+	chosen := []apiChild{}
+
+	// Page through recently added albums, giving up after a few pages of albums without enough matches
+	for offset := 0; offset < 500 && len(chosen) < p.size(); offset += 50 {
+		params := url.Values{}
+		params.Set("type", "newest")
+		params.Set("size", "50")
+		params.Set("offset", strconv.Itoa(offset))
+
+		var list struct {
+			AlbumList struct {
+				Album []apiChild `json:"album"`
+			} `json:"albumList2"`
+		}
+		if err := apiGet(p.acct, "getAlbumList2", params, &list); err != nil {
+			return nil, err
+		}
+		if len(list.AlbumList.Album) == 0 {
+			break
+		}
+
+		for _, album := range list.AlbumList.Album {
+			if len(chosen) >= p.size() {
+				break
+			}
+
+			// Skip whole albums known to be outside the year range or genre
+			if album.Genre != "" && p.config.Genre != "" && album.Genre != p.config.Genre {
+				continue
+			}
+			if album.Year != 0 && ((p.config.FromYear != 0 && album.Year < p.config.FromYear) ||
+				(p.config.ToYear != 0 && album.Year > p.config.ToYear)) {
+				continue
+			}
+
+			params := url.Values{}
+			params.Set("id", strconv.FormatInt(int64(album.ID), 10))
+
+			var res struct {
+				Album struct {
+					Song []apiChild `json:"song"`
+				} `json:"album"`
+			}
+			if err := apiGet(p.acct, "getAlbum", params, &res); err != nil {
+				return nil, err
+			}
+
+			chosen = p.filter(res.Album.Song, chosen)
+		}
+	}
+
+	return chosen, nil
+}
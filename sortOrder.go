@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// sortOrder chooses the order of directory entries, as many simple players play files in readdir order
+var sortOrder = flag.String("sort", "server", "Order of directory entries: server, name, track or added")
+
+// sortPrefix prefixes audio files with their position, so that they also sort correctly by name
+var sortPrefix = flag.Bool("sort-prefix", false, "Prefix audio filenames with their zero-padded position in the -sort order")
+
+// sortStarred lists starred entries before the others, so that favorites are found first even by name
+var sortStarred = flag.Bool("sort-starred", false, "List starred albums and songs first within each directory, in the -sort order")
+
+// direntSorter sorts directory entries with a comparison function, keeping the server's order for ties
+type direntSorter struct {
+	entries []fuse.Dirent
+	less    func(a, b fuse.Dirent) bool
+}
+
+func (s direntSorter) Len() int           { return len(s.entries) }
+func (s direntSorter) Swap(i, j int)      { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s direntSorter) Less(i, j int) bool { return s.less(s.entries[i], s.entries[j]) }
+
+// sortEntries orders the entries of this directory according to -sort, or by track for audiobooks, then
+// applies -sort-starred and -sort-prefix
+func (d SubDir) sortEntries(directories []fuse.Dirent, listing *musicDirectory) []fuse.Dirent {
+	// Directories come before files, in every order but the server's
+	dirFirst := func(a, b fuse.Dirent) (bool, bool) {
+		if a.Type != b.Type {
+			return a.Type == fuse.DT_Dir, true
+		}
+		return false, false
+	}
+
+	// Audiobooks are always listed in chapter order
+	order := *sortOrder
+	if d.Audiobook {
+		order = "track"
+	}
+
+	switch order {
+	case "server":
+		// Albums are still collated under -collate, leaving songs in the server's order
+		if nameCollator() != nil {
+			nameLess := direntNameLess(directories)
+			sort.Stable(direntSorter{directories, func(a, b fuse.Dirent) bool {
+				if less, ok := dirFirst(a, b); ok {
+					return less
+				}
+				return a.Type == fuse.DT_Dir && nameLess(a.Name, b.Name)
+			}})
+		}
+	case "name":
+		nameLess := direntNameLess(directories)
+		sort.Stable(direntSorter{directories, func(a, b fuse.Dirent) bool {
+			if less, ok := dirFirst(a, b); ok {
+				return less
+			}
+			return nameLess(a.Name, b.Name)
+		}})
+	case "track":
+		sort.Stable(direntSorter{directories, func(a, b fuse.Dirent) bool {
+			if less, ok := dirFirst(a, b); ok {
+				return less
+			}
+			return d.entryTrack(a.Name) < d.entryTrack(b.Name)
+		}})
+	case "added":
+		sort.Stable(direntSorter{directories, func(a, b fuse.Dirent) bool {
+			if less, ok := dirFirst(a, b); ok {
+				return less
+			}
+			return d.entryCreated(a.Name, listing).Before(d.entryCreated(b.Name, listing))
+		}})
+	}
+
+	// Starred entries move ahead of the rest, keeping the order above within each
+	if *sortStarred && !d.Audiobook {
+		sort.Stable(direntSorter{directories, func(a, b fuse.Dirent) bool {
+			if order != "server" {
+				if less, ok := dirFirst(a, b); ok {
+					return less
+				}
+			}
+			return d.entryStarred(a.Name, listing) && !d.entryStarred(b.Name, listing)
+		}})
+	}
+
+	if *sortPrefix {
+		d.prefixEntries(directories)
+	}
+	return directories
+}
+
+// entryTrack returns the track number of a file in this directory, ordering files without one last
+func (d SubDir) entryTrack(name string) int64 {
+	if f, ok := d.files[name]; ok && !f.IsArt && f.Tags.Track > 0 {
+		return f.Tags.Track
+	}
+	return 1 << 62
+}
+
+// entryCreated returns the time an entry of this directory was added to the server
+func (d SubDir) entryCreated(name string, listing *musicDirectory) time.Time {
+	if f, ok := d.files[name]; ok {
+		return f.Created
+	}
+	if sub, ok := d.dirs[name]; ok {
+		return listing.Children[sub.ID].Created.Time
+	}
+	return time.Time{}
+}
+
+// entryStarred returns whether the user has starred an entry of this directory
+func (d SubDir) entryStarred(name string, listing *musicDirectory) bool {
+	if f, ok := d.files[name]; ok {
+		return f.Starred
+	}
+	if sub, ok := d.dirs[name]; ok {
+		return listing.Children[sub.ID].starred()
+	}
+	return false
+}
+
+// prefixEntries renames the audio files of this directory with their zero-padded position, in place
+func (d SubDir) prefixEntries(directories []fuse.Dirent) {
+	// Count the audio files to find the width of the prefix
+	count := 0
+	for _, e := range directories {
+		if f, ok := d.files[e.Name]; ok && !f.IsArt {
+			count++
+		}
+	}
+	width := len(strconv.Itoa(count))
+	if width < 2 {
+		width = 2
+	}
+
+	position := 0
+	for i, e := range directories {
+		f, ok := d.files[e.Name]
+		if !ok || f.IsArt {
+			continue
+		}
+		position++
+
+		name := fmt.Sprintf("%0*d %s", width, position, e.Name)
+		delete(d.files, e.Name)
+		f.FileName = name
+		d.files[name] = f
+		directories[i].Name = name
+	}
+}
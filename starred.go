@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// starredView adds the Starred directory
+var starredView = flag.Bool("starred", false, "Add a Starred directory of starred artists, albums and songs")
+
+// starredTTL is how long starred items are kept before asking the server again
+const starredTTL = 5 * time.Minute
+
+// starredItems are the artists, albums and songs starred by the user, as returned by getStarred, or found
+// by search2
+type starredItems struct {
+	Artist []struct {
+		ID   apiInt `json:"id"`
+		Name string `json:"name"`
+	} `json:"artist"`
+	Album []apiChild `json:"album"`
+	Song  []apiChild `json:"song"`
+}
+
+// newStarredDir returns the Starred directory, split into Artists, Albums and Songs so that starred
+// songs aren't buried among whole albums.  The three share a single getStarred request.
+func newStarredDir(a *account) VirtualDir {
+	cache := struct {
+		sync.Mutex
+		items   *starredItems
+		fetched time.Time
+	}{}
+	starred := func() (*starredItems, error) {
+		cache.Lock()
+		defer cache.Unlock()
+
+		if cache.items != nil && time.Since(cache.fetched) < starredTTL {
+			return cache.items, nil
+		}
+
+		var res struct {
+			Starred starredItems `json:"starred"`
+		}
+		if err := apiGet(a, "getStarred", url.Values{}, &res); err != nil {
+			log.Printf("subfs: failed to retrieve starred items: %s", err.Error())
+			return nil, err
+		}
+
+		cache.items = &res.Starred
+		cache.fetched = time.Now()
+		return cache.items, nil
+	}
+
+	return newStaticDir(itemDirs(a, starred))
+}
+
+// itemDirs returns the Artists, Albums and Songs directories listing the items returned by fetch, as
+// for Starred or for a search
+func itemDirs(a *account, fetch func() (*starredItems, error)) map[string]fs.Node {
+	return map[string]fs.Node{
+		"Artists": VirtualDir{entries: func() (map[string]fs.Node, error) {
+			items, err := fetch()
+			if err != nil {
+				return nil, err
+			}
+
+			entries := map[string]fs.Node{}
+			for _, artist := range items.Artist {
+				name := limitName(sanitizeName(artistDisplayName(rewrite("artist", artist.Name))), int64(artist.ID))
+				sub := NewSubDir(a, int64(artist.ID), false, false)
+				sub.Name = name
+				entries[name] = sub
+			}
+			return entries, nil
+		}},
+		"Albums": VirtualDir{entries: func() (map[string]fs.Node, error) {
+			items, err := fetch()
+			if err != nil {
+				return nil, err
+			}
+
+			entries := map[string]fs.Node{}
+			for _, album := range items.Album {
+				name := a.sfs.formatDirname(album, fmt.Sprintf("%s - %s", rewrite("artist", album.Artist), rewrite("album", album.Title)))
+				sub := NewSubDir(a, int64(album.ID), false, false)
+				sub.Name = name
+				sub.Modified = album.modified()
+				sub.CoverArt = int64(album.CoverArt)
+				entries[name] = sub
+			}
+			return entries, nil
+		}},
+		"Songs": VirtualDir{entries: func() (map[string]fs.Node, error) {
+			items, err := fetch()
+			if err != nil {
+				return nil, err
+			}
+
+			entries := map[string]fs.Node{}
+			for _, c := range items.Song {
+				filename, err := a.sfs.formatFilename(c.audio(), c.Suffix, c.starred())
+				if err != nil || filename == "" {
+					continue
+				}
+				f := newAudioFile(a, c, true)
+				f.FileName = filename
+				entries[filename] = f
+			}
+			return entries, nil
+		}},
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// logStats logs a snapshot of cache usage, open handles, in-flight downloads, and index age
+func (sfs *Filesystem) logStats() {
+	for _, line := range sfs.stats() {
+		log.Printf("stats: %s", line)
+	}
+}
+
+// stats describes cache usage, open handles, in-flight downloads, and index age, one line each
+func (sfs *Filesystem) stats() []string {
+	stats := sfs.cache.Stats()
+
+	inFlight := sfs.streamFlight.inFlight()
+
+	cacheUse := float64(stats.Bytes) / 1024 / 1024
+	lines := []string{
+		fmt.Sprintf("cache: %d file(s), %0.3f / %d.000 MB", stats.Files, cacheUse, *cacheSize),
+		fmt.Sprintf("open handles: %d", atomic.LoadInt64(&sfs.openHandles)),
+		fmt.Sprintf("in-flight downloads: %d", inFlight),
+	}
+
+	for _, a := range sfs.accounts {
+		// Index age is unknown until the first refresh completes
+		updated := atomic.LoadInt64(&a.indexUpdated)
+		if updated == 0 {
+			lines = append(lines, fmt.Sprintf("index age [%s]: not yet loaded", a.Name))
+			continue
+		}
+		age := time.Since(time.Unix(updated, 0))
+		lines = append(lines, fmt.Sprintf("index age [%s]: %s", a.Name, age-age%time.Second))
+	}
+	return lines
+}
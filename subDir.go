@@ -1,13 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -17,160 +20,453 @@ import (
 
 // SubDir represents a directory in the filesystem
 type SubDir struct {
-	ID      int64
-	Root    bool
-	Folder  bool
+	readOnlyDir
+
+	acct     *account
+	ID       int64
+	Name     string
+	Modified time.Time
+	Root     bool
+	Folder   bool
+	CoverArt int64
+
+	// Path of this directory below the account's root, and whether it lies below an audiobook prefix
+	Path      string
+	Audiobook bool
+
+	// Artist is the server's name for the artist of an artist directory, for -artist-separators
+	Artist string
+
+	// generation is that of the index this directory was listed from, or 0 outside the account's tree
+	generation int64
+
+	// dirs, files, virtual and totals are filled in by a listing in progress, and published as a whole to
+	// listing once it is complete.  lock lets one listing run at a time.
 	dirs    map[string]SubDir
 	files   map[string]SubFile
+	virtual map[string]fs.Node
+	totals  *dirTotals
+	listing *dirListing
+	lock    *sync.Mutex
 }
 
-func NewSubDir(ID int64, Root bool, Folder bool) SubDir{
+// dirSnapshot is a complete listing of a directory, which is never changed once published
+type dirSnapshot struct {
+	dirs    map[string]SubDir
+	files   map[string]SubFile
+	virtual map[string]fs.Node
+	totals  dirTotals
+}
+
+// dirListing holds the latest complete listing of a directory, swapped for a new one as a whole, so that
+// lookups racing with a listing see either the previous listing or the next, and never part of one
+type dirListing struct {
+	sync.RWMutex
+	snapshot *dirSnapshot
+}
+
+// current returns the latest complete listing, or nil if the directory hasn't been listed yet
+func (l *dirListing) current() *dirSnapshot {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.snapshot
+}
+
+// publish replaces the latest complete listing
+func (l *dirListing) publish(snapshot *dirSnapshot) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.snapshot = snapshot
+}
+
+// dirTotals sums the songs of a directory once it has been listed
+type dirTotals struct {
+	loaded   bool
+	tracks   int64
+	duration int64
+	size     int64
+
+	// listed counts the songs with at least one file in the listing, which falls short of tracks when the
+	// filename template hides songs or several songs render to the same name
+	listed int64
+}
+
+// artSize is the size in pixels requested for cover art, or -1 for the original image
+var artSize = flag.Int64("art-size", -1, "Size in pixels of cover art images, or -1 for the original size")
+
+// flatten lists the artists of a single music folder at the root, without the folder and All directories
+var flatten = flag.Bool("flatten", false, "With a single music folder, list its artists at the root instead of in a folder directory")
+
+// allDir and allName control the directory at the root merging every music folder
+var allDir = flag.Bool("all-dir", true, "Add a directory at the root merging the artists of every music folder")
+var allName = flag.String("all-name", "All", "Name of the directory merging every music folder, for -all-dir")
+
+// allArt exposes every distinct cover art ID found in a directory, rather than only its canonical cover
+var allArt = flag.Bool("all-art", false, "Expose every distinct cover art image in a directory as <id>.jpg, in addition to cover.jpg")
+
+func NewSubDir(acct *account, ID int64, Root bool, Folder bool) SubDir {
 	var newDir = SubDir{
-		ID:   ID,
-		Root: Root,
+		acct:   acct,
+		ID:     ID,
+		Root:   Root,
 		Folder: Folder,
 	}
-	// contents of directory
-	newDir.dirs = map[string]SubDir{}
-	newDir.files = map[string]SubFile{}
+	// contents of directory, filled in by each listing
+	newDir.listing = &dirListing{}
+	newDir.lock = &sync.Mutex{}
 	return newDir
 }
 
-// Attr retrives the attributes for this SubDir
-func (SubDir) Attr() fuse.Attr {
+// Attr retrives the attributes for this SubDir, which is only writable with -overlay
+func (d SubDir) Attr() fuse.Attr {
+	d = d.refreshed()
+	mode := os.FileMode(0555)
+	if *overlayDir != "" {
+		mode = 0755
+	}
 	return fuse.Attr{
-		Mode: os.ModeDir | 0555,
+		Inode: d.inode(),
+		Mode:  os.ModeDir | mode,
+		Mtime: d.Modified,
+		Nlink: dirNlink,
 	}
 }
 
-// Create does nothing, because subfs is read-only
-func (SubDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
-	return nil, nil, fuse.Errno(syscall.EROFS)
+// Create creates a file in the -overlay directory, or does nothing without one, because subfs is read-only
+func (d SubDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
+	return overlayCreate(d.overlayDirPath(), req)
 }
 
-// Fsync does nothing, because subfs is read-only
-func (SubDir) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
-}
+// Lookup scans the current directory for matching files or directories, within -op-timeout
+func (d SubDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	d = d.refreshed()
+
+	// Local files take the place of the server's, while local directories only appear where the server has
+	// none, as the server's directories already include their local counterparts
+	var local fs.Node
+	if overlay := d.overlayDirPath(); overlay != "" {
+		node, info := overlayNode(filepath.Join(overlay, name))
+		if node != nil && !info.IsDir() {
+			return node, nil
+		}
+		local = node
+	}
 
-// Link does nothing, because subfs is read-only
-func (SubDir) Link(req *fuse.LinkRequest, node fs.Node, intr fs.Intr) (fs.Node, fuse.Error) {
-	return nil, fuse.Errno(syscall.EROFS)
+	node, err := lookupWithin("lookup of "+name, intr, func() (fs.Node, fuse.Error) {
+		return d.lookup(name, intr)
+	})
+	if err == fuse.ENOENT && local != nil {
+		return local, nil
+	}
+	return node, err
 }
 
-// Lookup scans the current directory for matching files or directories
-func (d SubDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+// lookup scans the current directory for matching files or directories
+func (d SubDir) lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	// Probes from file managers never exist, so don't list the directory for them
+	if isProbe(name) {
+		return nil, fuse.ENOENT
+	}
+
 	// If directory hasn't loaded, load things first
-	if len(d.dirs) == 0 && len(d.files) == 0 {
-		d.ReadDir(intr)
+	snapshot := d.listing.current()
+	if snapshot == nil {
+		if _, err := d.ReadDir(intr); err != nil {
+			return nil, err
+		}
+		if snapshot = d.listing.current(); snapshot == nil {
+			return nil, fuse.ENOENT
+		}
 	}
 
 	// Lookup directory by name
-	if dir, ok := d.dirs[name]; ok {
+	if dir, ok := snapshot.dirs[name]; ok {
 		return dir, nil
 	}
 
 	// Lookup file by name
-	if f, ok := d.files[name]; ok {
+	if f, ok := snapshot.files[name]; ok {
 		return f, nil
 	}
 
+	// Lookup generated files and directories by name
+	if node, ok := snapshot.virtual[name]; ok {
+		return placeVirtual(node, d.virtualIdentity(name)), nil
+	}
+
 	// File not found
 	return nil, fuse.ENOENT
 }
 
-// ReadDir returns a list of directory entries depending on the current path
+// xattrs returns the extended attributes describing this directory, listing it first if needed
+func (d SubDir) xattrs(intr fs.Intr) (map[string]string, fuse.Error) {
+	// Only album and artist directories have songs to sum
+	if d.Root || d.Folder {
+		return map[string]string{}, nil
+	}
+	d = d.refreshed()
+
+	snapshot := d.listing.current()
+	if snapshot == nil || !snapshot.totals.loaded {
+		if _, err := d.ReadDir(intr); err != nil {
+			return nil, err
+		}
+		if snapshot = d.listing.current(); snapshot == nil {
+			return map[string]string{}, nil
+		}
+	}
+
+	totals := snapshot.totals
+	attrs := map[string]string{
+		"user.subfs.tracks":   strconv.FormatInt(totals.tracks, 10),
+		"user.subfs.duration": strconv.FormatInt(totals.duration, 10),
+		"user.subfs.size":     strconv.FormatInt(totals.size, 10),
+	}
+
+	// Directories missing songs say how many of them are listed
+	if totals.listed != totals.tracks {
+		attrs["user.subfs.incomplete"] = fmt.Sprintf("%d/%d", totals.listed, totals.tracks)
+	}
+	return attrs, nil
+}
+
+// Getxattr returns an extended attribute of this directory, such as user.subfs.duration in seconds
+func (d SubDir) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	attrs, err := d.xattrs(intr)
+	if err != nil {
+		return err
+	}
+	return getxattr(attrs, req, resp)
+}
+
+// Listxattr lists the extended attributes of this directory
+func (d SubDir) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	attrs, err := d.xattrs(intr)
+	if err != nil {
+		return err
+	}
+	return listxattr(attrs, resp)
+}
+
+// ReadDir returns a list of directory entries depending on the current path, within -op-timeout
 func (d SubDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	d = d.refreshed()
+	return readDirWithin("listing of directory "+strconv.FormatInt(d.ID, 10), intr, func() ([]fuse.Dirent, fuse.Error) {
+		directories, err := d.readDir(intr)
+		if err != nil {
+			return nil, err
+		}
+		return d.direntInodes(overlayDirents(d.overlayDirPath(), directories)), nil
+	})
+}
+
+// readDir lists this directory, publishing the listing once it is complete
+func (d SubDir) readDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	// Only one listing may populate this directory at a time
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Fill in maps of this listing's own, leaving the previous listing in place for lookups until done
+	next := d
+	next.dirs = map[string]SubDir{}
+	next.files = map[string]SubFile{}
+	next.virtual = map[string]fs.Node{}
+	next.totals = &dirTotals{}
+	generation := atomic.LoadInt64(&d.acct.generation)
+	directories, err := next.populate(intr)
+	if err != nil {
+		return nil, err
+	}
+	d.registerChildren(next.dirs, generation)
+
+	d.listing.publish(&dirSnapshot{
+		dirs:    next.dirs,
+		files:   next.files,
+		virtual: next.virtual,
+		totals:  *next.totals,
+	})
+	return directories, nil
+}
+
+// populate fills in a new listing of this directory, returning its entries depending on the current path
+func (d SubDir) populate(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 	// List of directory entries to return
 	directories := make([]fuse.Dirent, 0)
 
 	// If at root of filesystem, fetch indexes
 	if d.Root {
-		// If empty, wait for indexes to be available
-		if len(artistsIndex) == 0 {
-			<-indexChan
+		// Wait for indexes to be available
+		index := d.acct.index()
+
+		// With a single music folder, its artists may be listed at the root instead
+		if *flatten && len(index) == 1 {
+			for folder := range index {
+				entries, err := d.readFolder(folder.ID)
+				if err != nil {
+					return nil, err
+				}
+				directories = append(directories, entries...)
+			}
+		} else {
+			directories = d.readRoot(index, directories)
 		}
 
-		// Create the All Entries
-		d.dirs["All"] = NewSubDir(
-			-1,
-			false,
-			true,
-		)
-		// Create a directory entry
-		dir := fuse.Dirent{
-			Name: "All",
-			Type: fuse.DT_Dir,
+		// Smart playlists defined in the configuration file
+		if len(d.acct.smartPlaylists) > 0 {
+			d.virtual["Smart Playlists"] = newSmartPlaylistsDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Smart Playlists",
+				Type: fuse.DT_Dir,
+			})
 		}
-		directories = append(directories, dir)
 
-		// Iterate through the music folders
-		for folder, _ := range artistsIndex {
-			d.dirs[folder.Name] = NewSubDir(
-				folder.ID,
-				false,
-				true,
-			)
-			// Create a directory entry
-			dir := fuse.Dirent{
-				Name: folder.Name,
+		// Albums most recently played on any client
+		if *recentlyPlayed {
+			d.virtual["Recently Played"] = newAlbumListDir(d.acct, "recent", recentTTL)
+			directories = append(directories, fuse.Dirent{
+				Name: "Recently Played",
 				Type: fuse.DT_Dir,
-			}
+			})
+		}
 
-			// Append entry
-			directories = append(directories, dir)
+		// The server's playlists
+		if *playlists {
+			d.virtual["Playlists"] = newPlaylistsDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Playlists",
+				Type: fuse.DT_Dir,
+			})
 		}
+
+		// Starred artists, albums and songs
+		if *starredView {
+			d.virtual["Starred"] = newStarredDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Starred",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Highest rated albums
+		if *topRated {
+			d.virtual["Top Rated"] = newAlbumListDir(d.acct, "highest", layoutTTL)
+			directories = append(directories, fuse.Dirent{
+				Name: "Top Rated",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Albums grouped by when they were added
+		if *addedTree {
+			d.virtual["Added"] = newAddedDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Added",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Songs seen so far, grouped by format and bitrate
+		if *qualityViews {
+			d.virtual["Quality"] = newQualityDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Quality",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Compilations gathered in one place
+		if *variousArtists {
+			d.virtual[variousArtistsName] = newVariousArtistsDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: variousArtistsName,
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Known songs grouped by composer
+		if *composersView {
+			d.virtual["Composers"] = newComposersDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "Composers",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Known albums missing their cover art
+		if *noCoverArt {
+			d.virtual["No Cover Art"] = newNoCoverArtDir(d.acct)
+			directories = append(directories, fuse.Dirent{
+				Name: "No Cover Art",
+				Type: fuse.DT_Dir,
+			})
+		}
+
+		// Hidden directory for subfs' own use, such as resolving songs by ID
+		d.virtual[".subfs"] = newControlDir(d.acct)
+		directories = append(directories, fuse.Dirent{
+			Name: ".subfs",
+			Type: fuse.DT_Dir,
+		})
+
 		return directories, nil
 	}
 
 	// Top level Music Folder
 	if d.Folder {
-		for folder, artists := range artistsIndex {
-			if (d.ID == folder.ID || d.ID == -1) {
-				log.Printf("Music Folder name: %s", folder.Name)
-				// Iterate all artists
-				for _, a := range artists {
-					// Map artist's name to directory
-					d.dirs[a.Name] = NewSubDir(
-						a.ID,
-						false,
-						false,
-					)
-
-					// Create a directory entry
-					dir := fuse.Dirent{
-						Name: a.Name,
-						Type: fuse.DT_Dir,
-					}
-
-					// Append entry
-					directories = append(directories, dir)
-				}
-			}
-		}
+		return d.readFolder(d.ID)
+	}
 
-		return directories, nil
+	// Directories can't be fetched without a server
+	if d.acct.isOffline() {
+		return nil, fuseError(errOffline)
 	}
 
 	// Not at filesystem root, so get this directory's contents
-	content, err := subsonic.GetMusicDirectory(d.ID)
+	// Concurrent fetches of the same directory share a single request
+	result, err := d.acct.sfs.directoryFlight.Do(d.acct.Name+"/"+strconv.FormatInt(d.ID, 10), func() (interface{}, error) {
+		return fetchMusicDirectory(d.acct, d.ID)
+	})
 	if err != nil {
 		log.Printf("subfs: failed to retrieve directory %d: %s", d.ID, err.Error())
-		return nil, fuse.ENOENT
+		return nil, fuseError(err)
 	}
+	listing := result.(*musicDirectory)
 
-	// Check for unique, available cover art IDs
+	// Move the songs of per-disc folders into this directory
+	if *discLayout == "merge" {
+		if listing, err = d.mergeDiscs(listing); err != nil {
+			log.Printf("subfs: failed to merge discs of directory %d: %s", d.ID, err.Error())
+			return nil, fuseError(err)
+		}
+	}
+	content := listing.Content
+
+	// Check for unique, available cover art IDs, remembering the first one found
 	coverArt := set.New()
+	var firstArt int64
+	noteArt := func(id int64) {
+		coverArt.Add(id)
+		if firstArt == 0 {
+			firstArt = id
+		}
+	}
 
-	// List of bad characters which should be replaced in filenames
-	badChars := []string{"/", "\\"}
+	// Subdirectories are usually albums, so apply album rewrite rules, then check for any characters
+	// which may cause trouble with filesystem display
+	titles := make([]string, len(content.Directories))
+	names, years := nameCounter{}, nameCounter{}
+	for i, dir := range content.Directories {
+		titles[i] = d.acct.sfs.formatDirname(listing.Children[dir.ID], yearPrefix(rewrite("album", dir.Title), listing.Children[dir.ID].Year))
+		names[titles[i]]++
+		years[fmt.Sprintf("%s (%d)", titles[i], listing.Children[dir.ID].Year)]++
+	}
 
 	// Iterate all returned directories
-	for _, dir := range content.Directories {
-		// Check for any characters which may cause trouble with filesystem display
-		for _, b := range badChars {
-			dir.Title = strings.Replace(dir.Title, b, "_", -1)
-		}
+	for i, dir := range content.Directories {
+		// Qualify albums sharing a title with their year or ID
+		dir.Title = names.qualify(titles[i], listing.Children[dir.ID].Year, dir.ID, years)
 
 		// Create a directory entry
 		entry := fuse.Dirent{
@@ -178,95 +474,93 @@ func (d SubDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 			Type: fuse.DT_Dir,
 		}
 
-		// Add SubDir directory to lookup map
-		d.dirs[dir.Title] = NewSubDir(
+		// Add SubDir directory to lookup map, remembering its own cover art
+		sub := NewSubDir(
+			d.acct,
 			dir.ID,
 			false,
 			false,
 		)
+		sub.Name = dir.Title
+		sub.Modified = listing.Children[dir.ID].modified()
+		sub.CoverArt = dir.CoverArt
+		d.dirs[dir.Title] = d.child(sub, dir.Title)
 
 		// Check for cover art
-		coverArt.Add(dir.CoverArt)
+		noteArt(dir.CoverArt)
 
 		// Append to list
 		directories = append(directories, entry)
 	}
 
-	// Iterate all returned audio
+	// Sum the songs of this directory, once each rather than per original and transcode
+	var previous dirTotals
+	if snapshot := d.listing.current(); snapshot != nil {
+		previous = snapshot.totals
+	}
+	*d.totals = dirTotals{loaded: true}
 	for _, a := range content.Audio {
+		d.totals.tracks++
+		d.totals.duration += a.DurationRaw
+		d.totals.size += a.Size
+	}
 
-		// Check for lossless and lossy transcode
-		transcodes := []struct {
-			suffix string
-			size   int64
-		}{
-			{a.Suffix, a.Size},
-			{a.TranscodedSuffix, 0},
-		}
-
-		for _, t := range transcodes {
-			// If suffix is empty (source is lossy), skip this file
-			if t.suffix == "" {
-				continue
-			}
-
-			// Mark file as lossless by default
-			lossless := true
-
-			// If size is empty (transcode to lossy), estimate it and mark as lossy
-			if t.size == 0 {
-				lossless = false
+	// Songs spanning several discs are either prefixed with their disc number, or split by disc
+	splitDiscs := *discLayout != "server" && multiDisc(listing)
+	discs := map[int64]map[string]fs.Node{}
 
-				// Since we have no idea what Subsonic's transcoding settings are, we will estimate
-				// using MP3 CBR 320 as our benchmark, being that it will likely over-estimate
-				// Thanks: http://www.jeffreysward.com/editorials/mp3size.htm
-				t.size = ((a.DurationRaw * 320) / 8) * 1024
+	// The song finally given each file, keyed by disc and filename, for counting the songs listed
+	placed := map[string]int64{}
 
-				// If the Duration is unknown, guess!
-				if t.size == 0 {
-					t.size = a.Size * 4
-				}
+	// Iterate all returned audio
+	for _, a := range content.Audio {
+		disc := listing.Children[a.ID].DiscNumber
+		// Check for lossless and lossy transcode, though audiobooks and raw streams are only offered as
+		// their originals
+		versions := []bool{true, false}
+		if d.Audiobook || *streamRaw {
+			versions = []bool{true}
+		}
+		for _, original := range versions {
+			suffix := a.Suffix
+			if !original {
+				suffix = a.TranscodedSuffix
 			}
 
-			// Predefined audio filename format
-			var filenameCtx = struct{
-				A gosubsonic.Audio
-				Artist string
-				Album string
-				Track int64
-				Title string
-				Suffix string
-				Path string
-				Filename string
-				Basename string
-			}{
-				A: a,
-				Artist: a.Artist,
-				Album: a.Album,
-				Track: a.Track,
-				Title: a.Title,
-				Suffix: t.suffix,
-				Path: a.Path,
-				Filename: path.Base(a.Path),
-				Basename: strings.TrimSuffix(path.Base(a.Path), "." + a.Suffix),
+			// If suffix is empty (source is lossy), skip this file
+			if suffix == "" {
+				continue
 			}
 
-			var filenameBuffer bytes.Buffer
-			err := filenameTemplate.Execute(&filenameBuffer, filenameCtx)
+			filename, err := d.acct.sfs.formatFilename(a, suffix, listing.Children[a.ID].starred())
 			if err != nil {
-				log.Printf("subfs: failed to format filename %d: %s", a.Path, err.Error())
+				log.Printf("subfs: failed to format filename %s: %s", a.Path, err.Error())
 				continue
 			}
-			var filename = filenameBuffer.String()
 			if len(filename) == 0 {
 				// the template returned an empty string
 				continue
 			}
+			if splitDiscs && disc != 0 && *discLayout == "merge" {
+				filename = discFilename(disc, filename)
+			}
+
+			// Add SubFile file to lookup map
+			f := newAudioFile(d.acct, listing.Children[a.ID], original)
+			f.FileName = filename
+			f.Audiobook = d.Audiobook
+
+			// Check for cover art
+			noteArt(a.CoverArt)
 
-			// Check for any characters which may cause trouble with filesystem display
-			for _, b := range badChars {
-				filename = strings.Replace(filename, b, "_", -1)
+			// Place the file in its disc's subdirectory instead, if needed
+			if splitDiscs && disc != 0 && *discLayout == "folders" {
+				addDiscFile(discs, disc, f)
+				placed[fmt.Sprintf("%d/%s", disc, filename)] = a.ID
+				continue
 			}
+			d.files[filename] = f
+			placed[filename] = a.ID
 
 			// Create a directory entry
 			dir := fuse.Dirent{
@@ -274,33 +568,49 @@ func (d SubDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 				Type: fuse.DT_File,
 			}
 
-			// Add SubFile file to lookup map
-			d.files[dir.Name] = SubFile{
-				ID:       a.ID,
-				Created:  a.Created,
-				FileName: filename,
-				IsVideo:  false,
-				Lossless: lossless,
-				Size:     t.size,
-			}
-
-			// Check for cover art
-			coverArt.Add(a.CoverArt)
-
 			// Append to list
 			directories = append(directories, dir)
 		}
 	}
 
+	// Warn of songs which the server listed but which have no file, once rather than on every listing
+	songs := map[int64]bool{}
+	for _, id := range placed {
+		songs[id] = true
+	}
+	d.totals.listed = int64(len(songs))
+	if d.totals.listed != d.totals.tracks && (!previous.loaded || previous.listed != d.totals.listed) {
+		log.Printf("subfs: directory %d lists %d of the %d songs reported by the server", d.ID, d.totals.listed, d.totals.tracks)
+	}
+
+	// Add a subdirectory for each disc
+	for disc, entries := range discs {
+		name := discDirName(disc)
+		d.virtual[name] = newStaticDir(entries)
+		directories = append(directories, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_Dir,
+		})
+	}
+
+	// Synthesize per-track files for single-file albums with a cue sheet
+	if *splitCue {
+		for _, f := range d.cueFiles(content) {
+			d.files[f.FileName] = f
+			directories = append(directories, fuse.Dirent{
+				Name: f.FileName,
+				Type: fuse.DT_File,
+			})
+		}
+	}
+
 	// Iterate all returned video
 	for _, v := range content.Video {
 		// Predefined video filename format
 		videoFormat := fmt.Sprintf("%s.%s", v.Title, v.Suffix)
 
 		// Check for any characters which may cause trouble with filesystem display
-		for _, b := range badChars {
-			videoFormat = strings.Replace(videoFormat, b, "_", -1)
-		}
+		videoFormat = limitName(sanitizeName(videoFormat), v.ID)
 
 		// Create a directory entry
 		dir := fuse.Dirent{
@@ -310,83 +620,242 @@ func (d SubDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
 
 		// Add SubFile file to lookup map
 		d.files[dir.Name] = SubFile{
+			acct:     d.acct,
 			ID:       v.ID,
 			Created:  v.Created,
 			FileName: videoFormat,
-			Size:     v.Size,
+			Size:     estimateVideoSize(v),
+			Duration: v.DurationRaw,
 			IsVideo:  true,
+			Suffix:   v.Suffix,
 		}
 
 		// Check for cover art
-		coverArt.Add(v.CoverArt)
+		noteArt(v.CoverArt)
 
 		// Append to list
 		directories = append(directories, dir)
+
+		// Add a poster beside the video, from its cover art or else a frame generated by the server
+		poster := v.CoverArt
+		if poster == 0 {
+			poster = v.ID
+		}
+		directories = append(directories, d.addArt(strings.TrimSuffix(videoFormat, "."+v.Suffix)+".jpg", poster))
+	}
+
+	// Add chapter files for media with a cue sheet or bookmark
+	if *chapterFiles {
+		directories = d.addChapterFiles(directories)
+	}
+
+	// Add ReplayGain sidecars for songs with server-reported gain
+	if *replayGainSidecars {
+		directories = d.addReplayGainFiles(directories)
+	}
+
+	// Add songs this artist shares with others, listed under another artist
+	directories = d.addCollaborations(directories)
+
+	// Describe albums, being directories with songs, using the ID3 album of their first song
+	if *albumInfoFiles && len(content.Audio) > 0 && d.acct.supports("getAlbumInfo") {
+		d.virtual["albuminfo.txt"] = d.albumInfoFile(int64(listing.Children[content.Audio[0].ID].AlbumID))
+		directories = append(directories, fuse.Dirent{
+			Name: "albuminfo.txt",
+			Type: fuse.DT_File,
+		})
+	}
+
+	// Add an instant mix playlist based on this artist or album
+	if *radio && d.Name != "" {
+		name := d.radioName()
+		d.virtual[name] = d.radioPlaylist(listing)
+		directories = append(directories, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_File,
+		})
+	}
+
+	// Choose the canonical cover from the directory's own art, falling back to the first art found within it
+	canonical := d.CoverArt
+	if canonical == 0 {
+		canonical = firstArt
 	}
 
-	// Iterate all cover art
-	for _, e := range coverArt.Enumerate() {
-		// Type-hint to int64
-		c := e.(int64)
-		coverArtFormat := fmt.Sprintf("%d.jpg", c)
+	// Emit exactly one canonical cover per directory
+	if canonical != 0 {
+		directories = append(directories, d.addArt("cover.jpg", canonical))
+	}
+
+	// Optionally emit the remaining distinct art as well
+	if *allArt {
+		for _, e := range coverArt.Enumerate() {
+			// Type-hint to int64
+			c := e.(int64)
+			if c == 0 || c == canonical {
+				continue
+			}
 
+			directories = append(directories, d.addArt(fmt.Sprintf("%d.jpg", c), c))
+		}
+	}
+
+	// Return all directory entries, in the requested order
+	return d.sortEntries(directories, listing), nil
+}
+
+// readRoot lists the All directory, if enabled, and each music folder at the root.  The caller must hold the
+// directory's lock.
+func (d SubDir) readRoot(index map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist, directories []fuse.Dirent) []fuse.Dirent {
+	// Create the All Entries, unless turned off
+	if *allDir {
+		d.dirs[*allName] = d.child(NewSubDir(
+			d.acct,
+			-1,
+			false,
+			true,
+		), *allName)
 		// Create a directory entry
 		dir := fuse.Dirent{
-			Name: coverArtFormat,
-			Type: fuse.DT_File,
+			Name: *allName,
+			Type: fuse.DT_Dir,
 		}
+		directories = append(directories, dir)
+	}
 
-		// Add SubFile file to lookup map
-		d.files[dir.Name] = SubFile{
-			ID:       c,
-			FileName: coverArtFormat,
-			IsArt:    true,
+	// Iterate through the music folders
+	for folder, _ := range index {
+		sub := NewSubDir(
+			d.acct,
+			folder.ID,
+			false,
+			true,
+		)
+		name := sanitizeName(folder.Name)
+		sub.Name = name
+		d.dirs[name] = d.child(sub, name)
+		// Create a directory entry
+		dir := fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_Dir,
 		}
 
-		// Append to list
+		// Append entry
 		directories = append(directories, dir)
 	}
 
-	// Return all directory entries
-	return directories, nil
+	return directories
 }
 
-// Mkdir does nothing, because subfs is read-only
-func (SubDir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
-	return nil, fuse.Errno(syscall.EROFS)
-}
+// readFolder lists the artists of a music folder, or of all folders if id is -1.  The caller must hold
+// the directory's lock.
+func (d SubDir) readFolder(id int64) ([]fuse.Dirent, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
 
-// Mknod does nothing, because subfs is read-only
-func (SubDir) Mknod(req *fuse.MknodRequest, intr fs.Intr) (fs.Node, fuse.Error) {
-	return nil, fuse.Errno(syscall.EROFS)
-}
+	// Arranged by album artist
+	if *layout == "album-artist" {
+		// All folders are asked for at once, unless some are left out, when each selected one is asked for
+		ids := []int64{id}
+		if id == -1 && (*includeFolders != "" || *excludeFolders != "") {
+			ids = []int64{}
+			for folder := range d.acct.index() {
+				ids = append(ids, folder.ID)
+			}
+		}
 
-// Remove does nothing, because subfs is read-only
-func (SubDir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
-}
+		entries := map[string]fs.Node{}
+		for _, folderID := range ids {
+			folderEntries, err := albumArtistEntries(d.acct, folderID)
+			if err != nil {
+				return nil, fuseError(err)
+			}
+			for name, node := range folderEntries {
+				entries[name] = node
+			}
+		}
+		for name, node := range entries {
+			d.virtual[name] = node
+		}
+		return sortArtists(direntsFor(entries)), nil
+	}
+
+	// Arranged as on the server
+	for folder, artists := range d.acct.index() {
+		if id == folder.ID || id == -1 {
+			log.Printf("Music Folder name: %s", folder.Name)
+			// Iterate all artists, leaving out those only found on compilations
+			for _, a := range artists {
+				if d.acct.compilationOnly(a.Name) {
+					continue
+				}
+
+				// Map artist's name to directory, rewritten by any rules
+				name := limitName(sanitizeName(artistDisplayName(rewrite("artist", a.Name))), a.ID)
+
+				// Present exactly one level of albums, whatever the server's nesting
+				if *layout == "normalized" {
+					d.virtual[name] = normalizedArtistDir(d.acct, a.ID, a.Name)
+					directories = append(directories, fuse.Dirent{
+						Name: name,
+						Type: fuse.DT_Dir,
+					})
+					continue
+				}
+
+				sub := NewSubDir(
+					d.acct,
+					a.ID,
+					false,
+					false,
+				)
+				sub.Name = name
+				sub.Artist = a.Name
+				d.dirs[name] = d.child(sub, name)
+
+				// Create a directory entry
+				dir := fuse.Dirent{
+					Name: name,
+					Type: fuse.DT_Dir,
+				}
 
-// Removexattr does nothing, because subfs is read-only
-func (SubDir) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
+				// Append entry
+				directories = append(directories, dir)
+			}
+		}
+	}
+
+	return sortArtists(directories), nil
 }
 
-// Rename does nothing, because subfs is read-only
-func (SubDir) Rename(req *fuse.RenameRequest, node fs.Node, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
+// addArt adds a cover art file with the given name to this directory, returning its directory entry
+func (d SubDir) addArt(name string, id int64) fuse.Dirent {
+	// Add SubFile file to lookup map
+	d.files[name] = SubFile{
+		acct:     d.acct,
+		ID:       id,
+		FileName: name,
+		IsArt:    true,
+		ArtSize:  *artSize,
+	}
+
+	// Create a directory entry
+	return fuse.Dirent{
+		Name: name,
+		Type: fuse.DT_File,
+	}
 }
 
-// Setattr does nothing, because subfs is read-only
-func (SubDir) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
+// Mkdir creates a directory in the -overlay directory, or does nothing without one, because subfs is read-only
+func (d SubDir) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	return overlayMkdir(d.overlayDirPath(), req)
 }
 
-// Setxattr does nothing, because subfs is read-only
-func (SubDir) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
-	return fuse.Errno(syscall.EROFS)
+// Remove removes a file added to the -overlay directory, but nothing else, because subfs is read-only
+func (d SubDir) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
+	return overlayRemove(d.overlayDirPath(), req)
 }
 
-// Symlink does nothing, because subfs is read-only
-func (SubDir) Symlink(req *fuse.SymlinkRequest, intr fs.Intr) (fs.Node, fuse.Error) {
-	return nil, fuse.Errno(syscall.EROFS)
+// Rename moves a file added to the -overlay directory, but nothing else, because subfs is read-only
+func (d SubDir) Rename(req *fuse.RenameRequest, node fs.Node, intr fs.Intr) fuse.Error {
+	return overlayRename(d.overlayDirPath(), req, node)
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+// BenchmarkReadDir lists an album of the fake server, sharing nothing between listings but the cache
+func BenchmarkReadDir(b *testing.B) {
+	sfs := newTestFilesystem(b, newFakeServer(b, "Bench", 20, 1024))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		entries, err := albumDir(sfs).ReadDir(nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(entries) == 0 {
+			b.Fatal("album listed no entries")
+		}
+	}
+}
+
+// TestReadDir checks that an album lists a file for each song of the fake server
+func TestReadDir(t *testing.T) {
+	sfs := newTestFilesystem(t, newFakeServer(t, "Test", 3, 1024))
+
+	entries, err := albumDir(sfs).ReadDir(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	for _, name := range []string{
+		"01 - Test Artist - Test Song 1.flac",
+		"02 - Test Artist - Test Song 2.flac",
+		"03 - Test Artist - Test Song 3.flac",
+	} {
+		if !names[name] {
+			t.Errorf("album doesn't list %s, only %v", name, names)
+		}
+	}
+}
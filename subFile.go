@@ -1,197 +1,237 @@
 package main
 
 import (
+	"flag"
 	"io"
-	"io/ioutil"
 	"log"
-	"os"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"github.com/mdlayher/gosubsonic"
 )
 
+// streamRaw serves every audio file as the original, using the download method, never a transcode
+var streamRaw = flag.Bool("stream-raw", false, "Serve audio only as original files from the download method, never transcoded, for accurate sizes and bit-perfect copies")
+
 // SubFile represents a file in Subsonic library
 type SubFile struct {
+	readOnlyFile
+
+	acct     *account
 	ID       int64
 	Created  time.Time
 	FileName string
 	IsArt    bool
+	ArtSize  int64
 	IsVideo  bool
 	Lossless bool
 	Size     int64
+	Suffix   string
+	Tags     trackTags
+
+	// Path of the song on the server, relative to its music folder
+	Path string
+
+	// ContentType is the MIME type of the file as served, as reported by the server
+	ContentType string
+
+	// Starred is whether the user has starred the song
+	Starred bool
+
+	// Duration in seconds, and whether the file is an audiobook whose read position is remembered
+	Duration  int64
+	Audiobook bool
+
+	// ReplayGain values reported by the server, if any
+	ReplayGain *replayGain
+
+	// Start and length in seconds of a virtual cue sheet track within the file
+	CueStart  float64
+	CueLength float64
 }
 
+// newAudioFile returns the file serving an audio entry, either as the original file or as a transcode
+func newAudioFile(acct *account, c apiChild, original bool) SubFile {
+	a := c.audio()
+	f := SubFile{
+		acct:        acct,
+		ID:          a.ID,
+		Created:     a.Created,
+		Lossless:    true,
+		Size:        a.Size,
+		Suffix:      a.Suffix,
+		ContentType: c.ContentType,
+		Tags:        audioTags(a),
+		Path:        c.Path,
+		Starred:     c.starred(),
+		Duration:    a.DurationRaw,
+		ReplayGain:  c.ReplayGain,
+	}
+	// Servers which stream originals, or which don't report a transcoded suffix, serve the file as is
+	if acct.quirks.streamsOriginal || a.TranscodedSuffix == "" || *streamRaw {
+		original = true
+	}
+	if !original {
+		f.Lossless = false
+		f.Suffix = a.TranscodedSuffix
+		f.ContentType = c.TranscodedContentType
+	}
+
+	// If size is known, the file is served as is, as it always is when streaming raw files
+	if original && (f.Size != 0 || *streamRaw) {
+		return f
+	}
+
+	// Otherwise, estimate the size.  Originals are still fetched byte for byte, only their size is a guess.
+	// Since we have no idea what Subsonic's transcoding settings are, we will estimate
+	// using MP3 CBR 320 as our benchmark, being that it will likely over-estimate
+	// Thanks: http://www.jeffreysward.com/editorials/mp3size.htm
+	f.Size = ((a.DurationRaw * 320) / 8) * 1024
+
+	// If the Duration is unknown, guess!
+	if f.Size == 0 {
+		f.Size = a.Size * 4
+	}
+
+	return f
+}
+
+// SetSize records the actual size of this file once read, which Attr reports from then on, even after a
+// restart
 func (s SubFile) SetSize(size int64) {
-	if s.GetSize() != size {
-		fileSizeCache[s.ID] = size
+	if s.GetSize() == size {
+		return
+	}
+	s.acct.sfs.sizes.set(s, size)
+}
+
+// knownSize returns the size of this file if it is known rather than estimated, as for originals and
+// files already read, or else -1, so that buffers aren't sized for an estimate far above the real size
+func (s SubFile) knownSize() int64 {
+	if size, ok := s.acct.sfs.sizes.get(s); ok {
+		return size
+	}
+	if s.Lossless && !s.IsVideo && !s.IsArt && s.CueLength == 0 {
+		return s.Size
 	}
+	return -1
 }
 
+// GetSize returns the actual size of this file if it has been read, or else the size listed or estimated
 func (s SubFile) GetSize() int64 {
-	size, ok := fileSizeCache[s.ID]
-	if !ok {
-		size = s.Size
+	if size, ok := s.acct.sfs.sizes.get(s); ok {
+		return size
 	}
-	return size
+	return s.Size
 }
 
 // Attr returns file attributes (all files read-only)
 func (s SubFile) Attr() fuse.Attr {
+	size := uint64(s.GetSize())
 	return fuse.Attr{
-		Mode:  0644,
-		Mtime: s.Created,
-		Size:  uint64(s.GetSize()),
+		Inode:  s.inode(),
+		Mode:   0644,
+		Mtime:  s.Created,
+		Size:   size,
+		Blocks: blocks(size),
+		Nlink:  1,
 	}
 }
 
-// ReadAll opens a file stream from Subsonic and returns the resulting bytes
-func (s SubFile) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
-	// Byte stream to return data
-	byteChan := make(chan []byte)
-
-	// Fetch file in background
-	go func() {
-		// Check for file in cache
-		if cFile, ok := fileCache[s.FileName]; ok {
-			// Check for empty file, meaning the cached file got wiped out
-			buf, err := ioutil.ReadFile(cFile.Name())
-			if len(buf) == 0 && strings.Contains(err.Error(), "no such file or directory") {
-				// Purge item from cache
-				log.Printf("Cache missing: [%d] %s", s.ID, s.FileName)
-				delete(fileCache, s.FileName)
-				cacheTotal = atomic.AddInt64(&cacheTotal, -1*s.Size)
-
-				// Print some cache metrics
-				cacheUse := float64(cacheTotal) / 1024 / 1024
-				cacheDel := float64(s.Size) / 1024 / 1024
-				log.Printf("Cache use: %0.3f / %d.000 MB (-%0.3f MB)", cacheUse, *cacheSize, cacheDel)
-
-				// Close file handle
-				if err := cFile.Close(); err != nil {
-					log.Println(err)
-				}
-			} else {
-				// Return cached file
-				byteChan <- buf
-				return
-			}
-		}
-
-		// Check for pre-existing stream in progress, so that multiple clients can receive it without
-		// requesting the stream multiple times.  Yeah concurrency!
-		if streamChan, ok := streamMap[s.ID]; ok {
-			// Wait for stream to be ready, and return it
-			byteChan <- <-streamChan
-			return
-		}
-
-		// Generate a channel for clients wishing to wait on this stream
-		streamMap[s.ID] = make(chan []byte, 0)
+// dirNlink is the link count of every directory.  Counting subdirectories would require listing them, and
+// find treats a count of 2 as having none, so 1 is reported instead, meaning unknown.
+const dirNlink = 1
 
-		// Open stream
-		stream, err := s.openStream()
-		if err != nil {
-			log.Println(err)
-			byteChan <- nil
+// blocks returns the number of 512-byte blocks reported for a file of the given size, as used by du
+func blocks(size uint64) uint64 {
+	return (size + 511) / 512
+}
 
-			// Remove stream from map on error
-			close(streamMap[s.ID])
-			delete(streamMap, s.ID)
-			return
-		}
+// xattrs returns the extended attributes describing this file
+func (s SubFile) xattrs() map[string]string {
+	attrs := map[string]string{}
 
-		// Read in stream
-		file, err := ioutil.ReadAll(stream)
-		if err != nil {
-			log.Println(err)
-			byteChan <- nil
+	// Expose ReplayGain values, e.g. user.replaygain.track_gain
+	for name, value := range s.ReplayGain.values() {
+		attrs["user."+strings.ToLower(strings.Replace(name, "REPLAYGAIN_", "replaygain.", 1))] = value
+	}
 
-			// Remove stream from map on error
-			close(streamMap[s.ID])
-			delete(streamMap, s.ID)
-			return
+	// Expose the checksum of cached files, for verification tools
+	if !s.IsArt {
+		if sum, ok := s.acct.sfs.cache.Checksum(s); ok {
+			attrs["user.subfs.md5"] = sum
 		}
+	}
 
-		// Calculate actual size upon retrieval
-		s.SetSize(int64(len(file)))
-
-		// Close stream
-		if err := stream.Close(); err != nil {
-			log.Println(err)
-			byteChan <- nil
+	// Expose the position reached within audiobooks
+	if s.Audiobook {
+		s.bookmarkXattrs(attrs)
+	}
 
-			// Remove stream from map on error
-			close(streamMap[s.ID])
-			delete(streamMap, s.ID)
-			return
-		}
+	return attrs
+}
 
-		// Return bytes
-		log.Printf("Closing stream: [%d] %s", s.ID, s.FileName)
-		byteChan <- file
+// Getxattr returns an extended attribute of this file
+func (s SubFile) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	return getxattr(s.xattrs(), req, resp)
+}
 
-		// Attempt to return bytes to others waiting, remove this stream
-		go func() {
-			// Time out after waiting for 10 seconds
-			select {
-			case streamMap[s.ID] <- file:
-			case <-time.After(time.Second * 10):
-			}
+// Listxattr lists the extended attributes of this file
+func (s SubFile) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	return listxattr(s.xattrs(), resp)
+}
 
-			// Remove stream from map
-			close(streamMap[s.ID])
-			delete(streamMap, s.ID)
-		}()
+// ReadAll opens a file stream from Subsonic and returns the resulting bytes
+func (s SubFile) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
+	// Byte stream to return data, and the reason for a failure if nil bytes are returned
+	byteChan := make(chan []byte)
+	var fetchErr error
 
-		// Check for maximum cache size
-		if cacheTotal > *cacheSize*1024*1024 {
-			log.Printf("Cache full (%d MB), skipping local cache", *cacheSize)
+	// Fetch file in background
+	go func() {
+		// Check for file in cache
+		if buf, ok := s.acct.sfs.cache.Get(s); ok {
+			// Return cached file
+			byteChan <- buf
 			return
 		}
 
-		// Check if cache will overflow if file is added
-		if cacheTotal+s.Size > *cacheSize*1024*1024 {
-			log.Printf("File will overflow cache (%0.3f MB), skipping local cache", float64(s.Size)/1024/1024)
+		// Without a server, only cached files can be read
+		if s.acct.isOffline() {
+			fetchErr = errOffline
+			byteChan <- nil
 			return
 		}
 
-		// If file is greater than 50MB, skip caching to conserve memory
-		threshold := 50
-		if s.Size > int64(threshold*1024*1024) {
-			log.Printf("File too large (%0.3f > %0d MB), skipping local cache", float64(s.Size)/1024/1024, threshold)
+		// Art is shared between concurrent reads of the same ID and size
+		if s.IsArt {
+			buf, err := s.fetchArt()
+			if err != nil {
+				log.Println(err)
+				fetchErr = err
+			}
+			byteChan <- buf
 			return
 		}
 
-		// Generate a temporary file
-		tmpFile, err := ioutil.TempFile(os.TempDir(), "subfs")
+		// Concurrent reads of the same file, whether through one handle or several, share one stream and
+		// each receive the whole file
+		buf, err := s.acct.sfs.streamFlight.Do(s.accountKey(), func() (interface{}, error) {
+			// A previous stream may have cached the file since this read checked
+			if buf, ok := s.acct.sfs.cache.Get(s); ok {
+				return buf, nil
+			}
+			return s.fetchStream()
+		})
 		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		// Write out temporary file
-		if _, err := tmpFile.Write(file); err != nil {
-			log.Println(err)
+			fetchErr = err
+			byteChan <- nil
 			return
 		}
-
-		// Add file to cache map
-		log.Printf("Caching file: [%d] %s", s.ID, s.FileName)
-		fileCache[s.FileName] = *tmpFile
-
-		// Add file's size to cache total size
-		cacheTotal = atomic.AddInt64(&cacheTotal, s.Size)
-
-		// Print some cache metrics
-		cacheUse := float64(cacheTotal) / 1024 / 1024
-		cacheAdd := float64(s.Size) / 1024 / 1024
-		log.Printf("Cache use: %0.3f / %d.000 MB (+%0.3f MB)", cacheUse, *cacheSize, cacheAdd)
-
-		return
+		byteChan <- buf.([]byte)
 	}()
 
 	// Wait for an event on read
@@ -199,6 +239,14 @@ func (s SubFile) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
 	// Byte stream channel
 	case stream := <-byteChan:
 		close(byteChan)
+
+		// A nil stream means the fetch failed, either here or in the stream being waited on
+		if stream == nil {
+			if fetchErr == nil {
+				return nil, fuse.EIO
+			}
+			return nil, fuseError(fetchErr)
+		}
 		return stream, nil
 	// Interrupt channel
 	case <-intr:
@@ -214,47 +262,143 @@ func (s SubFile) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
 	}
 }
 
+// fetchStream downloads the whole file, storing it in the cache for later reads
+func (s SubFile) fetchStream() ([]byte, error) {
+	// Open stream, resuming it if interrupted, tracking its progress and rewriting its tags if needed
+	stream, err := s.openStream()
+	_, local := stream.(localCopy)
+	if err == nil {
+		stream = trackDownload(s, resumeStream(s, stream))
+	}
+	if err == nil && s.shouldFixTags() {
+		stream, err = retag(stream, s.tags())
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	// Read in stream
+	file, err := readStream(stream, s.knownSize())
+	if err != nil {
+		log.Println(err)
+		stream.Close()
+		return nil, err
+	}
+
+	// Close stream
+	if err := stream.Close(); err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	log.Printf("Closing stream: [%d] %s", s.ID, s.FileName)
+
+	// Local copies are read again rather than cached, so that they never stand in for the server's copy
+	// in a cache other instances share
+	if local {
+		return file, nil
+	}
+
+	// Calculate actual size upon retrieval, and store file in local cache for later reads
+	s.SetSize(int64(len(file)))
+	s.acct.sfs.cache.Put(s, file)
+	return file, nil
+}
+
 // openStream returns the appropriate io.ReadCloser from a SubFile
 func (s SubFile) openStream() (io.ReadCloser, error) {
+	// Item is a track split from a larger file
+	if s.CueLength > 0 {
+		return s.openCueStream()
+	}
+
 	// Item is art
 	if s.IsArt {
 		log.Printf("Opening art stream: [%d] %s", s.ID, s.FileName)
-
-		// Get cover art stream
-		return subsonic.GetCoverArt(s.ID, -1)
+		stream, _, err := s.openStreamAt(0)
+		return stream, err
 	}
 
 	// Else, item is audio or video
 
-	// Check for lossless audio
+	// Original files are always fetched byte for byte, never substituted with a transcode, so that they
+	// match the server's copy, streamed raw for users not permitted to download.
 	if !s.IsVideo && s.Lossless {
-		// Check if the Subsonic user is permitted to "download" raw files
-		stream, err := subsonic.Download(s.ID)
-		if err != nil && strings.Contains(err.Error(), "not authorized to download files") {
-			// Stream a transcoded file instead
-			log.Printf("Opening transcoded audio stream: [%d] %s", s.ID, s.FileName)
-			return subsonic.Stream(s.ID, nil)
+		if f, ok := s.openLocal(0); ok {
+			return f, nil
 		}
-
-		// Attempt to get media file in raw, non-transcoded form
 		log.Printf("Opening audio stream: [%d] %s", s.ID, s.FileName)
-		return stream, nil
+		stream, _, err := s.acct.openOriginal(s.ID, 0)
+		return stream, err
 	}
 
-	// Stream options, for extra options
-	var streamOptions gosubsonic.StreamOptions
 	if s.IsVideo {
-		// Item is video
-		streamOptions = gosubsonic.StreamOptions{
-			Size: "1280x720",
-		}
-
-		log.Printf("Opening video stream: [%d] %s [%s]", s.ID, s.FileName, streamOptions.Size)
+		log.Printf("Opening video stream: [%d] %s [%s]", s.ID, s.FileName, *videoSize)
 	} else {
-		// Item is audio
 		log.Printf("Opening transcoded audio stream: [%d] %s", s.ID, s.FileName)
 	}
 
-	// Get media file stream
-	return subsonic.Stream(s.ID, &streamOptions)
+	// Get media file stream, through the API like every other request so that it targets the negotiated
+	// API version
+	stream, _, err := s.openStreamAt(0)
+	return stream, err
+}
+
+// openProxy opens a stream of the file for reads starting at offset, beginning there where the server
+// allows, and returns the offset the stream actually begins at
+func (s SubFile) openProxy(offset int64) (io.ReadCloser, int64, error) {
+	// Retagged transcodes differ from the server's stream, so are always read from their start
+	if offset > 0 && !s.shouldFixTags() {
+		stream, partial, err := s.openStreamAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if partial {
+			return stream, offset, nil
+		}
+		return stream, 0, nil
+	}
+
+	stream, err := s.openStream()
+	if err == nil && s.shouldFixTags() {
+		stream, err = retag(stream, s.tags())
+	}
+	return stream, 0, err
+}
+
+// openStreamAt opens the same stream as openStream directly against the Subsonic API, starting at offset
+// where possible.  The returned boolean reports whether the stream actually begins at offset.
+func (s SubFile) openStreamAt(offset int64) (io.ReadCloser, bool, error) {
+	// Tracks split from a larger file can't be resumed, as they are transcoded from a time offset
+	if s.CueLength > 0 {
+		stream, err := s.openCueStream()
+		return stream, false, err
+	}
+
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(s.ID, 10))
+
+	// Item is art
+	if s.IsArt {
+		if s.ArtSize > 0 {
+			params.Set("size", strconv.FormatInt(s.ArtSize, 10))
+		}
+		return apiStream(s.acct, "getCoverArt", params, offset)
+	}
+
+	// Original files are fetched byte for byte, as in openStream
+	if !s.IsVideo && s.Lossless {
+		if f, ok := s.openLocal(offset); ok {
+			return f, true, nil
+		}
+		return s.acct.openOriginal(s.ID, offset)
+	}
+
+	// Item is video
+	if s.IsVideo {
+		params.Set("size", *videoSize)
+		params.Set("maxBitRate", strconv.FormatInt(*videoBitRate, 10))
+	}
+
+	return apiStream(s.acct, "stream", params, offset)
 }
@@ -1,50 +1,23 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
-
-	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
-	"github.com/mdlayher/gosubsonic"
 )
 
-// subsonic stores the instance of the gosubsonic client
-var subsonic gosubsonic.Client
-
-// fileCache maps a file name to its file pointer
-var fileCache map[string]os.File
-
-// filenameTemplate describes how to format a filename
-var filenameTemplate *template.Template
-
-// cacheTotal is the total size of local files in the cache
-var cacheTotal int64
-
-// artistsIndex stores the fetched top-level artists
-var artistsIndex map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist
-
-// indexChan blocks subfs from getting indexes until the cache is populated
-var indexChan chan bool
-
-// streamMap maps a fileID to a channel containing a file stream
-var streamMap map[int64]chan []byte
-
 // cacheSize is the maximum size of the local file cache in megabytes
 var cacheSize = flag.Int64("cache", 100, "Size of the local file cache, in megabytes")
 
-// fileCacheSize stores any corrected transcoded filesizes
-// we find out the corrected size during a Fuse callback,
-// and we don't have a shared reference to a SubFile then
-var fileSizeCache map[int64]int64
-
 // helper method for filename templates
 // Strips the extension from a Path or Filename
 func stripExtension(filename string) string {
@@ -58,6 +31,9 @@ func main() {
 	user := flag.String("user", "", "Username for the Subsonic server")
 	password := flag.String("password", "", "Password for the Subsonic server")
 
+	// Flag for a configuration file, which may define several accounts
+	configPath := flag.String("config", "", "Path to an optional JSON configuration file")
+
 	// Flag for subfs mount point
 	mount := flag.String("mount", "", "Path where subfs will be mounted")
 
@@ -69,17 +45,67 @@ func main() {
 	// {{if eq .A.TranscodedSuffix ""}}{{.Filename}}{{else}}{{ if eq .Suffix "mp3" }}{{.Filename }}.{{.Suffix}}{{else}}{{end}}{{end}}
 	filenameTmpl := flag.String("filenames", "{{printf \"%02d - %s - %s.%s\" .A.Track .A.Artist .A.Title .A.Suffix}}", "Template for filenames")
 
-	// Parse command line flags
+	// Flag for album directory name template, such as "{{.Name}} {{.Stars}}" to show ratings
+	dirnameTmpl := flag.String("dirnames", "{{.Name}}", "Template for album directory names, with .Name, .Artist, .Album, .Year, .Genre, .Rating, .Stars and .Starred")
+
+	// Flags to preview the virtual tree without mounting
+	dryRun := flag.Bool("dry-run", false, "Print the virtual tree below the optional path argument instead of mounting")
+	dryRunDepth := flag.Int("dry-run-depth", 3, "Number of directory levels printed by -dry-run")
+
+	// Parse command line flags, falling back to environment variables
 	flag.Parse()
+	applyEnv()
+	initLogging()
+	if _, ok := readOnlyErrnos[*readOnlyErrno]; !ok {
+		log.Fatalf("Unknown -readonly-errno: %s", *readOnlyErrno)
+	}
 
-	// Open connection to Subsonic
-	sub, err := gosubsonic.New(*host, *user, *password)
-	if err != nil {
-		log.Fatalf("Could not connect to Subsonic server: %s", err.Error())
+	// Serve profiles from the start, so that startup can be measured too
+	if *pprofAddr != "" {
+		servePprof(*pprofAddr)
+	}
+
+	// Load the configuration file, if one is given
+	config := new(Config)
+	if *configPath != "" {
+		var err error
+		config, err = loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Could not load config %s: %s", *configPath, err.Error())
+		}
+	}
+
+	// Compile metadata rewrite rules
+	if err := compileRewrites(config.Rewrites); err != nil {
+		log.Fatalf("Could not load config %s: %s", *configPath, err.Error())
 	}
 
-	// Store subsonic client for global use
-	subsonic = *sub
+	// Gather credentials from flags and the configuration file
+	users := config.Users
+	if *user != "" {
+		users = append([]UserConfig{{Host: *host, User: *user, Password: *password, PasswordFile: *passwordFile}}, users...)
+	}
+	if len(users) == 0 {
+		log.Fatalf("No Subsonic user given, use -user or a configuration file")
+	}
+
+	// Open connections to Subsonic
+	var accounts []*account
+	for _, u := range users {
+		if u.Host == "" {
+			u.Host = *host
+		}
+
+		a, err := newAccount(u)
+		if err != nil {
+			log.Fatalf("Could not connect to Subsonic server as %s: %s", u.User, err.Error())
+		}
+		a.smartPlaylists = config.Playlists
+		a.audiobooks = config.Audiobooks
+		a.version = negotiateAPIVersion(a)
+		a.quirks = detectQuirks(a)
+		accounts = append(accounts, a)
+	}
 
 	// Save other parameters
 	templateFunctions := make(template.FuncMap)
@@ -95,136 +121,171 @@ func main() {
 	templateFunctions["Dir"] = path.Dir
 	templateFunctions["Ext"] = path.Ext
 	templateFunctions["stripExt"] = stripExtension
-	filenameTemplate, err = template.New("filenameTemplate").Funcs(templateFunctions).Parse(*filenameTmpl)
+	addTemplateFunctions(templateFunctions)
+	filenameTemplate, err := template.New("filenameTemplate").Funcs(templateFunctions).Parse(*filenameTmpl)
 	if err != nil {
 		log.Fatalf("Could not parse filenameTemplate: %s", *filenameTmpl)
 	}
 
-	// Initialize file cache
-	fileCache = map[string]os.File{}
-	cacheTotal = 0
-
-	// Initialize index cache
-	artistsIndex = make(map[gosubsonic.MusicFolder][]gosubsonic.IndexArtist)
-	indexChan = make(chan bool, 0)
-	go cacheIndexes()
-
-	// Initialize the updated filesize cache
-	fileSizeCache = make(map[int64]int64)
-
-	// Initialize stream map
-	streamMap = map[int64]chan []byte{}
-
-	// Attempt to mount filesystem
-	c, err := fuse.Mount(*mount)
+	dirnameTemplate, err := template.New("dirnameTemplate").Funcs(templateFunctions).Parse(*dirnameTmpl)
 	if err != nil {
-		log.Fatalf("Could not mount subfs at %s: %s", *mount, err.Error())
+		log.Fatalf("Could not parse dirnameTemplate: %s", *dirnameTmpl)
 	}
 
-	// Serve the FUSE filesystem
-	log.Printf("subfs: %s@%s -> %s [cache: %d MB]", *user, *host, *mount, *cacheSize)
-	go func() {
-		if err := fs.Serve(c, SubFS{}); err != nil {
-			log.Fatalf("Could not serve subfs at %s: %s", *mount, err.Error())
+	// Create the filesystem instance serving every account
+	cache, err := newCache()
+	if err != nil {
+		log.Fatalf("Could not open cache: %s", err.Error())
+	}
+	sfs := newFilesystem(accounts, filenameTemplate, cache)
+	go expireCache(cache)
+	sfs.dirnameTemplate = dirnameTemplate
+
+	// Derive the key for encrypting cached files
+	if *cacheEncrypt {
+		if err := initCacheEncryption(); err != nil {
+			log.Fatalf("Could not enable cache encryption: %s", err.Error())
 		}
-	}()
+	}
 
-	// Wait for termination singals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	signal.Notify(sigChan, syscall.SIGTERM)
-	for sig := range sigChan {
-		log.Println("subfs: caught signal:", sig)
-		break
+	// Initialize index caches, and watch for server outages
+	for _, a := range accounts {
+		go a.cacheIndexes()
+		go a.watchdog()
+		go a.loadServerBookmarks()
+		if *crawl {
+			go a.crawlLibrary()
+		}
 	}
 
-	// Purge all cached files
-	for _, f := range fileCache {
-		// Close file
-		if err := f.Close(); err != nil {
-			log.Println(err)
+	// Mirror a subtree to a local directory and exit in sync mode
+	if flag.Arg(0) == "sync" {
+		if flag.NArg() != 3 {
+			log.Fatalf("Usage: subfs [flags] sync <subsonic-path> <local-dir>")
+		}
+
+		root, _ := sfs.Root()
+		node, err := lookupPath(root, flag.Arg(1))
+		if err != nil {
+			log.Fatalf("Could not find %s: %s", flag.Arg(1), err.Error())
 		}
 
-		// Remove file
-		if err := os.Remove(f.Name()); err != nil {
-			log.Println(err)
+		if err := syncNode(node, path.Base(flag.Arg(1)), flag.Arg(2)); err != nil {
+			log.Fatalf("Could not sync %s: %s", flag.Arg(1), err.Error())
 		}
+
+		log.Printf("subfs: synced %s -> %s", flag.Arg(1), flag.Arg(2))
+		return
 	}
 
-	log.Printf("subfs: removed %d cached file(s)", len(fileCache))
+	// Print the tree and exit when previewing templates
+	if *dryRun {
+		root, _ := sfs.Root()
+		node, err := lookupPath(root, flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Could not find %s: %s", flag.Arg(0), err.Error())
+		}
 
-	// Attempt to unmount the FUSE filesystem
-	retry := 3
-	for i := 0; i < retry+1; i++ {
-		// Wait between attempts
-		if i > 0 {
-			<-time.After(time.Second * 3)
+		if err := printTree(os.Stdout, node, *dryRunDepth, ""); err != nil {
+			log.Fatalf("Could not print tree: %s", err.Error())
 		}
+		return
+	}
 
-		// Try unmount
-		if err := fuse.Unmount(*mount); err != nil {
-			// Force exit on last attempt
-			if i == retry {
-				log.Printf("subfs: could not unmount %s, halting!", *mount)
-				os.Exit(1)
-			}
+	// Remember the absolute mount point, so that generated playlists can refer to files within it
+	if sfs.mountPoint, err = filepath.Abs(*mount); err != nil {
+		sfs.mountPoint = *mount
+	}
 
-			log.Printf("subfs: could not unmount %s, retrying %d of %d...", *mount, i+1, retry)
-		} else {
-			break
-		}
+	// Report health to container orchestrators, if requested
+	if *healthAddr != "" {
+		sfs.serveHealth(*healthAddr)
 	}
 
-	// Close the FUSE filesystem
-	if err := c.Close(); err != nil {
-		log.Fatalf("Could not close subfs: %s", err.Error())
+	// Accept refresh, pin, purge and stats requests, if requested
+	sfs.serveControl()
+
+	// Attempt to mount filesystem
+	checkFuseDevice()
+	serveChan := make(chan error, 1)
+	c, err := sfs.serveMount(*mount, serveChan)
+	if err != nil {
+		log.Fatalf("Could not mount subfs at %s: %s", *mount, err.Error())
 	}
+	sfs.mountViews(config.Views)
 
-	log.Printf("subfs: done!")
-	return
-}
+	// Serve the FUSE filesystem
+	for _, a := range accounts {
+		log.Printf("subfs: %s@%s -> %s [cache: %d MB]", a.User, a.Host, *mount, *cacheSize)
+	}
 
-// cacheIndexes populates and refills the indexes cache at regular intervals
-func cacheIndexes() {
-	// Immediately cache the current index
+	// Wait for termination singals, dumping statistics or purging the cache on request
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	signal.Notify(sigChan, syscall.SIGHUP)
 	for {
-		// Fetch the main folders
-		folders, err := subsonic.GetMusicFolders()
-		if err != nil {
-			log.Printf("Failed to retrieve music folders: %s", err.Error())
-			return
-		}
+		var sig os.Signal
+		select {
+		case sig = <-sigChan:
+		case err := <-serveChan:
+			atomic.StoreInt32(&sfs.alive, 0)
+
+			// An unmount from outside, such as with fusermount -u, asks subfs to exit, but a connection the
+			// kernel aborted leaves a dead mount behind, which is remounted like any other failure
+			if err == nil && stillMounted(*mount) {
+				err = errors.New("connection aborted")
+			}
+			if err == nil {
+				log.Printf("subfs: %s was unmounted", *mount)
+				sfs.unmounted(c)
+				log.Printf("subfs: done!")
+				return
+			}
+			log.Printf("subfs: stopped serving %s: %s", *mount, err.Error())
 
-		// Fetch indexes
-		for _, folder := range folders {
-			// get all the letters of this folder
-			indexes, err := subsonic.GetIndexes(folder.ID, -1)
-			if err != nil {
-				log.Printf("Failed to retrieve indexes: %s", err.Error())
+			// Mount again, or exit nonzero to let a supervisor restart subfs
+			if *remount {
+				c = sfs.remountWithBackoff(*mount, c, serveChan)
 				continue
 			}
+			deadline := time.Now().Add(*shutdownTimeout)
+			sfs.unmountViews(deadline)
+			sfs.releaseCache(deadline)
+			os.Exit(1)
+		}
+
+		if sig == syscall.SIGUSR1 {
+			sfs.logStats()
+			continue
+		}
+
+		if sig == syscall.SIGUSR2 {
+			log.Printf("subfs: purged %d cached file(s)", sfs.cache.Purge())
+			continue
+		}
 
-			// Cache and return indexes
-			artistsIndex[folder] = make([]gosubsonic.IndexArtist, 0)
-			for _, i := range indexes {
-				for _, a := range i.Artist {
-					artistsIndex[folder] = append(artistsIndex[folder], a)
+		if sig == syscall.SIGHUP {
+			for _, a := range accounts {
+				if err := a.reloadCredentials(); err != nil {
+					log.Printf("subfs: could not reload credentials for %s: %s", a.Name, err.Error())
+					continue
 				}
+				log.Printf("subfs: reloaded credentials for %s", a.Name)
 			}
-			log.Printf("Caching %d artists", len(artistsIndex[folder]))
+			continue
 		}
-		log.Printf("Finished caching artists")
-		indexChan <- true
 
-		// Repeat at regular intervals
-		<-time.After(10 * time.Minute)
+		log.Println("subfs: caught signal:", sig)
+		break
 	}
-}
+	atomic.StoreInt32(&sfs.alive, 0)
 
-// SubFS represents the root of the filesystem
-type SubFS struct{}
+	// Unmount the FUSE filesystem and release the cache, within -shutdown-timeout
+	sfs.shutdown(*mount, c)
 
-// Root is called to get the root directory node of this filesystem
-func (fs SubFS) Root() (fs.Node, fuse.Error) {
-	return NewSubDir(-1, true, false), nil
+	log.Printf("subfs: done!")
+	return
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// syncNode mirrors a node of the virtual tree into the local directory dest
+func syncNode(node fs.Node, name string, dest string) error {
+	// Files are copied directly into the destination directory
+	if f, ok := node.(SubFile); ok {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		return syncFile(f, filepath.Join(dest, name))
+	}
+
+	return syncTree(node, dest)
+}
+
+// syncTree recursively mirrors the directory node into the local directory dest, through generated
+// directories such as disc folders, layouts and playlists as well as the server's
+func syncTree(node fs.Node, dest string) error {
+	dir, ok := node.(fs.HandleReadDirer)
+	if !ok {
+		return fmt.Errorf("%s: not a directory", dest)
+	}
+	lookup, ok := node.(fs.NodeStringLookuper)
+	if !ok {
+		return fmt.Errorf("%s: not a directory", dest)
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	entries, err := dir.ReadDir(nil)
+	if err != nil {
+		return fmt.Errorf("failed to read directory for %s: %v", dest, err)
+	}
+
+	for _, e := range entries {
+		target := filepath.Join(dest, e.Name)
+
+		// Hidden entries such as .subfs control subfs rather than hold the library
+		if strings.HasPrefix(e.Name, ".") {
+			continue
+		}
+
+		child, lerr := lookup.Lookup(e.Name, nil)
+		if lerr != nil {
+			log.Printf("sync: failed to find %s: %v", target, lerr)
+			continue
+		}
+
+		switch c := child.(type) {
+		case SubFile:
+			// Keep going when a single file fails, so one bad track doesn't abort the whole sync
+			if err := syncFile(c, target); err != nil {
+				log.Printf("sync: failed to copy %s: %s", target, err.Error())
+			}
+		case fs.HandleReadDirer:
+			// Recurse into directories
+			if err := syncTree(child, target); err != nil {
+				return err
+			}
+		case fs.HandleReadAller:
+			// Generated files, such as playlists and notes, are written as they are now
+			if err := syncGenerated(c, target); err != nil {
+				log.Printf("sync: failed to write %s: %s", target, err.Error())
+			}
+		default:
+			log.Printf("sync: skipping %s", target)
+		}
+	}
+
+	return nil
+}
+
+// syncGenerated writes the current content of a generated file to target
+func syncGenerated(f fs.HandleReadAller, target string) error {
+	data, err := f.ReadAll(nil)
+	if err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	return ioutil.WriteFile(target, data, 0644)
+}
+
+// syncFile downloads a single file to target, skipping files which are already up to date and
+// resuming any partial download left behind by a previous run
+func syncFile(s SubFile, target string) error {
+	// Files are stamped with their creation time once complete, so a matching mtime means up to date
+	if info, err := os.Stat(target); err == nil && (s.Created.IsZero() || info.ModTime().Equal(s.Created)) {
+		return nil
+	}
+
+	// Check for a partial download to resume, unless tags are rewritten which shifts every offset
+	partName := target + ".part"
+	var offset int64
+	if info, err := os.Stat(partName); err == nil && !s.shouldFixTags() {
+		offset = info.Size()
+	}
+
+	stream, partial, err := s.openStreamAt(offset)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if s.shouldFixTags() {
+		tagged, err := retag(stream, s.tags())
+		if err != nil {
+			return err
+		}
+		stream = tagged
+	}
+
+	// Start over if the server could not resume from the requested offset
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !partial {
+		offset = 0
+		flags |= os.O_TRUNC
+	}
+
+	part, err := os.OpenFile(partName, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		log.Printf("sync: resuming %s at %d bytes", target, offset)
+	} else {
+		log.Printf("sync: copying %s", target)
+	}
+
+	n, err := copyStream(part, stream)
+	if err != nil {
+		part.Close()
+		return err
+	}
+
+	if err := part.Close(); err != nil {
+		return err
+	}
+
+	// Move the completed file into place
+	if err := os.Rename(partName, target); err != nil {
+		return err
+	}
+
+	// Record the file's actual size, as transcoded files are only estimated
+	s.SetSize(offset + n)
+
+	if s.Created.IsZero() {
+		return nil
+	}
+	return os.Chtimes(target, time.Now(), s.Created)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/mdlayher/gosubsonic"
+)
+
+// fixTags enables rewriting the tags of transcoded streams from Subsonic's metadata
+var fixTags = flag.Bool("fix-tags", false, "Replace the tags of transcoded MP3 streams with tags built from Subsonic metadata")
+
+// trackTags holds the metadata used to build tags for a served file
+type trackTags struct {
+	Title  string
+	Artist string
+	Album  string
+	Track  int64
+	Year   int64
+	Genre  string
+
+	// Extra holds user-defined text frames, keyed by description
+	Extra map[string]string
+}
+
+// tags returns the tags to write into this file's stream
+func (s SubFile) tags() trackTags {
+	tags := s.Tags
+	if *replayGainTags {
+		tags.Extra = s.ReplayGain.values()
+	}
+	return tags
+}
+
+// audioTags returns the tags describing an audio file
+func audioTags(a gosubsonic.Audio) trackTags {
+	return trackTags{
+		Title:  a.Title,
+		Artist: a.Artist,
+		Album:  a.Album,
+		Track:  a.Track,
+		Year:   a.Year,
+		Genre:  a.Genre,
+	}
+}
+
+// shouldFixTags reports whether a file's stream has its tags rewritten.  Original files are always
+// served untouched, so only transcodes are affected, and only MP3 ones since the tag written is ID3v2.
+func (s SubFile) shouldFixTags() bool {
+	return *fixTags && !s.Lossless && !s.IsVideo && !s.IsArt && s.isMPEGAudio()
+}
+
+// tagReadCloser serves a rewritten tag followed by the remainder of the original stream
+type tagReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// skipID3v2 returns the rest of an MP3 stream after any ID3v2 tag at its start
+func skipID3v2(stream io.Reader) (io.Reader, error) {
+	header := make([]byte, 10)
+	n, err := io.ReadFull(stream, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+	if n < 10 || string(header[:3]) != "ID3" {
+		return io.MultiReader(bytes.NewReader(header), stream), nil
+	}
+
+	// The tag's size is a 28-bit syncsafe integer, and a footer doubles the header at the end of the tag
+	size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+	if header[5]&0x10 != 0 {
+		size += 10
+	}
+	if _, err := io.CopyN(ioutil.Discard, stream, size); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// retag replaces any ID3v2 tag at the start of an MP3 stream with one built from tags.  The stream
+// is rewritten on the fly, so the original tag is skipped without buffering the file.
+func retag(stream io.ReadCloser, tags trackTags) (io.ReadCloser, error) {
+	rest, err := skipID3v2(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return tagReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(id3v2Tag(tags)), rest),
+		Closer: stream,
+	}, nil
+}
+
+// id3v2Tag builds an ID3v2.3 tag containing the given metadata
+func id3v2Tag(tags trackTags) []byte {
+	var frames bytes.Buffer
+	writeFrame := func(id string, value string) {
+		if value == "" {
+			return
+		}
+
+		data := id3Text(value)
+		frames.WriteString(id)
+		binary.Write(&frames, binary.BigEndian, uint32(len(data)))
+		frames.Write([]byte{0, 0})
+		frames.Write(data)
+	}
+
+	writeFrame("TIT2", tags.Title)
+	writeFrame("TPE1", tags.Artist)
+	writeFrame("TALB", tags.Album)
+	if tags.Track > 0 {
+		writeFrame("TRCK", strconv.FormatInt(tags.Track, 10))
+	}
+	if tags.Year > 0 {
+		writeFrame("TYER", strconv.FormatInt(tags.Year, 10))
+	}
+	writeFrame("TCON", tags.Genre)
+
+	// User-defined text frames hold a description followed by the value, in the same encoding
+	names := make([]string, 0, len(tags.Extra))
+	for name := range tags.Extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeFrame("TXXX", name+"\x00"+tags.Extra[name])
+	}
+
+	// The tag size is a 28-bit syncsafe integer, excluding the header
+	size := frames.Len()
+	tag := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size>>21) & 0x7f, byte(size>>14) & 0x7f, byte(size>>7) & 0x7f, byte(size) & 0x7f}
+
+	return append(tag, frames.Bytes()...)
+}
+
+// id3Text encodes a text frame's value, using ISO-8859-1 where possible and UTF-16 otherwise
+func id3Text(value string) []byte {
+	latin1 := true
+	for _, r := range value {
+		if r > 0xff {
+			latin1 = false
+			break
+		}
+	}
+
+	if latin1 {
+		data := []byte{0}
+		for _, r := range value {
+			data = append(data, byte(r))
+		}
+		return data
+	}
+
+	// UTF-16 with a little-endian byte order mark
+	data := []byte{1, 0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune(value)) {
+		data = append(data, byte(u), byte(u>>8))
+	}
+	return data
+}
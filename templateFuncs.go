@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// addTemplateFunctions adds helpers for complex naming schemes to the filename template functions
+func addTemplateFunctions(funcs template.FuncMap) {
+	funcs["Pad"] = padNumber
+	funcs["ReplaceRegex"] = replaceRegex
+	funcs["Slugify"] = slugify
+	funcs["Transliterate"] = transliterate
+	funcs["Truncate"] = truncateRunes
+	funcs["Date"] = formatDate
+}
+
+// padNumber zero-pads a number to width digits, as in {{Pad 3 .Track}}
+func padNumber(width int, n int64) string {
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// replaceRegex replaces every match of a regular expression, as in {{ReplaceRegex " \\(.*\\)$" "" .Title}}
+func replaceRegex(pattern string, replacement string, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+// slugify lowercases a string and joins its ASCII letters and digits with dashes, as in "sigur-ros".  Names
+// without any, such as those written in Japanese, are only lowercased and have their spaces dashed.
+func slugify(s string) string {
+	var slug []rune
+	dash := false
+	for _, r := range strings.ToLower(transliterate(s)) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && len(slug) > 0 {
+				slug = append(slug, '-')
+			}
+			slug = append(slug, r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	if len(slug) == 0 {
+		return strings.Join(strings.Fields(strings.ToLower(s)), "-")
+	}
+	return string(slug)
+}
+
+// transliterations maps non-ASCII letters onto their closest ASCII spelling
+var transliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'Þ': "Th", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Ā': "A", 'ā': "a", 'Ă': "A", 'ă': "a", 'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c",
+	'Č': "C", 'č': "c", 'Ď': "D", 'ď': "d", 'Đ': "D", 'đ': "d", 'Ē': "E", 'ē': "e",
+	'Ė': "E", 'ė': "e", 'Ę': "E", 'ę': "e", 'Ě': "E", 'ě': "e", 'Ğ': "G", 'ğ': "g",
+	'Ī': "I", 'ī': "i", 'Į': "I", 'į': "i", 'İ': "I", 'ı': "i", 'Ł': "L", 'ł': "l",
+	'Ń': "N", 'ń': "n", 'Ň': "N", 'ň': "n", 'Ō': "O", 'ō': "o", 'Ő': "O", 'ő': "o",
+	'Œ': "OE", 'œ': "oe", 'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ţ': "T", 'ţ': "t", 'Ť': "T", 'ť': "t", 'Ū': "U", 'ū': "u",
+	'Ů': "U", 'ů': "u", 'Ű': "U", 'ű': "u", 'Ų': "U", 'ų': "u", 'Ÿ': "Y", 'Ź': "Z",
+	'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+	'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+}
+
+// transliterate replaces non-ASCII characters with their closest ASCII spelling, dropping any without one.
+// Names left with nothing but spaces, such as those written in Japanese, are kept as they are instead.
+func transliterate(s string) string {
+	var out []rune
+	for _, r := range s {
+		switch {
+		case r < unicode.MaxASCII:
+			out = append(out, r)
+		case transliterations[r] != "":
+			out = append(out, []rune(transliterations[r])...)
+		case unicode.IsSpace(r):
+			out = append(out, ' ')
+		}
+	}
+	if strings.TrimSpace(string(out)) == "" {
+		return s
+	}
+	return string(out)
+}
+
+// truncateRunes shortens a string to at most n characters
+func truncateRunes(n int, s string) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
+
+// formatDate formats a time with a Go layout, as in {{Date "2006-01-02" .Created}}
+func formatDate(layout string, t time.Time) string {
+	return t.Format(layout)
+}
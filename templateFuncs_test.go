@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestTransliterate checks that names are spelled in ASCII where they can be, and otherwise kept
+func TestTransliterate(t *testing.T) {
+	for name, want := range map[string]string{
+		"Sigur Rós":    "Sigur Ros",
+		"Motörhead":    "Motorhead",
+		"坂本龍一":         "坂本龍一",
+		"Björk – 坂本龍一": "Bjork - ",
+	} {
+		if got := transliterate(name); got != want {
+			t.Errorf("transliterate(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestSlugify checks that slugs are never empty for a name which isn't
+func TestSlugify(t *testing.T) {
+	for name, want := range map[string]string{
+		"Sigur Rós":      "sigur-ros",
+		"AC/DC":          "ac-dc",
+		"坂本龍一":           "坂本龍一",
+		"Yellow 魔術 Band": "yellow-band",
+		"坂本 龍一":          "坂本-龍一",
+	} {
+		if got := slugify(name); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"path"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// thumbnailBurst and thumbnailWindow detect thumbnailers, which open every file of a directory at once to
+// read their headers, and thumbnailEIO refuses them outright
+var thumbnailBurst = flag.Int("thumbnail-burst", 0, "Number of files opened in one directory within -thumbnail-window taken as a thumbnailer, whose reads of files not yet cached are answered from metadata instead of the server, or 0 to turn off")
+var thumbnailWindow = flag.Duration("thumbnail-window", 2*time.Second, "Time within which -thumbnail-burst opens are taken as a thumbnailer")
+var thumbnailEIO = flag.Bool("thumbnail-eio", false, "Fail a thumbnailer's reads of files not yet cached with EIO, rather than answering them from metadata")
+
+// thumbnailHeader is how far into a file a thumbnailer's reads are answered from metadata, enough for the
+// headers they look at.  A read past it is taken as the file being played, which is then read as usual.
+const thumbnailHeader = 256 * 1024
+
+// noteOpen records the opening of a file, reporting whether it is part of a burst of opens in its
+// directory, as made by a thumbnailer
+func (sfs *Filesystem) noteOpen(s SubFile) bool {
+	if *thumbnailBurst <= 0 || s.IsArt {
+		return false
+	}
+	dir := s.acct.Name + "/" + path.Dir(s.Path)
+	now := time.Now()
+
+	sfs.burstLock.Lock()
+	defer sfs.burstLock.Unlock()
+
+	// Forget opens which have left the window, in this directory and any other
+	cutoff := now.Add(-*thumbnailWindow)
+	for d, opens := range sfs.bursts {
+		if len(opens) > 0 && opens[len(opens)-1].Before(cutoff) {
+			delete(sfs.bursts, d)
+		}
+	}
+	opens := sfs.bursts[dir]
+	for len(opens) > 0 && opens[0].Before(cutoff) {
+		opens = opens[1:]
+	}
+	opens = append(opens, now)
+	sfs.bursts[dir] = opens
+
+	if len(opens) == *thumbnailBurst {
+		log.Printf("subfs: %d files opened at once in %s, answering their reads from metadata", len(opens), path.Dir(s.Path))
+	}
+	return len(opens) >= *thumbnailBurst
+}
+
+// readThumbnail answers a thumbnailer's read of the headers of a file not yet cached from its metadata
+// alone: MP3 files hold only an ID3 tag built from it, and everything else appears empty.  Reads of cached
+// files aren't answered here, and neither is any read once one went past the headers.
+func (h *fileHandle) readThumbnail(req *fuse.ReadRequest) ([]byte, bool, fuse.Error) {
+	h.lock.Lock()
+	if h.thumbnail && req.Offset >= thumbnailHeader {
+		h.thumbnail = false
+	}
+	thumbnail := h.thumbnail
+	cached := thumbnail && (h.data != nil || h.openCached())
+	h.lock.Unlock()
+	if !thumbnail || cached {
+		return nil, false, nil
+	}
+
+	if *thumbnailEIO {
+		return nil, true, fuse.EIO
+	}
+	if h.file.IsVideo || !h.file.isMPEGAudio() {
+		return []byte{}, true, nil
+	}
+
+	tag := id3v2Tag(h.file.tags())
+	if req.Offset >= int64(len(tag)) {
+		return []byte{}, true, nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(tag)) {
+		end = int64(len(tag))
+	}
+	return tag[req.Offset:end], true, nil
+}
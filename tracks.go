@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// mountPath returns the absolute path of this account's root directory
+func (a *account) mountPath() string {
+	if len(a.sfs.accounts) > 1 {
+		return filepath.Join(a.sfs.mountPoint, a.Name)
+	}
+	return a.sfs.mountPoint
+}
+
+// trackPath returns the absolute path at which a song can be opened by ID within the mount
+func (a *account) trackPath(c apiChild) string {
+	return filepath.Join(a.mountPath(), ".subfs", "tracks", fmt.Sprintf("%d.%s", c.ID, c.Suffix))
+}
+
+// newControlDir returns the hidden .subfs directory for an account
+func newControlDir(a *account) VirtualDir {
+	return newStaticDir(map[string]fs.Node{
+		"downloads": newVirtualFile(0, func() ([]byte, error) {
+			return a.sfs.downloadStatus(a), nil
+		}),
+		"server": newVirtualFile(0, func() ([]byte, error) {
+			return a.serverStatus(), nil
+		}),
+		"tracks":  TracksDir{acct: a},
+		"search":  SearchFile{acct: a},
+		"results": newResultsDir(a),
+	})
+}
+
+// TracksDir resolves songs by ID, as <id>.<suffix>, so that generated playlists can refer to any song
+// regardless of where it lives in the tree.  It can't be listed.
+type TracksDir struct {
+	VirtualDir
+	acct *account
+}
+
+// Lookup fetches the song named by ID, served as the original file or a transcode depending on suffix
+func (d TracksDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	ext := path.Ext(name)
+	id, err := strconv.ParseInt(strings.TrimSuffix(name, ext), 10, 64)
+	if err != nil || ext == "" {
+		return nil, fuse.ENOENT
+	}
+	ext = ext[1:]
+
+	value, ferr := withDeadline("lookup of "+name, intr, func() (interface{}, fuse.Error) {
+		c, err := fetchSong(d.acct, id)
+		if err != nil {
+			return nil, fuseError(err)
+		}
+		return c, nil
+	})
+	if ferr != nil {
+		return nil, ferr
+	}
+	c := value.(*apiChild)
+
+	var f SubFile
+	switch {
+	case ext == c.Suffix:
+		f = newAudioFile(d.acct, *c, true)
+	case ext == c.transcodedSuffix():
+		f = newAudioFile(d.acct, *c, false)
+	default:
+		return nil, fuse.ENOENT
+	}
+
+	f.FileName = name
+	return f, nil
+}
+
+// ReadDir returns no entries, as every song on the server would be far too many
+func (d TracksDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	return []fuse.Dirent{}, nil
+}
+
+// fetchSong retrieves a single song by ID
+func fetchSong(a *account, id int64) (*apiChild, error) {
+	params := url.Values{}
+	params.Set("id", strconv.FormatInt(id, 10))
+
+	var res struct {
+		Song apiChild `json:"song"`
+	}
+	if err := apiGet(a, "getSong", params, &res); err != nil {
+		return nil, err
+	}
+
+	return &res.Song, nil
+}
+
+// playlistM3U renders an extended M3U playlist of songs, referring to each by its path within the mount
+func playlistM3U(a *account, songs []apiChild) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, c := range songs {
+		fmt.Fprintf(&buf, "#EXTINF:%d,%s - %s\n", c.Duration, c.Artist, c.Title)
+		fmt.Fprintf(&buf, "%s\n", a.trackPath(c))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse/fs"
+)
+
+// variousArtists adds the Various Artists directory, gathering compilations in one place
+var variousArtists = flag.Bool("various-artists", false, "Add a Various Artists directory of compilation albums")
+
+// variousArtistsName is the name of the directory of compilations
+const variousArtistsName = "Various Artists"
+
+// variousNames lists album artists which mark an album as a compilation, in lower case
+var variousNames = map[string]bool{
+	"various artists": true,
+	"various":         true,
+	"va":              true,
+	"v.a.":            true,
+}
+
+// compilationArtists is the fewest distinct artists among an album's songs which make it a compilation
+const compilationArtists = 3
+
+// isCompilation returns whether an album is a compilation, as flagged by OpenSubsonic servers or by its
+// album artist, or as guessed from its known songs being by many different artists
+func (album id3Album) isCompilation(known map[apiInt][]apiChild) bool {
+	if album.IsCompilation || variousNames[strings.ToLower(strings.TrimSpace(album.Artist))] {
+		return true
+	}
+	for _, releaseType := range album.ReleaseTypes {
+		if strings.EqualFold(releaseType, "compilation") {
+			return true
+		}
+	}
+
+	// Most songs of a compilation are by an artist of their own
+	songs := known[album.ID]
+	artists := map[string]bool{}
+	for _, c := range songs {
+		artists[strings.ToLower(c.Artist)] = true
+	}
+	return len(artists) >= compilationArtists && len(artists)*2 > len(songs)
+}
+
+// compilationSet is an account's compilation albums, and the artists whose known songs are all on them,
+// found at most once per layoutTTL
+type compilationSet struct {
+	sync.Mutex
+	albums  []id3Album
+	artists map[string]bool
+	found   time.Time
+}
+
+// compilations returns the account's compilation albums, along with the lower case names of artists who
+// have no album of their own and whose known songs are all on compilations
+func (a *account) compilations() ([]id3Album, map[string]bool, error) {
+	a.various.Lock()
+	defer a.various.Unlock()
+
+	if a.various.albums != nil && time.Since(a.various.found) < layoutTTL {
+		return a.various.albums, a.various.artists, nil
+	}
+
+	albums, err := allAlbums(a)
+	if err != nil {
+		log.Printf("subfs: failed to retrieve album list: %s", err.Error())
+		return nil, nil, err
+	}
+
+	// Group the known songs by album, for guessing at untagged compilations
+	known := map[apiInt][]apiChild{}
+	for _, c := range a.songs.matching(func(c apiChild) bool { return c.AlbumID != 0 }) {
+		known[c.AlbumID] = append(known[c.AlbumID], c)
+	}
+
+	// Artists credited with an album, or a song on one, which isn't a compilation keep their directory
+	compilations := []id3Album{}
+	own := map[string]bool{}
+	for _, album := range albums {
+		if album.isCompilation(known) {
+			compilations = append(compilations, album)
+			continue
+		}
+		own[strings.ToLower(album.Artist)] = true
+		for _, c := range known[album.ID] {
+			own[strings.ToLower(c.Artist)] = true
+		}
+	}
+
+	artists := map[string]bool{}
+	for _, album := range compilations {
+		for _, c := range known[album.ID] {
+			if name := strings.ToLower(c.Artist); !own[name] {
+				artists[name] = true
+			}
+		}
+	}
+
+	a.various.albums, a.various.artists, a.various.found = compilations, artists, time.Now()
+	return compilations, artists, nil
+}
+
+// compilationOnly reports whether an artist's known songs are all on compilations, so that their directory
+// is left out of listings in favour of the Various Artists directory
+func (a *account) compilationOnly(artist string) bool {
+	if !*variousArtists {
+		return false
+	}
+	_, artists, err := a.compilations()
+	return err == nil && artists[strings.ToLower(artist)]
+}
+
+// newVariousArtistsDir returns the Various Artists directory, holding a directory per compilation album
+func newVariousArtistsDir(a *account) VirtualDir {
+	return newCachedDir(layoutTTL, func() (map[string]fs.Node, error) {
+		compilations, _, err := a.compilations()
+		if err != nil {
+			return nil, err
+		}
+
+		// Qualify albums sharing a title with their year or ID
+		names, years := nameCounter{}, nameCounter{}
+		for _, album := range compilations {
+			name := limitName(sanitizeName(rewrite("album", album.Name)), int64(album.ID))
+			names[name]++
+			years[fmt.Sprintf("%s (%d)", name, album.Year)]++
+		}
+
+		entries := map[string]fs.Node{}
+		for _, album := range compilations {
+			albumID := int64(album.ID)
+			name := names.qualify(limitName(sanitizeName(rewrite("album", album.Name)), albumID), album.Year, albumID, years)
+			entries[name] = albumSongsDir(a, albumID)
+		}
+		return entries, nil
+	})
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/mdlayher/gosubsonic"
+)
+
+// videoSize and videoBitRate choose the transcode videos are streamed as, from which their size is estimated
+var videoSize = flag.String("video-size", "1280x720", "Resolution videos are transcoded to by the server")
+var videoBitRate = flag.Int64("video-bitrate", 2000, "Maximum bit rate in kbps of transcoded videos, also used to estimate their size")
+
+// estimateVideoSize estimates the size of a video's transcode from its duration at -video-bitrate, as
+// the server's transcode bears no relation to the original's size.  The estimate is corrected once the
+// video has been read in full.
+func estimateVideoSize(v gosubsonic.Video) int64 {
+	if v.DurationRaw == 0 || *videoBitRate <= 0 {
+		return v.Size
+	}
+	return ((v.DurationRaw * *videoBitRate) / 8) * 1024
+}
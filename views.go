@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// viewFS serves one directory of an instance's tree as the root of a mount of its own, so that several
+// views share the instance's accounts, client and cache
+type viewFS struct {
+	sfs  *Filesystem
+	path string
+}
+
+// Root finds the directory shown by this view
+func (v viewFS) Root() (fs.Node, fuse.Error) {
+	root, err := v.sfs.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	node, lerr := lookupPath(root, v.path)
+	if lerr != nil {
+		log.Printf("subfs: could not find %s for a view: %s", v.path, lerr.Error())
+		return nil, fuse.ENOENT
+	}
+	if !node.Attr().Mode.IsDir() {
+		log.Printf("subfs: could not show %s as a view: not a directory", v.path)
+		return nil, fuse.ENOENT
+	}
+	return node, nil
+}
+
+// mountedView is a view being served, to be unmounted at exit
+type mountedView struct {
+	dir  string
+	conn *fuse.Conn
+}
+
+// mountViews mounts each view given in the configuration file, serving them in the background.  A view
+// which stops being served is only logged, leaving the others and the main mount running.
+func (sfs *Filesystem) mountViews(views []ViewConfig) {
+	for _, v := range views {
+		if v.Mount == "" {
+			log.Fatalf("Could not mount a view of %q: no mount point given", v.Path)
+		}
+
+		c, err := fuse.Mount(v.Mount)
+		if err != nil {
+			log.Fatalf("Could not mount view of %q at %s: %s", v.Path, v.Mount, err.Error())
+		}
+		sfs.views = append(sfs.views, mountedView{dir: v.Mount, conn: c})
+		log.Printf("subfs: view of %q -> %s", v.Path, v.Mount)
+
+		go func(v ViewConfig) {
+			if err := fs.Serve(c, viewFS{sfs: sfs, path: v.Path}); err != nil {
+				log.Printf("subfs: stopped serving view at %s: %s", v.Mount, err.Error())
+			}
+		}(v)
+	}
+}
+
+// unmountViews unmounts every view, detaching any still busy at deadline lazily
+func (sfs *Filesystem) unmountViews(deadline time.Time) {
+	for _, v := range sfs.views {
+		if err := unmount(v.dir, deadline); err != nil {
+			log.Printf("subfs: could not unmount view at %s: %s", v.dir, err.Error())
+			continue
+		}
+		if err := v.conn.Close(); err != nil {
+			log.Printf("subfs: could not close view at %s: %s", v.dir, err.Error())
+		}
+	}
+	sfs.views = nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// VirtualDir is a read-only directory whose entries are generated by subfs, rather than
+// fetched as a Subsonic directory
+type VirtualDir struct {
+	readOnlyDir
+
+	entries func() (map[string]fs.Node, error)
+
+	// xattrs returns the extended attributes describing this directory, if any
+	xattrs func() map[string]string
+
+	// identity is the account and path this directory was reached at, with -reexport
+	identity string
+}
+
+// newStaticDir returns a VirtualDir with a fixed set of entries
+func newStaticDir(entries map[string]fs.Node) VirtualDir {
+	return VirtualDir{
+		entries: func() (map[string]fs.Node, error) {
+			return entries, nil
+		},
+	}
+}
+
+// newCachedDir returns a VirtualDir which keeps its generated entries until ttl has passed
+func newCachedDir(ttl time.Duration, entries func() (map[string]fs.Node, error)) VirtualDir {
+	return newExpiringDir(ttl, nil, entries)
+}
+
+// newExpiringDir returns a VirtualDir which keeps its generated entries until ttl has passed, or until
+// generation returns a different value, if given
+func newExpiringDir(ttl time.Duration, generation func() int64, entries func() (map[string]fs.Node, error)) VirtualDir {
+	cache := struct {
+		sync.Mutex
+		entries    map[string]fs.Node
+		generated  time.Time
+		generation int64
+	}{}
+	current := func() int64 {
+		if generation == nil {
+			return 0
+		}
+		return generation()
+	}
+
+	return VirtualDir{
+		entries: func() (map[string]fs.Node, error) {
+			cache.Lock()
+			defer cache.Unlock()
+
+			if cache.entries != nil && time.Since(cache.generated) < ttl && cache.generation == current() {
+				return cache.entries, nil
+			}
+
+			gen := current()
+			generated, err := entries()
+			if err != nil {
+				return nil, err
+			}
+
+			cache.entries = generated
+			cache.generated = time.Now()
+			cache.generation = gen
+			return generated, nil
+		},
+	}
+}
+
+// Attr retrives the attributes for this VirtualDir
+func (d VirtualDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Inode: virtualInode(d.identity),
+		Mode:  os.ModeDir | 0555,
+		Nlink: dirNlink,
+	}
+}
+
+// Lookup finds a generated entry by name
+func (d VirtualDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
+	// Probes from file managers never exist, so don't generate the entries for them
+	if isProbe(name) {
+		return nil, fuse.ENOENT
+	}
+
+	return lookupWithin("lookup of "+name, intr, func() (fs.Node, fuse.Error) {
+		entries, err := d.entries()
+		if err != nil {
+			return nil, fuseError(err)
+		}
+
+		if node, ok := entries[name]; ok {
+			if d.identity != "" {
+				node = placeVirtual(node, d.identity+"/"+name)
+			}
+			return node, nil
+		}
+		return nil, fuse.ENOENT
+	})
+}
+
+// attrs returns the extended attributes describing this directory
+func (d VirtualDir) attrs() map[string]string {
+	if d.xattrs == nil {
+		return map[string]string{}
+	}
+	return d.xattrs()
+}
+
+// Getxattr returns an extended attribute of this directory
+func (d VirtualDir) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	return getxattr(d.attrs(), req, resp)
+}
+
+// Listxattr lists the extended attributes of this directory
+func (d VirtualDir) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	return listxattr(d.attrs(), resp)
+}
+
+// ReadDir returns a directory entry for each generated entry
+func (d VirtualDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	return readDirWithin("listing", intr, func() ([]fuse.Dirent, fuse.Error) {
+		entries, err := d.entries()
+		if err != nil {
+			return nil, fuseError(err)
+		}
+
+		directories := direntsFor(entries)
+		if *reexport && d.identity != "" {
+			for i, entry := range directories {
+				directories[i].Inode = entryInode(entries[entry.Name], d.identity+"/"+entry.Name)
+			}
+		}
+		return directories, nil
+	})
+}
+
+// direntsFor returns sorted directory entries for a set of nodes
+func direntsFor(entries map[string]fs.Node) []fuse.Dirent {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sortNames(names)
+
+	directories := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		// Directories are told apart by type, as the attributes of generated files may be costly
+		entryType := fuse.DT_File
+		if _, ok := entries[name].(fs.HandleReadDirer); ok {
+			entryType = fuse.DT_Dir
+		}
+
+		directories = append(directories, fuse.Dirent{
+			Name: name,
+			Type: entryType,
+		})
+	}
+	return directories
+}
+
+// VirtualFile is a read-only file whose content is generated on demand, and kept for a while
+type VirtualFile struct {
+	readOnlyFile
+
+	content func() ([]byte, error)
+	cache   *virtualContent
+
+	// identity is the account and path this file was reached at, with -reexport
+	identity string
+}
+
+// virtualContent is the most recently generated content of a VirtualFile
+type virtualContent struct {
+	sync.Mutex
+	data      []byte
+	generated time.Time
+	ttl       time.Duration
+}
+
+// newVirtualFile returns a VirtualFile which regenerates its content after ttl has passed
+func newVirtualFile(ttl time.Duration, content func() ([]byte, error)) VirtualFile {
+	return VirtualFile{
+		content: content,
+		cache: &virtualContent{
+			ttl: ttl,
+		},
+	}
+}
+
+// data returns the file's content, generating it if needed
+func (f VirtualFile) data() ([]byte, error) {
+	f.cache.Lock()
+	defer f.cache.Unlock()
+
+	if f.cache.data != nil && time.Since(f.cache.generated) < f.cache.ttl {
+		return f.cache.data, nil
+	}
+
+	data, err := f.content()
+	if err != nil {
+		return nil, err
+	}
+
+	f.cache.data = data
+	f.cache.generated = time.Now()
+	return data, nil
+}
+
+// Attr returns file attributes without generating the content, which listings and stat don't wait for.
+// The size is that of the content last generated, or 0 until it is first read.
+func (f VirtualFile) Attr() fuse.Attr {
+	f.cache.Lock()
+	size := uint64(len(f.cache.data))
+	f.cache.Unlock()
+
+	return fuse.Attr{
+		Inode:  virtualInode(f.identity),
+		Mode:   0444,
+		Size:   size,
+		Blocks: blocks(size),
+		Nlink:  1,
+	}
+}
+
+// Open reads the file with direct I/O, so that reads return the whole content rather than stopping at a
+// size reported before it was generated
+func (f VirtualFile) Open(req *fuse.OpenRequest, resp *fuse.OpenResponse, intr fs.Intr) (fs.Handle, fuse.Error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+// ReadAll returns the file's generated content
+func (f VirtualFile) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
+	value, err := withDeadline("generated file", intr, func() (interface{}, fuse.Error) {
+		data, err := f.data()
+		if err != nil {
+			return nil, fuseError(err)
+		}
+		return data, nil
+	})
+	data, _ := value.([]byte)
+	return data, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// pingInterval is the time between checks that each server is reachable
+var pingInterval = flag.Duration("ping-interval", 30*time.Second, "Interval between checks that the Subsonic server is reachable")
+
+// offlineThreshold is the number of consecutive failed pings before a server is considered offline
+const offlineThreshold = 3
+
+// errOffline is returned for requests which need a server that is currently offline
+var errOffline = errors.New("subsonic: server is offline")
+
+// watchdog periodically pings the server, switching the account into degraded mode after repeated
+// failures, and back once the server responds again.  Each successful ping, starting with the one made
+// at mount, also refreshes the server's info.
+func (a *account) watchdog() {
+	for {
+		var ping struct {
+			Version       string `json:"version"`
+			ServerVersion string `json:"serverVersion"`
+		}
+		_, _, client := clients()
+		err := apiGetWith(client, a, "ping", url.Values{}, &ping)
+		if isAuthError(err) {
+			// The server is up but refuses the credentials, which fail requests with EACCES rather than
+			// serving only cached files
+			atomic.StoreInt64(&a.pingFailures, 0)
+			atomic.StoreInt64(&a.lastContact, time.Now().Unix())
+			atomic.StoreInt32(&a.offline, 0)
+		} else if err != nil {
+			failures := atomic.AddInt64(&a.pingFailures, 1)
+			if failures == offlineThreshold {
+				atomic.StoreInt32(&a.offline, 1)
+				log.Printf("subfs: server for %s is offline, serving cached files only: %s", a.Name, err.Error())
+			}
+		} else {
+			if atomic.LoadInt32(&a.offline) == 1 {
+				log.Printf("subfs: server for %s is back online", a.Name)
+			}
+			atomic.StoreInt64(&a.pingFailures, 0)
+			atomic.StoreInt64(&a.lastContact, time.Now().Unix())
+			atomic.StoreInt32(&a.offline, 0)
+			atomic.StoreInt32(&a.authRejected, 0)
+			a.updateAPIVersion(ping.Version)
+			a.refreshServerInfo(ping.Version, ping.ServerVersion)
+		}
+
+		<-time.After(*pingInterval)
+	}
+}
+
+// isOffline reports whether the server is currently considered unreachable
+func (a *account) isOffline() bool {
+	return atomic.LoadInt32(&a.offline) == 1
+}
+
+// serverStatus describes the state of the server, as shown in .subfs/server
+func (a *account) serverStatus() []byte {
+	state := "online"
+	if a.isOffline() {
+		state = "offline"
+	}
+
+	lastContact := "never"
+	if contact := atomic.LoadInt64(&a.lastContact); contact != 0 {
+		lastContact = time.Unix(contact, 0).Format(time.RFC3339)
+	}
+
+	if a.credentialsRejected() {
+		state = "credentials rejected"
+	}
+
+	status := fmt.Sprintf("state: %s\nhost: %s\nlast contact: %s\nfailed pings: %d\n",
+		state, a.Host, lastContact, atomic.LoadInt64(&a.pingFailures))
+	return append([]byte(status), a.serverInfo().text()...)
+}
+
+// serveMetrics writes the state of each server, and the latency of its API calls, in the Prometheus text format
+func (sfs *Filesystem) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "# HELP subfs_server_up Whether the Subsonic server is reachable.")
+	fmt.Fprintln(w, "# TYPE subfs_server_up gauge")
+	for _, a := range sfs.accounts {
+		up := 1
+		if a.isOffline() {
+			up = 0
+		}
+		fmt.Fprintf(w, "subfs_server_up{account=%q} %d\n", a.Name, up)
+	}
+
+	fmt.Fprintln(w, "# HELP subfs_server_failed_pings Consecutive failed pings of the Subsonic server.")
+	fmt.Fprintln(w, "# TYPE subfs_server_failed_pings gauge")
+	for _, a := range sfs.accounts {
+		fmt.Fprintf(w, "subfs_server_failed_pings{account=%q} %d\n", a.Name, atomic.LoadInt64(&a.pingFailures))
+	}
+
+	sfs.writeAPIMetrics(w)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sort"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// getxattr answers an extended attribute request from a set of attributes
+func getxattr(attrs map[string]string, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) fuse.Error {
+	value, ok := attrs[req.Name]
+	if !ok {
+		return fuse.Errno(syscall.ENODATA)
+	}
+
+	resp.Xattr = []byte(value)
+	return nil
+}
+
+// listxattr answers an extended attribute listing from a set of attributes
+func listxattr(attrs map[string]string, resp *fuse.ListxattrResponse) fuse.Error {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Names are returned as a list of null-terminated strings
+	for _, name := range names {
+		resp.Xattr = append(resp.Xattr, name...)
+		resp.Xattr = append(resp.Xattr, 0)
+	}
+	return nil
+}